@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"distributed-calculator/internal/agent"
+	"distributed-calculator/internal/models"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 func main() {
@@ -18,58 +24,123 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid COMPUTING_POWER: %v", err)
 	}
-	service := agent.NewService(orchestratorURL)
+	
+	pollWait, err := time.ParseDuration(getEnv("POLL_WAIT", "30s"))
+	if err != nil {
+		log.Fatalf("Invalid POLL_WAIT: %v", err)
+	}
+	
+	heartbeatInterval, err := time.ParseDuration(getEnv("HEARTBEAT_INTERVAL", "2s"))
+	if err != nil || heartbeatInterval <= 0 {
+		log.Fatalf("Invalid HEARTBEAT_INTERVAL: must be a positive duration")
+	}
+	
+	flushInterval, err := time.ParseDuration(getEnv("RESULT_FLUSH_INTERVAL", "50ms"))
+	if err != nil || flushInterval < 0 {
+		log.Fatalf("Invalid RESULT_FLUSH_INTERVAL: must be a non-negative duration")
+	}
+	
+	var transport agent.Transport
+	switch transportName := getEnv("AGENT_TRANSPORT", "http"); transportName {
+	case "http":
+		httpTransport := agent.NewHTTPTransport(orchestratorURL, pollWait)
+		if flushInterval > 0 {
+			// Задачи запрашиваются пакетами на всех свободных воркеров, а результаты копятся flushInterval
+			transport = agent.NewBatchTransport(httpTransport, flushInterval)
+		} else {
+			transport = httpTransport
+		}
+	case "grpc":
+		grpcAddr := getEnv("ORCHESTRATOR_GRPC_ADDR", "localhost:9090")
+		grpcTransport, err := agent.NewGRPCTransport(grpcAddr)
+		if err != nil {
+			log.Fatalf("Failed to connect to orchestrator at %s: %v", grpcAddr, err)
+		}
+		log.Printf("Using gRPC transport to %s", grpcAddr)
+		transport = grpcTransport
+	default:
+		log.Fatalf("Invalid AGENT_TRANSPORT: %s (expected http or grpc)", transportName)
+	}
+	defer transport.Close()
+	
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	// По умолчанию ID уникален для каждого запуска: перезапущенный агент не
+	// выдаёт себя за прежний, задачи которого уже освобождены
+	agentID := getEnv("AGENT_ID", hostname+"-"+uuid.NewString()[:8])
+	service := agent.NewService(transport, models.AgentRegistration{
+		ID:         agentID,
+		Hostname:   hostname,
+		Workers:    computingPower,
+		Operations: agent.SupportedOperations,
+		Version:    agent.Version,
+	})
 
-	stopChan := make(chan os.Signal, 1)
-	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+	// Сигнал отменяет контекст, и его видят все воркеры сразу
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	
+	// Если оркестратор ещё не запущен, агент зарегистрируется по первому heartbeat
+	if err := service.Register(ctx); err != nil {
+		log.Printf("Failed to register agent %s: %v", agentID, err)
+	} else {
+		log.Printf("Agent %s registered with %d workers", agentID, computingPower)
+	}
+	go service.RunHeartbeats(ctx, heartbeatInterval)
 
 	var wg sync.WaitGroup
 	
 	for i := 0; i < computingPower; i++ {
 		wg.Add(1)
-		go runWorker(service, i, stopChan, &wg)
+		go runWorker(ctx, service, i, &wg)
 	}
 	
-	<-stopChan
+	<-ctx.Done()
 	log.Println("Shutting down agent...")
 	
 	wg.Wait()
 	log.Println("Agent stopped")
 }
 
-func runWorker(service *agent.Service, id int, stopChan <-chan os.Signal, wg *sync.WaitGroup) {
+func runWorker(ctx context.Context, service *agent.Service, id int, wg *sync.WaitGroup) {
 	defer wg.Done()
 	
 	log.Printf("Worker %d started", id)
 	
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-	
 	for {
-		select {
-		case <-stopChan:
+		task, err := service.GetTask(ctx)
+		// Уже полученную задачу досчитываем, чтобы не ждать истечения её аренды
+		if task == nil && ctx.Err() != nil {
 			log.Printf("Worker %d stopping", id)
 			return
-		case <-ticker.C:
-			task, err := service.GetTask()
-			if err != nil {
-				log.Printf("Worker %d failed to get task: %v", id, err)
-				time.Sleep(1 * time.Second) 
-				continue
-			}
-			
-			if task == nil {
-				continue
-			}
-			
-			log.Printf("Worker %d processing task %s: %s %s %s", id, task.ID, task.Arg1, task.Operation, task.Arg2)
-			if err := service.ProcessTask(task); err != nil {
-				log.Printf("Worker %d failed to process task %s: %v", id, task.ID, err)
-				continue
+		}
+		if err != nil {
+			log.Printf("Worker %d failed to get task: %v", id, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(1 * time.Second):
 			}
-			
-			log.Printf("Worker %d completed task %s", id, task.ID)
+			continue
+		}
+		
+		if task == nil {
+			continue
 		}
+		
+		log.Printf("Worker %d processing task %s: %s(%s)", id, task.ID, task.Operation, strings.Join(task.Args, ", "))
+		err = service.ProcessTask(task)
+		if errors.Is(err, agent.ErrTaskCancelled) {
+			log.Printf("Worker %d dropped task %s: expression was cancelled", id, task.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Worker %d failed to process task %s: %v", id, task.ID, err)
+			continue
+		}
+		
+		log.Printf("Worker %d completed task %s", id, task.ID)
 	}
 }
 
@@ -79,4 +150,4 @@ func getEnv(key, defaultValue string) string {
 		return defaultValue
 	}
 	return value
-}
\ No newline at end of file
+}
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"context"
+	"distributed-calculator/internal/agentpb"
+	"distributed-calculator/internal/calculator"
 	"distributed-calculator/internal/models"
 	"distributed-calculator/internal/orchestrator"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
 )
 
+// shutdownTimeout ограничивает ожидание незавершённых запросов при остановке
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	operationTimes := make(map[models.Operation]int64)
 	
@@ -38,26 +51,197 @@ func main() {
 	}
 	operationTimes[models.Division] = divisionTime
 	
-	repo := orchestrator.NewInMemoryRepository()
+	exponentiationTime, err := strconv.ParseInt(getEnv("TIME_EXPONENTIATION_MS", "3000"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid TIME_EXPONENTIATION_MS: %v", err)
+	}
+	operationTimes[models.Exponentiation] = exponentiationTime
+	
+	// Время вычисления функций задаётся отдельно: TIME_SQRT_MS, TIME_MAX_MS и т.д.
+	for function := range calculator.Functions {
+		key := "TIME_" + strings.ToUpper(string(function)) + "_MS"
+		functionTime, err := strconv.ParseInt(getEnv(key, "1000"), 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", key, err)
+		}
+		operationTimes[function] = functionTime
+	}
+	
+	leaseTimeout, err := strconv.ParseInt(getEnv("TASK_LEASE_TIMEOUT_MS", "5000"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid TASK_LEASE_TIMEOUT_MS: %v", err)
+	}
+	
+	reaperInterval, err := strconv.ParseInt(getEnv("DEADLINE_CHECK_INTERVAL_MS", "100"), 10, 64)
+	if err != nil || reaperInterval <= 0 {
+		log.Fatalf("Invalid DEADLINE_CHECK_INTERVAL_MS: must be a positive number of milliseconds")
+	}
+	
+	agentTimeout, err := strconv.ParseInt(getEnv("AGENT_HEARTBEAT_TIMEOUT_MS", "10000"), 10, 64)
+	if err != nil || agentTimeout <= 0 {
+		log.Fatalf("Invalid AGENT_HEARTBEAT_TIMEOUT_MS: must be a positive number of milliseconds")
+	}
+	
+	webhookAttempts, err := strconv.Atoi(getEnv("WEBHOOK_MAX_ATTEMPTS", "5"))
+	if err != nil || webhookAttempts <= 0 {
+		log.Fatalf("Invalid WEBHOOK_MAX_ATTEMPTS: must be a positive number")
+	}
 	
-	service := orchestrator.NewService(repo, operationTimes)
+	webhookBackoff, err := strconv.ParseInt(getEnv("WEBHOOK_BACKOFF_MS", "1000"), 10, 64)
+	if err != nil || webhookBackoff <= 0 {
+		log.Fatalf("Invalid WEBHOOK_BACKOFF_MS: must be a positive number of milliseconds")
+	}
+	
+	webhookNetworks, err := orchestrator.ParseNetworks(os.Getenv("WEBHOOK_ALLOWED_NETWORKS"))
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOK_ALLOWED_NETWORKS: %v", err)
+	}
+	
+	idempotencyTTL, err := strconv.ParseInt(getEnv("IDEMPOTENCY_KEY_TTL_MS", "86400000"), 10, 64)
+	if err != nil || idempotencyTTL <= 0 {
+		log.Fatalf("Invalid IDEMPOTENCY_KEY_TTL_MS: must be a positive number of milliseconds")
+	}
+	
+	// Заголовку X-Client-ID доверяем, только если его выставляет прокси перед оркестратором
+	trustClientIDHeader, err := strconv.ParseBool(getEnv("TRUST_CLIENT_ID_HEADER", "false"))
+	if err != nil {
+		log.Fatalf("Invalid TRUST_CLIENT_ID_HEADER: must be true or false")
+	}
+	
+	var repo orchestrator.Repository
+	var sqliteRepo *orchestrator.SQLiteRepository
+	switch storage := getEnv("STORAGE", "memory"); storage {
+	case "memory":
+		repo = orchestrator.NewInMemoryRepository()
+	case "sqlite":
+		sqlitePath := getEnv("SQLITE_PATH", "calculator.db")
+		sqliteRepo, err = orchestrator.NewSQLiteRepository(sqlitePath)
+		if err != nil {
+			log.Fatalf("Failed to open SQLite storage %s: %v", sqlitePath, err)
+		}
+		log.Printf("Using SQLite storage at %s", sqlitePath)
+		repo = sqliteRepo
+	default:
+		log.Fatalf("Invalid STORAGE: %s (expected memory or sqlite)", storage)
+	}
+	
+	service := orchestrator.NewService(repo, operationTimes, time.Duration(leaseTimeout)*time.Millisecond)
+	service.SetAgentTimeout(time.Duration(agentTimeout) * time.Millisecond)
+	service.SetIdempotencyTTL(time.Duration(idempotencyTTL) * time.Millisecond)
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		log.Printf("WARNING: WEBHOOK_SECRET is not set, requests to callback_url will NOT be signed and receivers cannot verify that they come from the orchestrator")
+	}
+	webhookSender := orchestrator.NewWebhookSender(webhookSecret, webhookAttempts, time.Duration(webhookBackoff)*time.Millisecond)
+	webhookSender.SetAllowedNetworks(webhookNetworks)
+	service.SetWebhookSender(webhookSender)
+	
+	switch policy := getEnv("SCHEDULING_POLICY", "fair"); policy {
+	case "fair":
+		service.SetScheduler(orchestrator.NewFairScheduler())
+	case "fifo":
+		service.SetScheduler(orchestrator.FIFOScheduler{})
+	case "critical-path":
+		service.SetScheduler(orchestrator.CriticalPathScheduler{})
+	default:
+		log.Fatalf("Invalid SCHEDULING_POLICY: %s (expected fair, fifo or critical-path)", policy)
+	}
+	
+	// Согласуем состояние после возможного падения до того, как начнём принимать запросы
+	if _, err := service.Recover(); err != nil {
+		log.Fatalf("Failed to recover state: %v", err)
+	}
+	
+	// Сигнал останавливает серверы, после чего хранилище закрывается
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	
+	// Выражения с истёкшим сроком переводятся в TIMEOUT, а агенты без heartbeat - в DEAD в фоне
+	go service.RunReaper(ctx, time.Duration(reaperInterval)*time.Millisecond)
 	
 	handlers := orchestrator.NewHandlers(service)
+	handlers.SetTrustClientIDHeader(trustClientIDHeader)
 	
 	router := mux.NewRouter()
+	router.Use(orchestrator.RecoveryMiddleware)
 	
 	apiRouter := router.PathPrefix("/api/v1").Subrouter()
 	apiRouter.HandleFunc("/calculate", handlers.CalculateHandler).Methods("POST")
+	apiRouter.HandleFunc("/calculate/batch", handlers.CalculateBatchHandler).Methods("POST")
+	apiRouter.HandleFunc("/batches/{id}", handlers.GetBatchHandler).Methods("GET")
 	apiRouter.HandleFunc("/expressions", handlers.GetExpressionsHandler).Methods("GET")
 	apiRouter.HandleFunc("/expressions/{id}", handlers.GetExpressionHandler).Methods("GET")
+	apiRouter.HandleFunc("/expressions/{id}", handlers.CancelExpressionHandler).Methods("DELETE")
+	apiRouter.HandleFunc("/expressions/{id}/events", handlers.ExpressionEventsHandler).Methods("GET")
+	apiRouter.HandleFunc("/ws", handlers.WebSocketHandler).Methods("GET")
+	apiRouter.HandleFunc("/agents", handlers.GetAgentsHandler).Methods("GET")
 	
 	internalRouter := router.PathPrefix("/internal").Subrouter()
 	internalRouter.HandleFunc("/task", handlers.GetTaskHandler).Methods("GET")
 	internalRouter.HandleFunc("/task", handlers.ProcessTaskResultHandler).Methods("POST")
+	internalRouter.HandleFunc("/tasks", handlers.GetTasksHandler).Methods("GET")
+	internalRouter.HandleFunc("/tasks/results", handlers.ProcessTaskResultsHandler).Methods("POST")
+	internalRouter.HandleFunc("/agents", handlers.RegisterAgentHandler).Methods("POST")
+	internalRouter.HandleFunc("/agents/{id}/heartbeat", handlers.AgentHeartbeatHandler).Methods("POST")
+	
+	// Агенты могут получать задачи и по gRPC: задачи приходят по постоянному потоку
+	grpcPort := getEnv("GRPC_PORT", "9090")
+	listener, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		log.Fatalf("Failed to listen on gRPC port %s: %v", grpcPort, err)
+	}
+	grpcServer := grpc.NewServer()
+	agentpb.RegisterAgentServiceServer(grpcServer, orchestrator.NewGRPCServer(service))
+	go func() {
+		log.Printf("gRPC server starting on port %s...", grpcPort)
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Printf("gRPC server failed: %v", err)
+			stop()
+		}
+	}()
 	
 	port := getEnv("PORT", "8080")
-	log.Printf("Orchestrator starting on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	// Контексты запросов отменяются сигналом: долгие запросы задач и SSE сразу завершаются
+	srv := &http.Server{
+		Addr:        ":" + port,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		log.Printf("Orchestrator starting on port %s...", port)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server failed: %v", err)
+			stop()
+		}
+	}()
+	
+	<-ctx.Done()
+	log.Printf("Shutting down orchestrator...")
+	
+	// Потоки gRPC и WebSocket сами не завершаются: ждём их не дольше shutdownTimeout
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down HTTP server gracefully: %v", err)
+		srv.Close()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		grpcServer.Stop()
+	}
+	
+	if sqliteRepo != nil {
+		if err := sqliteRepo.Close(); err != nil {
+			log.Printf("Failed to close SQLite storage: %v", err)
+		}
+	}
+	log.Printf("Orchestrator stopped")
 }
 
 func getEnv(key, defaultValue string) string {
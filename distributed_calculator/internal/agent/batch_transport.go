@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// BatchTransport сокращает число запросов к оркестратору по HTTP. Воркеры,
+// одновременно ждущие задачу, получают их одним запросом /internal/tasks, а
+// результаты копятся flushInterval и уходят одним запросом /internal/tasks/results.
+// Для воркеров всё выглядит как обычный Transport: SendTaskResult возвращает
+// итог своего результата после отправки пакета.
+type BatchTransport struct {
+	*HTTPTransport
+	flushInterval time.Duration
+
+	fetchMutex sync.Mutex
+	idle       int            // воркеры, ждущие задачу
+	fetched    []*models.Task // полученные, но ещё не разобранные задачи
+	fetching   chan struct{}  // закрывается по окончании текущего запроса задач
+
+	resultMutex sync.Mutex
+	pending     []pendingResult
+}
+
+type pendingResult struct {
+	request models.TaskResultRequest
+	done    chan error
+}
+
+func NewBatchTransport(transport *HTTPTransport, flushInterval time.Duration) *BatchTransport {
+	return &BatchTransport{
+		HTTPTransport: transport,
+		flushInterval: flushInterval,
+	}
+}
+
+// GetTask отдаёт уже полученную задачу, ждёт запрос, начатый другим воркером,
+// или сам запрашивает задачи для всех простаивающих воркеров. После отмены ctx
+// новые задачи не запрашиваются, но уже полученные, в том числе запросом другого
+// воркера, по-прежнему раздаются, чтобы их досчитали до остановки агента.
+func (t *BatchTransport) GetTask(ctx context.Context, agentID string) (*models.Task, error) {
+	t.fetchMutex.Lock()
+	defer t.fetchMutex.Unlock()
+
+	t.idle++
+	defer func() { t.idle-- }()
+
+	for {
+		if len(t.fetched) > 0 {
+			task := t.fetched[0]
+			t.fetched = t.fetched[1:]
+			return task, nil
+		}
+
+		if t.fetching != nil {
+			// У воркеров агента общий контекст, поэтому при остановке запрос другого
+			// воркера тоже прерывается и ждать его недолго
+			fetching := t.fetching
+			t.fetchMutex.Unlock()
+			<-fetching
+			t.fetchMutex.Lock()
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		max := t.idle
+		fetching := make(chan struct{})
+		t.fetching = fetching
+		t.fetchMutex.Unlock()
+
+		tasks, err := t.HTTPTransport.GetTasks(ctx, agentID, max)
+
+		t.fetchMutex.Lock()
+		t.fetching = nil
+		close(fetching)
+		t.fetched = append(t.fetched, tasks...)
+
+		if err != nil {
+			return nil, err
+		}
+		if len(tasks) == 0 {
+			// Задач не появилось за pollWait: следующий запрос сделает другой воркер
+			return nil, nil
+		}
+	}
+}
+
+func (t *BatchTransport) SendTaskResult(taskID string, result float64) error {
+	return t.submit(models.TaskResultRequest{
+		ID:     taskID,
+		Result: result,
+	})
+}
+
+func (t *BatchTransport) SendTaskFailure(taskID string, message string) error {
+	return t.submit(models.TaskResultRequest{
+		ID:    taskID,
+		Error: message,
+	})
+}
+
+// submit добавляет результат в пакет и ждёт его отправки. Первый результат
+// пакета запускает таймер, по которому пакет отправляется.
+func (t *BatchTransport) submit(request models.TaskResultRequest) error {
+	done := make(chan error, 1)
+
+	t.resultMutex.Lock()
+	t.pending = append(t.pending, pendingResult{request: request, done: done})
+	if len(t.pending) == 1 {
+		time.AfterFunc(t.flushInterval, t.flush)
+	}
+	t.resultMutex.Unlock()
+
+	return <-done
+}
+
+func (t *BatchTransport) flush() {
+	t.resultMutex.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.resultMutex.Unlock()
+
+	requests := make([]models.TaskResultRequest, len(batch))
+	for i, pending := range batch {
+		requests[i] = pending.request
+		// Бесконечность или NaN не закодировать в JSON, и из-за одного результата
+		// не ушёл бы весь пакет. Такой результат отправляется как ошибка задачи.
+		if result := requests[i].Result; requests[i].Error == "" && (math.IsInf(result, 0) || math.IsNaN(result)) {
+			requests[i].Error = fmt.Sprintf("result %g is not a finite number", result)
+			requests[i].Result = 0
+		}
+	}
+
+	// Результаты отправляются и во время остановки агента, поэтому не зависят от контекста воркеров
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	errs, err := t.HTTPTransport.SendTaskResults(ctx, requests)
+	for i, pending := range batch {
+		if err != nil {
+			pending.done <- err
+			continue
+		}
+		pending.done <- errs[i]
+	}
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchTransportFetchesForIdleWorkers(t *testing.T) {
+	var mu sync.Mutex
+	batches := []int{}
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		mu.Lock()
+		batches = append(batches, max)
+		first := len(batches) == 1
+		mu.Unlock()
+
+		// Первый запрос держим, пока все воркеры не станут ждать задачу
+		if first {
+			<-release
+		}
+
+		response := models.TaskListResponse{Tasks: []*models.Task{}}
+		for i := 0; i < max; i++ {
+			response.Tasks = append(response.Tasks, &models.Task{ID: fmt.Sprintf("t%d-%d", len(batches), i)})
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	transport := NewBatchTransport(NewHTTPTransport(server.URL, time.Second), 10*time.Millisecond)
+
+	tasks := make(chan *models.Task, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			task, err := transport.GetTask(context.Background(), "agent")
+			if err != nil {
+				t.Errorf("Failed to get task: %v", err)
+			}
+			tasks <- task
+		}()
+	}
+
+	for {
+		transport.fetchMutex.Lock()
+		idle := transport.idle
+		transport.fetchMutex.Unlock()
+		if idle == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		task := <-tasks
+		if task == nil || seen[task.ID] {
+			t.Fatalf("Expected distinct tasks, got %+v", task)
+		}
+		seen[task.ID] = true
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if total := sum(batches); len(batches) > 2 || total != 4 {
+		t.Errorf("Expected 4 tasks in at most 2 requests, got batches %v", batches)
+	}
+}
+
+func TestBatchTransportHandsOutFetchedTasksOnShutdown(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+
+		// Оркестратор выдал больше задач, чем воркер успеет взять до остановки
+		response := models.TaskListResponse{Tasks: []*models.Task{{ID: "t1"}, {ID: "t2"}, {ID: "t3"}}}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	transport := NewBatchTransport(NewHTTPTransport(server.URL, time.Second), 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if task, err := transport.GetTask(ctx, "agent"); err != nil || task == nil || task.ID != "t1" {
+		t.Fatalf("Expected t1, got %+v (%v)", task, err)
+	}
+	cancel()
+
+	for _, expected := range []string{"t2", "t3"} {
+		if task, err := transport.GetTask(ctx, "agent"); err != nil || task == nil || task.ID != expected {
+			t.Errorf("Expected fetched %s after shutdown, got %+v (%v)", expected, task, err)
+		}
+	}
+	if task, err := transport.GetTask(ctx, "agent"); task != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected no more tasks after shutdown, got %+v (%v)", task, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("Expected no requests after shutdown, got %d", requests)
+	}
+}
+
+func TestBatchTransportBuffersResults(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+
+	received := make(map[string]models.TaskResultRequest)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var results []models.TaskResultRequest
+		if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+			t.Errorf("Failed to decode results: %v", err)
+		}
+		mu.Lock()
+		requests++
+		for _, result := range results {
+			received[result.ID] = result
+		}
+		mu.Unlock()
+
+		response := models.TaskResultListResponse{}
+		for _, result := range results {
+			status := http.StatusOK
+			if result.ID == "cancelled" {
+				status = http.StatusGone
+			}
+			response.Results = append(response.Results, models.TaskResultStatus{ID: result.ID, Status: status})
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	transport := NewBatchTransport(NewHTTPTransport(server.URL, time.Second), 50*time.Millisecond)
+
+	errs := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, id := range []string{"t1", "t2", "overflow", "cancelled"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			var err error
+			switch id {
+			case "t2":
+				err = transport.SendTaskFailure(id, "division by zero")
+			case "overflow":
+				err = transport.SendTaskResult(id, math.Inf(1))
+			default:
+				err = transport.SendTaskResult(id, 1)
+			}
+			mu.Lock()
+			errs[id] = err
+			mu.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	if requests != 1 {
+		t.Errorf("Expected results to be sent in one request, got %d", requests)
+	}
+	if errs["t1"] != nil || errs["t2"] != nil || errs["overflow"] != nil || !errors.Is(errs["cancelled"], ErrTaskCancelled) {
+		t.Errorf("Unexpected results: %v", errs)
+	}
+	// Бесконечный результат не помешал отправить пакет и дошёл как ошибка задачи
+	if overflow := received["overflow"]; overflow.Error == "" || received["t1"].Result != 1 {
+		t.Errorf("Expected overflow to be reported as failure, got %+v", received)
+	}
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
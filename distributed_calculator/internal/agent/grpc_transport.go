@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"context"
+	"distributed-calculator/internal/agentpb"
+	"distributed-calculator/internal/models"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCTransport держит один поток GetTask на весь агент: каждый свободный воркер
+// отправляет по нему запрос, а оркестратор присылает задачу, когда она готова.
+// Если поток оборвался, следующий запрос задачи открывает его заново.
+type GRPCTransport struct {
+	conn   *grpc.ClientConn
+	client agentpb.AgentServiceClient
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	stream   *taskStream
+	draining bool // агент останавливается: новые задачи не запрашиваются
+}
+
+var errTransportDraining = errors.New("agent is shutting down")
+
+// taskStream - открытый поток GetTask. receive передаёт пришедшие по нему задачи
+// в tasks и закрывает done, когда поток обрывается.
+type taskStream struct {
+	stream agentpb.AgentService_GetTaskClient
+	tasks  chan *models.Task
+	done   chan struct{}
+	err    error
+}
+
+// target - адрес gRPC-сервера оркестратора, например orchestrator:9090
+func NewGRPCTransport(target string) (*GRPCTransport, error) {
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &GRPCTransport{
+		conn:   conn,
+		client: agentpb.NewAgentServiceClient(conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (t *GRPCTransport) Register(ctx context.Context, registration models.AgentRegistration) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	operations := make([]string, 0, len(registration.Operations))
+	for _, operation := range registration.Operations {
+		operations = append(operations, string(operation))
+	}
+
+	_, err := t.client.Register(ctx, &agentpb.RegisterRequest{
+		AgentId:    registration.ID,
+		Hostname:   registration.Hostname,
+		Workers:    int32(registration.Workers),
+		Operations: operations,
+		Version:    registration.Version,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register agent: %w", err)
+	}
+	return nil
+}
+
+// GetTask ждёт, пока оркестратор пришлёт задачу. Отмена ctx означает остановку
+// агента: новые задачи больше не запрашиваются, а задачи, выданные по уже
+// отправленным запросам, возвращаются следующим вызовам GetTask (см. drain).
+func (t *GRPCTransport) GetTask(ctx context.Context, agentID string) (*models.Task, error) {
+	if ctx.Err() != nil {
+		return t.drain(ctx)
+	}
+
+	stream, err := t.request(agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case task := <-stream.tasks:
+		return task, nil
+	case <-stream.done:
+		return nil, fmt.Errorf("task stream closed: %w", stream.err)
+	case <-ctx.Done():
+		return t.drain(ctx)
+	}
+}
+
+// drain закрывает отправку запросов и ждёт задачу, выданную по одному из уже
+// отправленных. Оркестратор, увидев закрытие, перестаёт ждать задачи и закрывает
+// поток после уже отправленных, поэтому ни одна выданная задача не теряется.
+// Если задач больше не будет, возвращает ошибку ctx.
+func (t *GRPCTransport) drain(ctx context.Context) (*models.Task, error) {
+	t.mu.Lock()
+	stream := t.stream
+	if stream != nil && !t.draining {
+		_ = stream.stream.CloseSend()
+	}
+	t.draining = true
+	t.mu.Unlock()
+
+	if stream == nil {
+		return nil, ctx.Err()
+	}
+
+	select {
+	case task := <-stream.tasks:
+		return task, nil
+	case <-stream.done:
+		return nil, ctx.Err()
+	case <-time.After(requestTimeout):
+		// Оркестратор не закрыл поток: его задачи освободятся, когда агент перестанет слать heartbeat
+		return nil, ctx.Err()
+	}
+}
+
+// request просит у оркестратора ещё одну задачу, при необходимости открывая поток заново
+func (t *GRPCTransport) request(agentID string) (*taskStream, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return nil, errTransportDraining
+	}
+
+	if t.stream != nil {
+		select {
+		case <-t.stream.done:
+			t.stream = nil
+		default:
+		}
+	}
+
+	if t.stream == nil {
+		stream, err := t.client.GetTask(t.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open task stream: %w", err)
+		}
+		t.stream = &taskStream{stream: stream, tasks: make(chan *models.Task), done: make(chan struct{})}
+		go t.stream.receive(t.ctx)
+	}
+
+	if err := t.stream.stream.Send(&agentpb.TaskRequest{AgentId: agentID}); err != nil {
+		// Поток оборван: следующий запрос откроет новый
+		t.stream = nil
+		return nil, fmt.Errorf("failed to request task: %w", err)
+	}
+
+	return t.stream, nil
+}
+
+func (s *taskStream) receive(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		task, err := s.stream.Recv()
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		select {
+		case s.tasks <- taskFromProto(task):
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return
+		}
+	}
+}
+
+func (t *GRPCTransport) SendTaskResult(taskID string, result float64) error {
+	// Результат отправляется и во время остановки агента, поэтому не зависит от контекста воркера
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := t.client.SubmitResult(ctx, &agentpb.SubmitResultRequest{Id: taskID, Result: result})
+	return taskResultError(err)
+}
+
+func (t *GRPCTransport) SendTaskFailure(taskID string, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := t.client.ReportFailure(ctx, &agentpb.ReportFailureRequest{Id: taskID, Error: message})
+	return taskResultError(err)
+}
+
+func (t *GRPCTransport) Heartbeat(ctx context.Context, agentID string, taskIDs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	response, err := t.client.Heartbeat(ctx, &agentpb.HeartbeatRequest{AgentId: agentID, TaskIds: taskIDs})
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrAgentNotRegistered
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response.GetCancelledTaskIds(), nil
+}
+
+// Close обрывает поток задач и закрывает соединение
+func (t *GRPCTransport) Close() error {
+	t.cancel()
+	return t.conn.Close()
+}
+
+// taskResultError переводит код gRPC в ошибку так же, как HTTPTransport переводит статус ответа
+func taskResultError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if status.Code(err) == codes.Aborted {
+		return ErrTaskCancelled
+	}
+	return fmt.Errorf("failed to send task result: %w", err)
+}
+
+func taskFromProto(task *agentpb.Task) *models.Task {
+	return &models.Task{
+		ID:            task.GetId(),
+		Args:          task.GetArgs(),
+		Operation:     models.Operation(task.GetOperation()),
+		OperationTime: task.GetOperationTime(),
+	}
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"context"
+	"distributed-calculator/internal/agentpb"
+	"distributed-calculator/internal/models"
+	"distributed-calculator/internal/orchestrator"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startOrchestrator поднимает gRPC-сервер оркестратора на свободном порту
+func startOrchestrator(t *testing.T, operationTimes map[models.Operation]int64) (*orchestrator.Service, *Service) {
+	t.Helper()
+
+	service := orchestrator.NewService(orchestrator.NewInMemoryRepository(), operationTimes, time.Minute)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	agentpb.RegisterAgentServiceServer(server, orchestrator.NewGRPCServer(service))
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	transport, err := NewGRPCTransport(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	t.Cleanup(func() { _ = transport.Close() })
+
+	agentService := NewService(transport, testRegistration)
+	if err := agentService.Register(context.Background()); err != nil {
+		t.Fatalf("Failed to register agent: %v", err)
+	}
+
+	return service, agentService
+}
+
+func TestGRPCTransportComputesExpression(t *testing.T) {
+	orchestratorService, agentService := startOrchestrator(t, map[models.Operation]int64{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Воркеры запрашивают задачи раньше, чем выражение отправлено: задачи придут по потоку
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				task, err := agentService.GetTask(ctx)
+				if err != nil {
+					return
+				}
+				if err := agentService.ProcessTask(task); err != nil {
+					t.Errorf("Failed to process task: %v", err)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	expression, err := orchestratorService.ProcessExpression("(1 + 2) * (3 + 4) - 5")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stored, _ := orchestratorService.GetExpressionByID(expression.ID)
+		if stored.Status == models.StatusCompleted {
+			if *stored.Result != 16 {
+				t.Errorf("Expected 16, got %v", *stored.Result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expression was not computed: %+v", stored)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestGRPCHeartbeatStopsCancelledTask(t *testing.T) {
+	orchestratorService, agentService := startOrchestrator(t, map[models.Operation]int64{models.Addition: 60000})
+
+	expression, err := orchestratorService.ProcessExpression("1 + 2")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	task, err := agentService.GetTask(context.Background())
+	if err != nil || task == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", task, err)
+	}
+
+	processed := make(chan error, 1)
+	go func() { processed <- agentService.ProcessTask(task) }()
+
+	// Пока задача вычисляется, heartbeat продлевает её аренду
+	time.Sleep(50 * time.Millisecond)
+	if err := agentService.Heartbeat(context.Background()); err != nil {
+		t.Fatalf("Failed to send heartbeat: %v", err)
+	}
+	agents := orchestratorService.GetAgents()
+	if len(agents) != 1 || agents[0].ID != "test-agent" || agents[0].ActiveTasks != 1 || agents[0].Status != models.AgentAlive {
+		t.Errorf("Expected registered agent with one task, got %+v", agents)
+	}
+
+	if _, err := orchestratorService.CancelExpression(expression.ID); err != nil {
+		t.Fatalf("Failed to cancel expression: %v", err)
+	}
+	if err := agentService.Heartbeat(context.Background()); err != nil {
+		t.Fatalf("Failed to send heartbeat: %v", err)
+	}
+
+	select {
+	case err := <-processed:
+		if !errors.Is(err, ErrTaskCancelled) {
+			t.Errorf("Expected ErrTaskCancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Cancelled task was not stopped")
+	}
+
+	if err := agentService.SendTaskResult(task.ID, 3); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Expected ErrTaskCancelled for late result, got %v", err)
+	}
+}
+
+func TestGRPCTransportDrainsTasksOnShutdown(t *testing.T) {
+	orchestratorService, agentService := startOrchestrator(t, map[models.Operation]int64{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		task *models.Task
+		err  error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			task, err := agentService.GetTask(ctx)
+			results <- result{task, err}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	expression, err := orchestratorService.ProcessExpression("1 + 2")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	// Останавливаемся, когда задача уже выдана агенту
+	deadline := time.Now().Add(5 * time.Second)
+	for agents := orchestratorService.GetAgents(); len(agents) != 1 || agents[0].ActiveTasks != 1; agents = orchestratorService.GetAgents() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Task was not handed out: %+v", agents)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	// Выданная задача достаётся воркеру, а второй запрос завершается, не дожидаясь таймаута
+	var drained []*models.Task
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.task != nil {
+				drained = append(drained, r.task)
+			} else if !errors.Is(r.err, context.Canceled) {
+				t.Errorf("Expected context.Canceled, got %v", r.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("GetTask did not return after shutdown")
+		}
+	}
+	if len(drained) != 1 {
+		t.Fatalf("Expected the handed out task to be drained, got %+v", drained)
+	}
+	if task, err := agentService.GetTask(ctx); task != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected no more tasks after shutdown, got %+v (%v)", task, err)
+	}
+
+	if err := agentService.ProcessTask(drained[0]); err != nil {
+		t.Fatalf("Failed to process drained task: %v", err)
+	}
+	if stored, _ := orchestratorService.GetExpressionByID(expression.ID); stored.Status != models.StatusCompleted {
+		t.Errorf("Expected expression to complete, got %+v", stored)
+	}
+}
+
+func TestGRPCRejectsNonFiniteResult(t *testing.T) {
+	orchestratorService, agentService := startOrchestrator(t, map[models.Operation]int64{})
+
+	expression, err := orchestratorService.ProcessExpression("1 + 2")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, err := agentService.GetTask(context.Background())
+	if err != nil || task == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", task, err)
+	}
+
+	if err := agentService.SendTaskResult(task.ID, math.Inf(1)); status.Code(errors.Unwrap(err)) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for +Inf result, got %v", err)
+	}
+	if stored, _ := orchestratorService.GetExpressionByID(expression.ID); stored.Status != models.StatusProcessing {
+		t.Errorf("Expected expression to stay in PROCESSING, got %+v", stored)
+	}
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"distributed-calculator/internal/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPTransport получает задачи long-poll запросами к /internal/task
+type HTTPTransport struct {
+	orchestratorURL string
+	client          *http.Client
+	pollWait        time.Duration
+}
+
+// pollWait - сколько оркестратор держит запрос задачи, если готовых задач нет
+func NewHTTPTransport(orchestratorURL string, pollWait time.Duration) *HTTPTransport {
+	return &HTTPTransport{
+		orchestratorURL: orchestratorURL,
+		client:          &http.Client{},
+		pollWait:        pollWait,
+	}
+}
+
+func (t *HTTPTransport) Register(ctx context.Context, registration models.AgentRegistration) error {
+	resp, err := t.post(ctx, "/internal/agents", registration)
+	if err != nil {
+		return fmt.Errorf("failed to register agent: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// GetTask ждёт задачу не дольше pollWait и возвращает nil, если её так и не появилось
+func (t *HTTPTransport) GetTask(ctx context.Context, agentID string) (*models.Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.pollWait+requestTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/internal/task?wait=%s", t.orchestratorURL, t.pollWait)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if agentID != "" {
+		req.Header.Set("X-Agent-ID", agentID)
+	}
+
+	// Отправляем GET-запрос к оркестратору
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response models.TaskResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return response.Task, nil
+}
+
+// GetTasks ждёт задачи не дольше pollWait и возвращает до max задач, готовых к этому моменту
+func (t *HTTPTransport) GetTasks(ctx context.Context, agentID string, max int) ([]*models.Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.pollWait+requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/internal/tasks?max=%d&wait=%s", t.orchestratorURL, max, t.pollWait), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if agentID != "" {
+		req.Header.Set("X-Agent-ID", agentID)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tasks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response models.TaskListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return response.Tasks, nil
+}
+
+// SendTaskResults отправляет пакет результатов одним запросом и возвращает
+// итог для каждого из них: nil, ErrTaskCancelled или ошибку оркестратора
+func (t *HTTPTransport) SendTaskResults(ctx context.Context, requests []models.TaskResultRequest) ([]error, error) {
+	resp, err := t.post(ctx, "/internal/tasks/results", requests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send task results: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response models.TaskResultListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(response.Results) != len(requests) {
+		return nil, fmt.Errorf("expected %d results, got %d", len(requests), len(response.Results))
+	}
+
+	errs := make([]error, len(requests))
+	for i, result := range response.Results {
+		switch result.Status {
+		case http.StatusOK:
+		case http.StatusGone:
+			errs[i] = ErrTaskCancelled
+		default:
+			errs[i] = fmt.Errorf("unexpected status code %d: %s", result.Status, result.Error)
+		}
+	}
+	return errs, nil
+}
+
+func (t *HTTPTransport) SendTaskResult(taskID string, result float64) error {
+	return t.sendTaskResult(models.TaskResultRequest{
+		ID:     taskID,
+		Result: result,
+	})
+}
+
+func (t *HTTPTransport) SendTaskFailure(taskID string, message string) error {
+	return t.sendTaskResult(models.TaskResultRequest{
+		ID:    taskID,
+		Error: message,
+	})
+}
+
+func (t *HTTPTransport) sendTaskResult(request models.TaskResultRequest) error {
+	// Результат отправляется и во время остановки агента, поэтому не зависит от контекста воркера
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := t.post(ctx, "/internal/task", request)
+	if err != nil {
+		return fmt.Errorf("failed to send task result: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return ErrTaskCancelled
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (t *HTTPTransport) Heartbeat(ctx context.Context, agentID string, taskIDs []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	resp, err := t.post(ctx, fmt.Sprintf("/internal/agents/%s/heartbeat", url.PathEscape(agentID)), models.HeartbeatRequest{TaskIDs: taskIDs})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrAgentNotRegistered
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response models.HeartbeatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return response.CancelledTaskIDs, nil
+}
+
+// post отправляет body в формате JSON по пути path оркестратора
+func (t *HTTPTransport) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.orchestratorURL+path, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return t.client.Do(req)
+}
+
+func (t *HTTPTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
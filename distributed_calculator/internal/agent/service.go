@@ -1,111 +1,286 @@
 package agent
 
 import (
-	"bytes"
+	"context"
 	"distributed-calculator/internal/models"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"log"
+	"math"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+var (
+	// ErrTaskCancelled означает, что выражение задачи отменено и её результат больше не нужен
+	ErrTaskCancelled = errors.New("task was cancelled by orchestrator")
+	// ErrAgentNotRegistered означает, что оркестратор не знает агента, например после перезапуска
+	ErrAgentNotRegistered = errors.New("agent is not registered by orchestrator")
+)
+
+// Version - версия агента, сообщаемая оркестратору при регистрации.
+// Задаётся при сборке: -ldflags "-X distributed-calculator/internal/agent.Version=1.2.0"
+var Version = "dev"
+
+// SupportedOperations - операции, которые умеет вычислять агент
+var SupportedOperations = []models.Operation{
+	models.Addition, models.Subtraction, models.Multiplication, models.Division, models.Exponentiation,
+	models.Sqrt, models.Abs, models.Min, models.Max, models.Round, models.Log, models.Sin, models.Cos,
+}
+
 type Service struct {
-	orchestratorURL string
-	client          *http.Client
+	transport    Transport
+	registration models.AgentRegistration
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc
 }
 
-func NewService(orchestratorURL string) *Service {
+// registration - то, что агент сообщает о себе оркестратору; ID обязателен
+func NewService(transport Transport, registration models.AgentRegistration) *Service {
 	return &Service{
-		orchestratorURL: orchestratorURL,
-		client: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		transport:    transport,
+		registration: registration,
+		inflight:     make(map[string]context.CancelFunc),
 	}
 }
 
-func (s *Service) GetTask() (*models.Task, error) {
-	// Отправляем GET-запрос к оркестратору
-	resp, err := s.client.Get(fmt.Sprintf("%s/internal/task", s.orchestratorURL))
+// Register сообщает оркестратору об агенте. Незарегистрированный агент тоже
+// получает задачи, но оркестратор не видит его в реестре и не замечает его падения.
+func (s *Service) Register(ctx context.Context) error {
+	return s.transport.Register(ctx, s.registration)
+}
+
+// GetTask ждёт задачу от оркестратора и возвращает nil, если её так и не появилось.
+// Отмена ctx прерывает ожидание.
+func (s *Service) GetTask(ctx context.Context) (*models.Task, error) {
+	return s.transport.GetTask(ctx, s.registration.ID)
+}
+
+func (s *Service) ProcessTask(task *models.Task) error {
+	result, err := evaluate(task)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get task: %w", err)
+		// Сообщаем оркестратору, чтобы выражение не зависло в PROCESSING
+		reportErr := s.SendTaskFailure(task.ID, err.Error())
+		if errors.Is(reportErr, ErrTaskCancelled) {
+			return reportErr
+		}
+		if reportErr != nil {
+			return fmt.Errorf("%v (failed to report failure: %w)", err, reportErr)
+		}
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, nil
+	ctx, done := s.track(task.ID)
+	defer done()
+
+	timer := time.NewTimer(time.Duration(task.OperationTime) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		// Оркестратор сообщил в ответ на heartbeat, что выражение отменено
+		return ErrTaskCancelled
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	return s.SendTaskResult(task.ID, result)
+}
+
+// track запоминает задачу как вычисляемую до вызова done.
+// Контекст отменяется, если выражение задачи отменят.
+func (s *Service) track(taskID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.mu.Lock()
+	s.inflight[taskID] = cancel
+	s.mu.Unlock()
+
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.inflight, taskID)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// Heartbeat сообщает оркестратору, что агент жив, продлевает аренду вычисляемых
+// задач и прерывает вычисление задач, выражения которых отменены. Если оркестратор
+// не знает агента, агент регистрируется заново.
+func (s *Service) Heartbeat(ctx context.Context) error {
+	s.mu.Lock()
+	taskIDs := make([]string, 0, len(s.inflight))
+	for id := range s.inflight {
+		taskIDs = append(taskIDs, id)
+	}
+	s.mu.Unlock()
+
+	cancelled, err := s.transport.Heartbeat(ctx, s.registration.ID, taskIDs)
+	if errors.Is(err, ErrAgentNotRegistered) {
+		return s.Register(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send heartbeat: %w", err)
 	}
 
-	var response models.TaskResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range cancelled {
+		if cancel, exists := s.inflight[id]; exists {
+			cancel()
+		}
 	}
 
-	return response.Task, nil
+	return nil
 }
 
-func (s *Service) ProcessTask(task *models.Task) error {
+// RunHeartbeats отправляет heartbeat каждые interval, пока не отменён ctx
+func (s *Service) RunHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Heartbeat(ctx); err != nil {
+				log.Printf("Failed to send heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+func evaluate(task *models.Task) (float64, error) {
 	// Преобразуем аргументы в числа
-	arg1, err := strconv.ParseFloat(task.Arg1, 64)
-	if err != nil {
-		return fmt.Errorf("invalid arg1: %w", err)
+	args := make([]float64, len(task.Args))
+	for i, arg := range task.Args {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid argument %d: %w", i+1, err)
+		}
+		args[i] = value
 	}
 
-	arg2, err := strconv.ParseFloat(task.Arg2, 64)
+	result, err := compute(task.Operation, args)
 	if err != nil {
-		return fmt.Errorf("invalid arg2: %w", err)
+		return 0, err
+	}
+	// Бесконечность и NaN нельзя передать оркестратору (JSON их не поддерживает),
+	// поэтому переполнение считается ошибкой вычисления
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, fmt.Errorf("%s(%s) is out of range", task.Operation, strings.Join(task.Args, ", "))
 	}
+	return result, nil
+}
 
-	var result float64
-	switch task.Operation {
+func compute(operation models.Operation, args []float64) (float64, error) {
+	switch operation {
+	case models.Addition, models.Subtraction, models.Multiplication, models.Division, models.Exponentiation:
+		if len(args) != 2 {
+			return 0, fmt.Errorf("operation %s expects 2 arguments, got %d", operation, len(args))
+		}
+		return computeBinary(operation, args[0], args[1])
+	case models.Min, models.Max:
+		if len(args) == 0 {
+			return 0, fmt.Errorf("%s expects at least 1 argument", operation)
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			if operation == models.Min {
+				result = math.Min(result, arg)
+			} else {
+				result = math.Max(result, arg)
+			}
+		}
+		return result, nil
+	case models.Log:
+		if len(args) == 2 {
+			return logarithm(args[0], args[1])
+		}
+	}
+
+	if len(args) != 1 {
+		return 0, fmt.Errorf("unknown operation %s with %d arguments", operation, len(args))
+	}
+	return computeUnary(operation, args[0])
+}
+
+func computeBinary(operation models.Operation, arg1, arg2 float64) (float64, error) {
+	switch operation {
 	case models.Addition:
-		result = arg1 + arg2
+		return arg1 + arg2, nil
 	case models.Subtraction:
-		result = arg1 - arg2
+		return arg1 - arg2, nil
 	case models.Multiplication:
-		result = arg1 * arg2
+		return arg1 * arg2, nil
 	case models.Division:
 		if arg2 == 0 {
-			return fmt.Errorf("division by zero")
+			return 0, fmt.Errorf("division by zero")
 		}
-		result = arg1 / arg2
-	default:
-		return fmt.Errorf("unknown operation: %s", task.Operation)
+		return arg1 / arg2, nil
+	case models.Exponentiation:
+		return power(arg1, arg2)
 	}
-
-	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
-
-	return s.SendTaskResult(task.ID, result)
+	return 0, fmt.Errorf("unknown operation: %s", operation)
 }
 
-func (s *Service) SendTaskResult(taskID string, result float64) error {
-	request := models.TaskResultRequest{
-		ID:     taskID,
-		Result: result,
+func computeUnary(operation models.Operation, arg float64) (float64, error) {
+	switch operation {
+	case models.Sqrt:
+		if arg < 0 {
+			return 0, fmt.Errorf("square root of negative number %g", arg)
+		}
+		return math.Sqrt(arg), nil
+	case models.Abs:
+		return math.Abs(arg), nil
+	case models.Round:
+		return math.Round(arg), nil
+	case models.Log:
+		if arg <= 0 {
+			return 0, fmt.Errorf("logarithm of non-positive number %g", arg)
+		}
+		return math.Log(arg), nil
+	case models.Sin:
+		return math.Sin(arg), nil
+	case models.Cos:
+		return math.Cos(arg), nil
 	}
+	return 0, fmt.Errorf("unknown operation: %s", operation)
+}
 
-	body, err := json.Marshal(request)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+// logarithm вычисляет log(x, base) - логарифм x по основанию base
+func logarithm(x, base float64) (float64, error) {
+	if x <= 0 {
+		return 0, fmt.Errorf("logarithm of non-positive number %g", x)
 	}
+	if base <= 0 || base == 1 {
+		return 0, fmt.Errorf("invalid logarithm base %g", base)
+	}
+	return math.Log(x) / math.Log(base), nil
+}
 
-	resp, err := s.client.Post(
-		fmt.Sprintf("%s/internal/task", s.orchestratorURL),
-		"application/json",
-		bytes.NewBuffer(body),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to send task result: %w", err)
+func power(base, exponent float64) (float64, error) {
+	if base < 0 && exponent != math.Trunc(exponent) {
+		return 0, fmt.Errorf("negative base %g with fractional exponent %g", base, exponent)
+	}
+	if base == 0 && exponent < 0 {
+		return 0, fmt.Errorf("zero raised to negative power %g", exponent)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	result := math.Pow(base, exponent)
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, fmt.Errorf("%g ^ %g is out of range", base, exponent)
 	}
+	return result, nil
+}
 
-	return nil
-}
\ No newline at end of file
+func (s *Service) SendTaskResult(taskID string, result float64) error {
+	return s.transport.SendTaskResult(taskID, result)
+}
+
+func (s *Service) SendTaskFailure(taskID string, message string) error {
+	return s.transport.SendTaskFailure(taskID, message)
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestComputeExponentiation(t *testing.T) {
+	tests := []struct {
+		base     float64
+		exponent float64
+		expected float64
+	}{
+		{2, 10, 1024},
+		{-2, 3, -8},
+		{4, 0.5, 2},
+		{2, -1, 0.5},
+		{0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		result, err := compute(models.Exponentiation, []float64{tt.base, tt.exponent})
+		if err != nil {
+			t.Errorf("Unexpected error for %g ^ %g: %v", tt.base, tt.exponent, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("Expected %g ^ %g = %g, got %g", tt.base, tt.exponent, tt.expected, result)
+		}
+	}
+}
+
+func TestComputeDomainErrors(t *testing.T) {
+	tests := []struct {
+		operation models.Operation
+		args      []float64
+	}{
+		{models.Division, []float64{1, 0}},
+		{models.Exponentiation, []float64{-8, 1.0 / 3}},
+		{models.Exponentiation, []float64{0, -1}},
+		{models.Exponentiation, []float64{10, 400}},
+		{models.Operation("%"), []float64{1, 2}},
+		{models.Addition, []float64{1}},
+		{models.Sqrt, []float64{-4}},
+		{models.Log, []float64{0}},
+		{models.Log, []float64{8, 1}},
+		{models.Max, []float64{}},
+		{models.Sin, []float64{1, 2}},
+	}
+
+	for _, tt := range tests {
+		if result, err := compute(tt.operation, tt.args); err == nil {
+			t.Errorf("Expected error for %s%v, got %g", tt.operation, tt.args, result)
+		}
+	}
+}
+
+func TestComputeFunctions(t *testing.T) {
+	tests := []struct {
+		operation models.Operation
+		args      []float64
+		expected  float64
+	}{
+		{models.Sqrt, []float64{16}, 4},
+		{models.Abs, []float64{-2.5}, 2.5},
+		{models.Min, []float64{3, -1, 2}, -1},
+		{models.Max, []float64{3, -1, 2}, 3},
+		{models.Max, []float64{7}, 7},
+		{models.Round, []float64{2.5}, 3},
+		{models.Log, []float64{1}, 0},
+		{models.Log, []float64{8, 2}, 3},
+		{models.Sin, []float64{0}, 0},
+		{models.Cos, []float64{0}, 1},
+	}
+
+	for _, tt := range tests {
+		result, err := compute(tt.operation, tt.args)
+		if err != nil {
+			t.Errorf("Unexpected error for %s%v: %v", tt.operation, tt.args, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("Expected %s%v = %g, got %g", tt.operation, tt.args, tt.expected, result)
+		}
+	}
+}
+
+var testRegistration = models.AgentRegistration{ID: "test-agent", Hostname: "test", Workers: 1, Operations: SupportedOperations, Version: Version}
+
+func TestProcessTaskReportsFailure(t *testing.T) {
+	var received models.TaskResultRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	service := NewService(NewHTTPTransport(server.URL, time.Second), testRegistration)
+	task := &models.Task{ID: "t1", Args: []string{"1", "0"}, Operation: models.Division}
+
+	if err := service.ProcessTask(task); err == nil {
+		t.Errorf("Expected division by zero error")
+	}
+	if received.ID != "t1" || received.Error != "division by zero" {
+		t.Errorf("Expected failure to be reported to orchestrator, got %+v", received)
+	}
+}
+
+func TestProcessTaskReportsOverflow(t *testing.T) {
+	var received models.TaskResultRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = models.TaskResultRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	service := NewService(NewHTTPTransport(server.URL, time.Second), testRegistration)
+	for _, task := range []*models.Task{
+		{ID: "t1", Args: []string{"1e308", "10"}, Operation: models.Multiplication},
+		{ID: "t2", Args: []string{"1e308", "1e308"}, Operation: models.Addition},
+		{ID: "t3", Args: []string{"-1e308", "1e308"}, Operation: models.Subtraction},
+	} {
+		// Переполнение отправляется как ошибка, а не как результат, который не закодировать в JSON
+		if err := service.ProcessTask(task); err == nil {
+			t.Errorf("Expected overflow error for %s%v", task.Operation, task.Args)
+		}
+		if received.ID != task.ID || received.Error == "" {
+			t.Errorf("Expected overflow of %s to be reported as failure, got %+v", task.ID, received)
+		}
+	}
+}
+
+func TestSendTaskResultReportsCancellation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	service := NewService(NewHTTPTransport(server.URL, time.Second), testRegistration)
+	if err := service.SendTaskResult("t1", 1); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Expected ErrTaskCancelled for 410 response, got %v", err)
+	}
+}
+
+func TestGetTaskLongPolls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := r.URL.Query().Get("wait"); wait != "30s" {
+			t.Errorf("Expected wait=30s, got %q", wait)
+		}
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(models.TaskResponse{Task: &models.Task{ID: "t1", Args: []string{"1", "2"}, Operation: models.Addition}})
+	}))
+	defer server.Close()
+
+	service := NewService(NewHTTPTransport(server.URL, 30*time.Second), testRegistration)
+	task, err := service.GetTask(context.Background())
+	if err != nil || task == nil || task.ID != "t1" {
+		t.Errorf("Expected task t1, got %+v (%v)", task, err)
+	}
+}
+
+func TestGetTaskStopsOnCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Оркестратор держит запрос, пока агент не отключится
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	service := NewService(NewHTTPTransport(server.URL, time.Minute), testRegistration)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	task, err := service.GetTask(ctx)
+	if task != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation error, got %+v (%v)", task, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetTask did not stop on cancellation, took %v", elapsed)
+	}
+}
+
+func TestHeartbeatRegistersAgainWhenUnknown(t *testing.T) {
+	registrations := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/agents":
+			var registration models.AgentRegistration
+			if err := json.NewDecoder(r.Body).Decode(&registration); err != nil || registration.ID != "test-agent" || len(registration.Operations) == 0 {
+				t.Errorf("Unexpected registration: %+v (%v)", registration, err)
+			}
+			registrations++
+			w.WriteHeader(http.StatusOK)
+		case "/internal/agents/test-agent/heartbeat":
+			// Оркестратор перезапустился и забыл агента
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	service := NewService(NewHTTPTransport(server.URL, time.Second), testRegistration)
+	if err := service.Heartbeat(context.Background()); err != nil {
+		t.Fatalf("Failed to send heartbeat: %v", err)
+	}
+	if registrations != 1 {
+		t.Errorf("Expected agent to register again, got %d registrations", registrations)
+	}
+}
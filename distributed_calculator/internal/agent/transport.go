@@ -0,0 +1,23 @@
+package agent
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"time"
+)
+
+// requestTimeout - время на сам запрос к оркестратору сверх ожидания задачи
+const requestTimeout = 10 * time.Second
+
+// Transport доставляет агенту задачи от оркестратора, а оркестратору - их результаты.
+// SendTaskResult и SendTaskFailure возвращают ErrTaskCancelled, если выражение отменено.
+type Transport interface {
+	Register(ctx context.Context, registration models.AgentRegistration) error
+	GetTask(ctx context.Context, agentID string) (*models.Task, error)
+	SendTaskResult(taskID string, result float64) error
+	SendTaskFailure(taskID string, message string) error
+	// Heartbeat продлевает аренду вычисляемых задач и возвращает среди них отменённые.
+	// ErrAgentNotRegistered означает, что агенту нужно зарегистрироваться заново.
+	Heartbeat(ctx context.Context, agentID string, taskIDs []string) ([]string, error)
+	Close() error
+}
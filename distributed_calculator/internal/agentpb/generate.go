@@ -0,0 +1,4 @@
+// Package agentpb содержит сгенерированный код gRPC-протокола между агентами и оркестратором.
+package agentpb
+
+//go:generate buf generate
@@ -0,0 +1,41 @@
+package calculator
+
+import (
+	"distributed-calculator/internal/models"
+	"fmt"
+)
+
+// Arity - допустимое число аргументов функции; Max < 0 означает "без ограничения"
+type Arity struct {
+	Min int
+	Max int
+}
+
+func (a Arity) accepts(count int) bool {
+	return count >= a.Min && (a.Max < 0 || count <= a.Max)
+}
+
+func (a Arity) String() string {
+	switch {
+	case a.Max < 0:
+		return fmt.Sprintf("at least %d arguments", a.Min)
+	case a.Min == a.Max && a.Min == 1:
+		return "1 argument"
+	case a.Min == a.Max:
+		return fmt.Sprintf("%d arguments", a.Min)
+	}
+	return fmt.Sprintf("%d to %d arguments", a.Min, a.Max)
+}
+
+// Functions - встроенные функции, доступные в выражениях.
+// Каждый вызов становится отдельной задачей для агента.
+var Functions = map[models.Operation]Arity{
+	models.Sqrt:  {Min: 1, Max: 1},
+	models.Abs:   {Min: 1, Max: 1},
+	models.Min:   {Min: 1, Max: -1},
+	models.Max:   {Min: 1, Max: -1},
+	models.Round: {Min: 1, Max: 1},
+	models.Log:   {Min: 1, Max: 2},
+	models.Sin:   {Min: 1, Max: 1},
+	models.Cos:   {Min: 1, Max: 1},
+}
@@ -0,0 +1,180 @@
+package calculator
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota
+	TokenNumber
+	TokenPlus
+	TokenMinus
+	TokenStar
+	TokenSlash
+	TokenCaret
+	TokenLParen
+	TokenRParen
+	TokenComma
+	TokenIdent
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenEOF:
+		return "end of expression"
+	case TokenNumber:
+		return "number"
+	case TokenPlus:
+		return "'+'"
+	case TokenMinus:
+		return "'-'"
+	case TokenStar:
+		return "'*'"
+	case TokenSlash:
+		return "'/'"
+	case TokenCaret:
+		return "'^'"
+	case TokenLParen:
+		return "'('"
+	case TokenRParen:
+		return "')'"
+	case TokenComma:
+		return "','"
+	case TokenIdent:
+		return "identifier"
+	}
+	return fmt.Sprintf("token(%d)", int(k))
+}
+
+// Token - лексема выражения; Pos - смещение в байтах от начала исходной строки
+type Token struct {
+	Kind  TokenKind
+	Value string
+	Pos   int
+}
+
+var singleCharTokens = map[byte]TokenKind{
+	'+': TokenPlus,
+	'-': TokenMinus,
+	'*': TokenStar,
+	'/': TokenSlash,
+	'^': TokenCaret,
+	'(': TokenLParen,
+	')': TokenRParen,
+	',': TokenComma,
+}
+
+// maxTokens ограничивает длину выражения. Глубина AST растёт с числом лексем
+// (1+1+...+1 - цепочка из левых операндов), а AST обходится рекурсивно,
+// поэтому без ограничения длинное выражение переполнило бы стек.
+const maxTokens = 10000
+
+// Tokenize разбивает выражение на лексемы. Последняя лексема всегда TokenEOF.
+func Tokenize(expression string) ([]Token, error) {
+	tokens := []Token{}
+
+	for pos := 0; pos < len(expression); {
+		char := expression[pos]
+
+		if isSpace(char) {
+			pos++
+			continue
+		}
+
+		if len(tokens) == maxTokens {
+			return nil, &ParseError{Pos: pos, Msg: fmt.Sprintf("expression is too long (more than %d tokens)", maxTokens)}
+		}
+
+		// "**" - синоним "^"
+		if strings.HasPrefix(expression[pos:], "**") {
+			tokens = append(tokens, Token{Kind: TokenCaret, Value: "**", Pos: pos})
+			pos += 2
+			continue
+		}
+
+		if kind, ok := singleCharTokens[char]; ok {
+			tokens = append(tokens, Token{Kind: kind, Value: string(char), Pos: pos})
+			pos++
+			continue
+		}
+
+		if isDigit(char) || char == '.' {
+			end, err := scanNumber(expression, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{Kind: TokenNumber, Value: expression[pos:end], Pos: pos})
+			pos = end
+			continue
+		}
+
+		if isLetter(char) {
+			end := pos + 1
+			for end < len(expression) && (isLetter(expression[end]) || isDigit(expression[end])) {
+				end++
+			}
+			tokens = append(tokens, Token{Kind: TokenIdent, Value: expression[pos:end], Pos: pos})
+			pos = end
+			continue
+		}
+
+		r, _ := utf8.DecodeRuneInString(expression[pos:])
+		return nil, &ParseError{Pos: pos, Token: string(r), Msg: "unexpected character"}
+	}
+
+	tokens = append(tokens, Token{Kind: TokenEOF, Pos: len(expression)})
+	return tokens, nil
+}
+
+// scanNumber читает число вида 12, 1.5, .5, 2e-3 и возвращает позицию за его концом
+func scanNumber(expression string, start int) (int, error) {
+	pos := start
+	digits := 0
+
+	for pos < len(expression) && isDigit(expression[pos]) {
+		pos++
+		digits++
+	}
+	if pos < len(expression) && expression[pos] == '.' {
+		pos++
+		for pos < len(expression) && isDigit(expression[pos]) {
+			pos++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return 0, &ParseError{Pos: start, Token: expression[start:pos], Msg: "invalid number"}
+	}
+
+	if pos < len(expression) && (expression[pos] == 'e' || expression[pos] == 'E') {
+		exponent := pos + 1
+		if exponent < len(expression) && (expression[exponent] == '+' || expression[exponent] == '-') {
+			exponent++
+		}
+		if exponent >= len(expression) || !isDigit(expression[exponent]) {
+			return 0, &ParseError{Pos: start, Token: expression[start:exponent], Msg: "invalid number"}
+		}
+		pos = exponent
+		for pos < len(expression) && isDigit(expression[pos]) {
+			pos++
+		}
+	}
+
+	return pos, nil
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isLetter(char byte) bool {
+	return char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char == '_'
+}
+
+func isSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r'
+}
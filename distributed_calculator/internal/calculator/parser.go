@@ -4,163 +4,407 @@ import (
 	"distributed-calculator/internal/models"
 	"fmt"
 	"strconv"
-	"strings"
 
 	"github.com/google/uuid"
 )
 
+const (
+	NodeNumber    = "number"
+	NodeOperation = "operation"
+	NodeUnary     = "unary"
+	NodeCall      = "call"
+)
+
 type ASTNode struct {
-	NodeType    string
-	Value       string
-	Left        *ASTNode
-	Right       *ASTNode
-	TaskID      string
+	NodeType     string
+	Value        string
+	Left         *ASTNode
+	Right        *ASTNode
+	Args         []*ASTNode
+	Pos          int
+	TaskID       string
 	Dependencies []string
 }
 
+// ParseError описывает синтаксическую ошибку в выражении.
+// Pos - смещение в байтах от начала выражения, Token - текст лексемы в этой позиции.
+type ParseError struct {
+	Pos   int
+	Token string
+	Msg   string
+}
+
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s at column %d", e.Msg, e.Column())
+	}
+	return fmt.Sprintf("%s %q at column %d", e.Msg, e.Token, e.Column())
+}
+
+// Column возвращает номер столбца, начиная с 1
+func (e *ParseError) Column() int {
+	return e.Pos + 1
+}
+
+// Plan - результат разбора выражения: задачи для агентов и итоговый аргумент.
+// Root - либо число (если выражение свелось к константе), либо ID корневой задачи.
+type Plan struct {
+	Tasks []*models.Task
+	Root  string
+}
+
 func ParseExpression(expressionID, expression string, operationTimes map[models.Operation]int64) ([]*models.Task, error) {
-	expression = strings.ReplaceAll(expression, " ", "")
-	
-	ast, err := buildAST(expression)
+	plan, err := Compile(expressionID, expression, operationTimes)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan.Tasks, nil
+}
+
+func Compile(expressionID, expression string, operationTimes map[models.Operation]int64) (*Plan, error) {
+	ast, err := Parse(expression)
 	if err != nil {
 		return nil, err
 	}
-	
+
 	tasks := []*models.Task{}
-	_, err = createTasksFromAST(ast, &tasks, expressionID, operationTimes)
+	root, err := createTasksFromAST(ast, &tasks, expressionID, operationTimes)
+	if err != nil {
+		return nil, err
+	}
+	assignRanks(tasks)
+
+	return &Plan{
+		Tasks: tasks,
+		Root:  root,
+	}, nil
+}
+
+// Parse строит AST выражения методом precedence climbing.
+// Все синтаксические ошибки возвращаются как *ParseError.
+func Parse(expression string) (*ASTNode, error) {
+	tokens, err := Tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	if p.peek().Kind == TokenEOF {
+		return nil, &ParseError{Pos: 0, Msg: "empty expression"}
+	}
+
+	ast, err := p.parseExpression(lowestPrecedence)
 	if err != nil {
 		return nil, err
 	}
-	
-	return tasks, nil
+
+	if token := p.peek(); token.Kind != TokenEOF {
+		return nil, p.unexpected(token)
+	}
+
+	return ast, nil
+}
+
+const (
+	lowestPrecedence = 1
+	// maxDepth ограничивает вложенность скобок, унарных операторов и цепочек ^,
+	// чтобы злонамеренный ввод не переполнил стек
+	maxDepth = 256
+)
+
+type binaryOperator struct {
+	operation        models.Operation
+	precedence       int
+	rightAssociative bool
+}
+
+var binaryOperators = map[TokenKind]binaryOperator{
+	TokenPlus:  {operation: models.Addition, precedence: 1},
+	TokenMinus: {operation: models.Subtraction, precedence: 1},
+	TokenStar:  {operation: models.Multiplication, precedence: 2},
+	TokenSlash: {operation: models.Division, precedence: 2},
+	TokenCaret: {operation: models.Exponentiation, precedence: exponentPrecedence, rightAssociative: true},
+}
+
+// exponentPrecedence выше, чем у унарного минуса: -2^2 = -(2^2)
+const exponentPrecedence = 3
+
+type parser struct {
+	tokens []Token
+	pos    int
+	depth  int
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() Token {
+	token := p.tokens[p.pos]
+	if token.Kind != TokenEOF {
+		p.pos++
+	}
+	return token
 }
 
-func buildAST(expression string) (*ASTNode, error) {
-	// Если выражение пустое, возвращаем ошибку
-	if len(expression) == 0 {
-		return nil, fmt.Errorf("пустое выражение")
+func (p *parser) parseExpression(minPrecedence int) (*ASTNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
 	}
-	
-	bracketCount := 0
-	for i := len(expression) - 1; i >= 0; i-- {
-		char := expression[i]
-		if char == ')' {
-			bracketCount++
-		} else if char == '(' {
-			bracketCount--
+
+	for {
+		token := p.peek()
+		operator, isBinary := binaryOperators[token.Kind]
+		if !isBinary || operator.precedence < minPrecedence {
+			return left, nil
 		}
-		
-		if bracketCount == 0 && (char == '+' || char == '-') {
-			return &ASTNode{
-				NodeType: "operation",
-				Value:    string(char),
-				Left:     mustBuildAST(expression[:i]),
-				Right:    mustBuildAST(expression[i+1:]),
-			}, nil
+		p.next()
+
+		// Для левоассоциативных операций правая часть связывает только более приоритетные,
+		// для правоассоциативных (^) - ещё и операции того же приоритета
+		nextPrecedence := operator.precedence + 1
+		if operator.rightAssociative {
+			nextPrecedence = operator.precedence
+			// Цепочка 2^2^...^2 разбирается рекурсией, как и вложенные скобки
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+		}
+
+		right, err := p.parseExpression(nextPrecedence)
+		if operator.rightAssociative {
+			p.leave()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		left = &ASTNode{
+			NodeType: NodeOperation,
+			Value:    string(operator.operation),
+			Left:     left,
+			Right:    right,
+			Pos:      token.Pos,
 		}
 	}
-	
-	bracketCount = 0
-	for i := len(expression) - 1; i >= 0; i-- {
-		char := expression[i]
-		if char == ')' {
-			bracketCount++
-		} else if char == '(' {
-			bracketCount--
+}
+
+// enter учитывает ещё один уровень рекурсии разбора; после него нужен leave
+func (p *parser) enter() error {
+	if p.depth >= maxDepth {
+		token := p.peek()
+		return &ParseError{Pos: token.Pos, Token: token.Value, Msg: "expression is nested too deeply"}
+	}
+	p.depth++
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) parseUnary() (*ASTNode, error) {
+	token := p.peek()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	if token.Kind != TokenPlus && token.Kind != TokenMinus {
+		return p.parsePrimary()
+	}
+	p.next()
+
+	operand, err := p.parseExpression(exponentPrecedence)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		NodeType: NodeUnary,
+		Value:    token.Value,
+		Left:     operand,
+		Pos:      token.Pos,
+	}, nil
+}
+
+func (p *parser) parsePrimary() (*ASTNode, error) {
+	token := p.next()
+
+	switch token.Kind {
+	case TokenNumber:
+		if _, err := strconv.ParseFloat(token.Value, 64); err != nil {
+			return nil, &ParseError{Pos: token.Pos, Token: token.Value, Msg: "invalid number"}
+		}
+		return &ASTNode{
+			NodeType: NodeNumber,
+			Value:    token.Value,
+			Pos:      token.Pos,
+		}, nil
+
+	case TokenLParen:
+		inner, err := p.parseExpression(lowestPrecedence)
+		if err != nil {
+			return nil, err
 		}
-		
-		if bracketCount == 0 && (char == '*' || char == '/') {
-			return &ASTNode{
-				NodeType: "operation",
-				Value:    string(char),
-				Left:     mustBuildAST(expression[:i]),
-				Right:    mustBuildAST(expression[i+1:]),
-			}, nil
+		if closing := p.peek(); closing.Kind != TokenRParen {
+			return nil, &ParseError{Pos: closing.Pos, Token: closing.Value, Msg: fmt.Sprintf("expected ')' to close '(' at column %d, got %s", token.Pos+1, closing.Kind)}
 		}
+		p.next()
+		return inner, nil
+
+	case TokenIdent:
+		return p.parseCall(token)
 	}
-	
-	if expression[0] == '(' && expression[len(expression)-1] == ')' {
-		bracketCount = 0
-		for i := 0; i < len(expression)-1; i++ {
-			if expression[i] == '(' {
-				bracketCount++
-			} else if expression[i] == ')' {
-				bracketCount--
+
+	return nil, p.unexpected(token)
+}
+
+// parseCall разбирает вызов функции name(arg, ...) и проверяет число аргументов
+func (p *parser) parseCall(name Token) (*ASTNode, error) {
+	operation := models.Operation(name.Value)
+	arity, known := Functions[operation]
+	if !known {
+		return nil, &ParseError{Pos: name.Pos, Token: name.Value, Msg: "unknown function"}
+	}
+
+	if opening := p.peek(); opening.Kind != TokenLParen {
+		return nil, &ParseError{Pos: opening.Pos, Token: opening.Value, Msg: fmt.Sprintf("expected '(' after function name, got %s", opening.Kind)}
+	}
+	p.next()
+
+	args := []*ASTNode{}
+	if p.peek().Kind != TokenRParen {
+		for {
+			arg, err := p.parseExpression(lowestPrecedence)
+			if err != nil {
+				return nil, err
 			}
-			
-			if bracketCount == 0 {
+			args = append(args, arg)
+
+			if p.peek().Kind != TokenComma {
 				break
 			}
-		}
-		
-		if bracketCount != 0 {
-			return buildAST(expression[1 : len(expression)-1])
+			p.next()
 		}
 	}
-	
-	_, err := strconv.ParseFloat(expression, 64)
-	if err == nil {
-		return &ASTNode{
-			NodeType: "number",
-			Value:    expression,
-		}, nil
+
+	if closing := p.peek(); closing.Kind != TokenRParen {
+		return nil, &ParseError{Pos: closing.Pos, Token: closing.Value, Msg: fmt.Sprintf("expected ',' or ')' in call to %s, got %s", name.Value, closing.Kind)}
 	}
-	
-	return nil, fmt.Errorf("недопустимое выражение: %s", expression)
+	p.next()
+
+	if !arity.accepts(len(args)) {
+		return nil, &ParseError{Pos: name.Pos, Token: name.Value, Msg: fmt.Sprintf("function expects %s, got %d", arity, len(args))}
+	}
+
+	return &ASTNode{
+		NodeType: NodeCall,
+		Value:    name.Value,
+		Args:     args,
+		Pos:      name.Pos,
+	}, nil
 }
 
-func mustBuildAST(expression string) *ASTNode {
-	node, err := buildAST(expression)
-	if err != nil {
-		panic(err)
+func (p *parser) unexpected(token Token) *ParseError {
+	if token.Kind == TokenEOF {
+		return &ParseError{Pos: token.Pos, Msg: "unexpected end of expression"}
 	}
-	return node
+	return &ParseError{Pos: token.Pos, Token: token.Value, Msg: "unexpected token"}
 }
 
 func createTasksFromAST(node *ASTNode, tasks *[]*models.Task, expressionID string, operationTimes map[models.Operation]int64) (string, error) {
-	if node.NodeType == "number" {
+	switch node.NodeType {
+	case NodeNumber:
 		return node.Value, nil
-	}
-	
-	if node.NodeType == "operation" {
-		leftArg, err := createTasksFromAST(node.Left, tasks, expressionID, operationTimes)
-		if err != nil {
-			return "", err
+
+	case NodeOperation, NodeCall:
+		operands := node.Args
+		if node.NodeType == NodeOperation {
+			operands = []*ASTNode{node.Left, node.Right}
+		}
+
+		args := make([]string, 0, len(operands))
+		dependencies := []string{}
+		for _, operand := range operands {
+			arg, err := createTasksFromAST(operand, tasks, expressionID, operationTimes)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, arg)
+			if operand.TaskID != "" {
+				dependencies = append(dependencies, operand.TaskID)
+			}
 		}
-		
-		rightArg, err := createTasksFromAST(node.Right, tasks, expressionID, operationTimes)
+
+		task := newTask(expressionID, models.Operation(node.Value), args, dependencies, operationTimes)
+		*tasks = append(*tasks, task)
+		node.TaskID = task.ID
+
+		return task.ID, nil
+
+	case NodeUnary:
+		arg, err := createTasksFromAST(node.Left, tasks, expressionID, operationTimes)
 		if err != nil {
 			return "", err
 		}
-		
-		taskID := uuid.New().String()
-		operation := models.Operation(node.Value)
-		
-		dependencies := []string{}
-		if node.Left.TaskID != "" {
-			dependencies = append(dependencies, node.Left.TaskID)
-		}
-		if node.Right.TaskID != "" {
-			dependencies = append(dependencies, node.Right.TaskID)
+
+		if node.Value == "+" {
+			node.TaskID = node.Left.TaskID
+			return arg, nil
 		}
-		
-		task := &models.Task{
-			ID:            taskID,
-			ExpressionID:  expressionID,
-			Arg1:          leftArg,
-			Arg2:          rightArg,
-			Operation:     operation,
-			OperationTime: operationTimes[operation],
-			Completed:     false,
-			Dependencies:  dependencies,
+
+		// Знак числа сворачиваем сразу, без отдельной задачи
+		if node.Left.TaskID == "" {
+			value, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid number: %s", arg)
+			}
+			return strconv.FormatFloat(-value, 'f', -1, 64), nil
 		}
-		
+
+		// -(x) вычисляется агентом как 0 - x
+		task := newTask(expressionID, models.Subtraction, []string{"0", arg}, []string{node.Left.TaskID}, operationTimes)
 		*tasks = append(*tasks, task)
-		
-		node.TaskID = taskID
-		
-		return taskID, nil
-	}
-	
-	return "", fmt.Errorf("неизвестный тип узла: %s", node.NodeType)
-}
\ No newline at end of file
+		node.TaskID = task.ID
+
+		return task.ID, nil
+	}
+
+	return "", fmt.Errorf("unknown node type: %s", node.NodeType)
+}
+
+func newTask(expressionID string, operation models.Operation, args, dependencies []string, operationTimes map[models.Operation]int64) *models.Task {
+	return &models.Task{
+		ID:            uuid.New().String(),
+		ExpressionID:  expressionID,
+		Args:          args,
+		Operation:     operation,
+		OperationTime: operationTimes[operation],
+		Completed:     false,
+		Dependencies:  dependencies,
+	}
+}
+
+// assignRanks вычисляет ранг каждой задачи: её OperationTime плюс наибольший ранг
+// среди задач, которые от неё зависят. Задачи идут после своих зависимостей,
+// поэтому достаточно одного прохода с конца.
+func assignRanks(tasks []*models.Task) {
+	byID := make(map[string]*models.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+		task.Rank = 0
+	}
+
+	for i := len(tasks) - 1; i >= 0; i-- {
+		task := tasks[i]
+		task.Rank += task.OperationTime
+		for _, depID := range task.Dependencies {
+			if dep, exists := byID[depID]; exists && dep.Rank < task.Rank {
+				dep.Rank = task.Rank
+			}
+		}
+	}
+}
@@ -2,6 +2,8 @@ package calculator
 
 import (
 	"distributed-calculator/internal/models"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -22,7 +24,7 @@ func TestParseExpression(t *testing.T) {
 		t.Errorf("Expected 1 task, got %d", len(tasks))
 		return
 	}
-	if tasks[0].Arg1 != "2" || tasks[0].Arg2 != "3" || tasks[0].Operation != models.Addition {
+	if len(tasks[0].Args) != 2 || tasks[0].Args[0] != "2" || tasks[0].Args[1] != "3" || tasks[0].Operation != models.Addition {
 		t.Errorf("Incorrect task for simple expression: %+v", tasks[0])
 	}
 
@@ -65,6 +67,324 @@ func TestParseExpression(t *testing.T) {
 	}
 }
 
+func TestParseUnaryOperators(t *testing.T) {
+	operationTimes := map[models.Operation]int64{
+		models.Addition:       1000,
+		models.Subtraction:    1000,
+		models.Multiplication: 2000,
+		models.Division:       3000,
+	}
+
+	tests := []struct {
+		expression string
+		arg1       string
+		operation  models.Operation
+		arg2       string
+	}{
+		{"-5+3", "-5", models.Addition, "3"},
+		{"2*-3", "2", models.Multiplication, "-3"},
+		{"2 - -3", "2", models.Subtraction, "-3"},
+		{"+4 / +2", "4", models.Division, "2"},
+		{"-(-1.5) * 2", "1.5", models.Multiplication, "2"},
+	}
+
+	for _, tt := range tests {
+		tasks, err := ParseExpression("expr", tt.expression, operationTimes)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tt.expression, err)
+			continue
+		}
+		if len(tasks) != 1 {
+			t.Errorf("Expected 1 task for %q, got %d", tt.expression, len(tasks))
+			continue
+		}
+		if len(tasks[0].Args) != 2 || tasks[0].Args[0] != tt.arg1 || tasks[0].Operation != tt.operation || tasks[0].Args[1] != tt.arg2 {
+			t.Errorf("Incorrect task for %q: %+v", tt.expression, tasks[0])
+		}
+	}
+
+	plan, err := Compile("expr", "--5", operationTimes)
+	if err != nil {
+		t.Fatalf("Failed to parse double negation: %v", err)
+	}
+	if len(plan.Tasks) != 0 || plan.Root != "5" {
+		t.Errorf("Expected double negation to fold into 5, got %+v", plan)
+	}
+
+	plan, err = Compile("expr", "(-(2+3))", operationTimes)
+	if err != nil {
+		t.Fatalf("Failed to parse negated subexpression: %v", err)
+	}
+	if len(plan.Tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %d", len(plan.Tasks))
+	}
+	additionTask := findTaskByOperation(plan.Tasks, models.Addition)
+	negationTask := findTaskByOperation(plan.Tasks, models.Subtraction)
+	if additionTask == nil || negationTask == nil {
+		t.Fatalf("Missing expected tasks in the result")
+	}
+	if len(negationTask.Args) != 2 || negationTask.Args[0] != "0" || negationTask.Args[1] != additionTask.ID || plan.Root != negationTask.ID {
+		t.Errorf("Incorrect negation task: %+v", negationTask)
+	}
+	if len(negationTask.Dependencies) != 1 || negationTask.Dependencies[0] != additionTask.ID {
+		t.Errorf("Incorrect dependencies in the tasks")
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		expression string
+		pos        int
+		token      string
+	}{
+		{"", 0, ""},
+		{"2 + ", 4, ""},
+		{"2 + * 3", 4, "*"},
+		{"(2 + 3", 6, ""},
+		{"2 + 3)", 5, ")"},
+		{"2 3", 2, "3"},
+		{"2 $ 3", 2, "$"},
+		{"1 + 1e+", 4, "1e+"},
+		{"()", 1, ")"},
+		{"2 ^^ 3", 3, "^"},
+		{"2 *** 3", 4, "*"},
+		{strings.Repeat("(", 300) + "1" + strings.Repeat(")", 300), 256, "("},
+		{strings.Repeat("2^", 300) + "2", 512, "2"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseExpression("expr", tt.expression, nil)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected ParseError for %q, got %v", tt.expression, err)
+			continue
+		}
+		if parseErr.Pos != tt.pos || parseErr.Token != tt.token {
+			t.Errorf("Incorrect error for %q: pos=%d token=%q (%v)", tt.expression, parseErr.Pos, parseErr.Token, parseErr)
+		}
+	}
+}
+
+func TestParsePrecedenceAndAssociativity(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"1 - 2 - 3", "((1 - 2) - 3)"},
+		{"8 / 4 / 2", "((8 / 4) / 2)"},
+		{"1 + 2 * 3 - 4", "((1 + (2 * 3)) - 4)"},
+		{"2 * (3 + 4) * 5", "((2 * (3 + 4)) * 5)"},
+		{"-2 * -(1.5e1)", "((-2) * (-1.5e1))"},
+		{"2 ^ 3 ^ 2", "(2 ^ (3 ^ 2))"},
+		{"2 ** 3 ** 2", "(2 ^ (3 ^ 2))"},
+		{"2 * 3 ^ 2", "(2 * (3 ^ 2))"},
+		{"-2 ^ 2", "(-(2 ^ 2))"},
+		{"2 ^ -1", "(2 ^ (-1))"},
+		{"(2 ^ 3) ^ 2", "((2 ^ 3) ^ 2)"},
+	}
+
+	for _, tt := range tests {
+		ast, err := Parse(tt.expression)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tt.expression, err)
+			continue
+		}
+		if got := formatAST(ast); got != tt.expected {
+			t.Errorf("Incorrect tree for %q: expected %s, got %s", tt.expression, tt.expected, got)
+		}
+	}
+}
+
+func TestParseFunctionCalls(t *testing.T) {
+	operationTimes := map[models.Operation]int64{
+		models.Addition: 1000,
+		models.Sqrt:     500,
+		models.Max:      700,
+	}
+
+	tasks, err := ParseExpression("expr", "max(1, 2.5, -3)", operationTimes)
+	if err != nil {
+		t.Fatalf("Failed to parse function call: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Operation != models.Max || len(tasks[0].Args) != 3 || tasks[0].OperationTime != 700 {
+		t.Fatalf("Incorrect task for function call: %+v", tasks)
+	}
+	if tasks[0].Args[0] != "1" || tasks[0].Args[1] != "2.5" || tasks[0].Args[2] != "-3" {
+		t.Errorf("Incorrect function arguments: %v", tasks[0].Args)
+	}
+
+	tasks, err = ParseExpression("expr", "sqrt(2 + 2) + 1", operationTimes)
+	if err != nil {
+		t.Fatalf("Failed to parse nested function call: %v", err)
+	}
+	if len(tasks) != 3 {
+		t.Fatalf("Expected 3 tasks, got %d", len(tasks))
+	}
+	sqrtTask := findTaskByOperation(tasks, models.Sqrt)
+	if sqrtTask == nil || len(sqrtTask.Dependencies) != 1 || sqrtTask.Args[0] != sqrtTask.Dependencies[0] {
+		t.Errorf("Incorrect dependencies for function task: %+v", sqrtTask)
+	}
+
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"sqrt(4)", "sqrt(4)"},
+		{"-abs(-2) ^ 2", "(-(abs((-2)) ^ 2))"},
+		{"min(1, max(2, 3)) * log(8, 2)", "(min(1, max(2, 3)) * log(8, 2))"},
+	}
+	for _, tt := range tests {
+		ast, err := Parse(tt.expression)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tt.expression, err)
+			continue
+		}
+		if got := formatAST(ast); got != tt.expected {
+			t.Errorf("Incorrect tree for %q: expected %s, got %s", tt.expression, tt.expected, got)
+		}
+	}
+}
+
+func TestParseFunctionCallErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		pos        int
+		token      string
+	}{
+		{"sqrt()", 0, "sqrt"},
+		{"1 + sqrt(1, 2)", 4, "sqrt"},
+		{"log(1, 2, 3)", 0, "log"},
+		{"max()", 0, "max"},
+		{"foo(1)", 0, "foo"},
+		{"sqrt 4", 5, "4"},
+		{"max(1,)", 6, ")"},
+		{"min(1 2)", 6, "2"},
+		{"sqrt(4", 6, ""},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseExpression("expr", tt.expression, nil)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Expected ParseError for %q, got %v", tt.expression, err)
+			continue
+		}
+		if parseErr.Pos != tt.pos || parseErr.Token != tt.token {
+			t.Errorf("Incorrect error for %q: pos=%d token=%q (%v)", tt.expression, parseErr.Pos, parseErr.Token, parseErr)
+		}
+	}
+}
+
+func TestCompileAssignsCriticalPathRanks(t *testing.T) {
+	operationTimes := map[models.Operation]int64{
+		models.Addition:       1000,
+		models.Subtraction:    1000,
+		models.Multiplication: 2000,
+		models.Division:       3000,
+	}
+
+	plan, err := Compile("expr", "((1+2)*(3+4))/(5-6)+7", operationTimes)
+	if err != nil {
+		t.Fatalf("Failed to compile expression: %v", err)
+	}
+
+	// Ранг - время задачи плюс самый долгий путь от неё до корня
+	expected := map[string]int64{
+		"1 + 2": 7000,
+		"3 + 4": 7000,
+		"5 - 6": 5000,
+		"t * t": 6000,
+		"t / t": 4000,
+		"t + 7": 1000,
+	}
+	for _, task := range plan.Tasks {
+		args := make([]string, len(task.Args))
+		for i, arg := range task.Args {
+			args[i] = arg
+			if len(arg) > 5 {
+				args[i] = "t"
+			}
+		}
+		key := args[0] + " " + string(task.Operation) + " " + args[1]
+		if rank, exists := expected[key]; !exists || task.Rank != rank {
+			t.Errorf("Expected rank %d for task %s, got %d", expected[key], key, task.Rank)
+		}
+	}
+}
+
+func TestCompileRejectsTooLongExpressions(t *testing.T) {
+	// Плоская сумма строит AST глубиной в число слагаемых
+	_, err := Compile("expr", strings.Repeat("1+", 8_000_000)+"1", nil)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Pos != maxTokens {
+		t.Fatalf("Expected ParseError at offset %d, got %v", maxTokens, err)
+	}
+
+	plan, err := Compile("expr", strings.Repeat("1+", maxTokens/2-1)+"1", nil)
+	if err != nil {
+		t.Fatalf("Failed to compile expression at the limit: %v", err)
+	}
+	if len(plan.Tasks) != maxTokens/2-1 {
+		t.Errorf("Expected %d tasks, got %d", maxTokens/2-1, len(plan.Tasks))
+	}
+}
+
+func FuzzParseExpression(f *testing.F) {
+	seeds := []string{
+		"2 + 3", "2 + 3 * 4", "(2 + 3) * 4", "-5+3", "2*-3", "(-(2+3))",
+		"2+", "*3", "(2+3", "2++2", "2 3", ")(", "1e+", ".", "((((1))))", "--5",
+		"2 ^ 3 ** 2", "max(1, 2, 3)", "sqrt()", "log(8, 2)", "min(1,", "abs",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	operationTimes := map[models.Operation]int64{
+		models.Addition:       1,
+		models.Subtraction:    1,
+		models.Multiplication: 1,
+		models.Division:       1,
+	}
+
+	f.Fuzz(func(t *testing.T, expression string) {
+		plan, err := Compile("expr", expression, operationTimes)
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected ParseError for %q, got %T: %v", expression, err, err)
+			}
+			if parseErr.Pos < 0 || parseErr.Pos > len(expression) {
+				t.Fatalf("Error position %d is out of range for %q", parseErr.Pos, expression)
+			}
+			return
+		}
+		if plan.Root == "" {
+			t.Fatalf("Empty root for %q", expression)
+		}
+		for _, task := range plan.Tasks {
+			if task.Rank < task.OperationTime {
+				t.Fatalf("Rank %d of task %s is less than its operation time in %q", task.Rank, task.Operation, expression)
+			}
+		}
+	})
+}
+
+func formatAST(node *ASTNode) string {
+	switch node.NodeType {
+	case NodeOperation:
+		return "(" + formatAST(node.Left) + " " + node.Value + " " + formatAST(node.Right) + ")"
+	case NodeUnary:
+		return "(" + node.Value + formatAST(node.Left) + ")"
+	case NodeCall:
+		args := make([]string, len(node.Args))
+		for i, arg := range node.Args {
+			args[i] = formatAST(arg)
+		}
+		return node.Value + "(" + strings.Join(args, ", ") + ")"
+	}
+	return node.Value
+}
+
 func findTaskByOperation(tasks []*models.Task, operation models.Operation) *models.Task {
 	for _, task := range tasks {
 		if task.Operation == operation {
@@ -72,4 +392,4 @@ func findTaskByOperation(tasks []*models.Task, operation models.Operation) *mode
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
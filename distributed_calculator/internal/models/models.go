@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type ExpressionStatus string
 
 const (
@@ -7,8 +9,15 @@ const (
 	StatusProcessing ExpressionStatus = "PROCESSING"
 	StatusCompleted ExpressionStatus = "COMPLETED"
 	StatusError     ExpressionStatus = "ERROR"
+	StatusCancelled ExpressionStatus = "CANCELLED"
+	StatusTimeout   ExpressionStatus = "TIMEOUT"
 )
 
+// Final сообщает, что выражение в этом статусе больше не изменится
+func (s ExpressionStatus) Final() bool {
+	return s != StatusPending && s != StatusProcessing
+}
+
 type Operation string
 
 const (
@@ -16,6 +25,18 @@ const (
 	Subtraction    Operation = "-"
 	Multiplication Operation = "*"
 	Division       Operation = "/"
+	Exponentiation Operation = "^"
+)
+
+const (
+	Sqrt  Operation = "sqrt"
+	Abs   Operation = "abs"
+	Min   Operation = "min"
+	Max   Operation = "max"
+	Round Operation = "round"
+	Log   Operation = "log"
+	Sin   Operation = "sin"
+	Cos   Operation = "cos"
 )
 
 type Expression struct {
@@ -24,22 +45,192 @@ type Expression struct {
 	Status     ExpressionStatus `json:"status"`
 	Result     *float64         `json:"result,omitempty"`
 	Error      string           `json:"error,omitempty"`
+	RootTaskID string           `json:"-"`
+	Deadline   *time.Time       `json:"deadline,omitempty"`
+	// Priority, ClientID и SubmittedAt копируются в задачи выражения для планировщика
+	Priority    int       `json:"priority,omitempty"`
+	ClientID    string    `json:"-"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	// CallbackURL получает POST с итогом выражения; попытки доставки копятся в Deliveries
+	CallbackURL string            `json:"callback_url,omitempty"`
+	Deliveries  []WebhookDelivery `json:"deliveries,omitempty"`
+}
+
+// Delivered сообщает, принял ли CallbackURL итог выражения
+func (e *Expression) Delivered() bool {
+	for _, delivery := range e.Deliveries {
+		if delivery.Delivered {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery - одна попытка отправить итог выражения на его callback_url.
+// StatusCode пуст, если ответа не было, и тогда Error описывает причину.
+type WebhookDelivery struct {
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
 }
 
 type Task struct {
-	ID            string    `json:"id"`
-	ExpressionID  string    `json:"-"`
-	Arg1          string    `json:"arg1"`
-	Arg2          string    `json:"arg2"`
-	Operation     Operation `json:"operation"`
-	OperationTime int64     `json:"operation_time"`
-	Result        *float64  `json:"result,omitempty"`
-	Completed     bool      `json:"-"`
-	Dependencies  []string  `json:"-"`
+	ID             string     `json:"id"`
+	ExpressionID   string     `json:"-"`
+	Args           []string   `json:"args"`
+	Operation      Operation  `json:"operation"`
+	OperationTime  int64      `json:"operation_time"`
+	Result         *float64   `json:"result,omitempty"`
+	Completed      bool       `json:"-"`
+	Dependencies   []string   `json:"-"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	Attempts       int        `json:"-"`
+	Cancelled      bool       `json:"-"`
+	Error          string     `json:"-"`
+	Priority       int        `json:"-"`
+	ClientID       string     `json:"-"`
+	SubmittedAt    time.Time  `json:"-"`
+	// Rank - длина самого долгого пути от задачи до корня выражения в миллисекундах,
+	// включая её собственное время; задачи с большим рангом лежат на критическом пути
+	Rank int64 `json:"-"`
+}
+
+// Leased сообщает, удерживает ли какой-либо агент задачу в момент now
+func (t *Task) Leased(now time.Time) bool {
+	return t.LeaseExpiresAt != nil && now.Before(*t.LeaseExpiresAt)
 }
 
+// CalculateRequest может ограничить время вычисления: через timeout_ms от момента
+// запроса или абсолютным deadline. Если заданы оба, действует более ранний срок.
+// Задачи выражений с большим priority выдаются агентам раньше; priority вне
+// диапазона от MinPriority до MaxPriority приводится к ближайшей границе.
+// ClientID заполняется оркестратором из адреса клиента или доверенного заголовка X-Client-ID.
+// Если задан callback_url, итог выражения (COMPLETED или ERROR) будет отправлен на него POST-запросом.
 type CalculateRequest struct {
-	Expression string `json:"expression"`
+	Expression  string     `json:"expression"`
+	TimeoutMs   int64      `json:"timeout_ms,omitempty"`
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	Priority    int        `json:"priority,omitempty"`
+	ClientID    string     `json:"-"`
+	CallbackURL string     `json:"callback_url,omitempty"`
+}
+
+const (
+	MinPriority = 0
+	MaxPriority = 10
+)
+
+// BatchItemRequest - одно выражение пакета. Необязательный Key задаёт клиент,
+// чтобы сопоставлять результаты со своими записями; ключи в пакете не повторяются.
+type BatchItemRequest struct {
+	CalculateRequest
+	Key string `json:"key,omitempty"`
+}
+
+type BatchCalculateRequest struct {
+	Expressions []BatchItemRequest `json:"expressions"`
+}
+
+// BatchItem - итог приёма одного выражения пакета: ID созданного выражения
+// или ошибка разбора, как в ответе на POST /api/v1/calculate
+type BatchItem struct {
+	Key          string `json:"key,omitempty"`
+	ExpressionID string `json:"id,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Column       int    `json:"column,omitempty"`
+}
+
+// Batch хранит выражения пакета в порядке запроса
+type Batch struct {
+	ID        string      `json:"id"`
+	Items     []BatchItem `json:"items"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type BatchCalculateResponse struct {
+	ID    string      `json:"id"`
+	Items []BatchItem `json:"items"`
+}
+
+// BatchItemResult - состояние одного выражения пакета
+type BatchItemResult struct {
+	BatchItem
+	Status ExpressionStatus `json:"status,omitempty"`
+	Result *float64         `json:"result,omitempty"`
+}
+
+// BatchProgress - сводка по пакету: Finished - сколько выражений больше не изменится,
+// из них Completed посчитаны, а Failed не приняты, завершились ошибкой, отменены или просрочены.
+// Items заполняется, когда пакет готов (Done).
+type BatchProgress struct {
+	ID        string            `json:"id"`
+	Done      bool              `json:"done"`
+	Total     int               `json:"total"`
+	Finished  int               `json:"finished"`
+	Completed int               `json:"completed"`
+	Failed    int               `json:"failed"`
+	CreatedAt time.Time         `json:"created_at"`
+	Items     []BatchItemResult `json:"items,omitempty"`
+}
+
+type BatchResponse struct {
+	Batch BatchProgress `json:"batch"`
+}
+
+// IdempotencyKey связывает ключ из заголовка Idempotency-Key с выражением, созданным
+// по первому запросу с этим ключом. RequestHash - хеш тела запроса: повтор с тем же
+// ключом, но другим телом отклоняется. После ExpiresAt ключ можно использовать заново.
+// Ключи разных клиентов (ClientID) не пересекаются.
+type IdempotencyKey struct {
+	ClientID     string    `json:"client_id"`
+	Key          string    `json:"key"`
+	RequestHash  string    `json:"request_hash"`
+	ExpressionID string    `json:"expression_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type EventType string
+
+const (
+	// EventStatus - текущее состояние выражения, например сразу после подписки
+	EventStatus EventType = "status"
+	// EventProgress - посчитана ещё одна задача выражения
+	EventProgress EventType = "progress"
+	// EventResult - выражение завершено; после него событий по выражению не будет
+	EventResult EventType = "result"
+)
+
+// ExpressionEvent - снимок выражения, который получают подписчики при его изменении
+type ExpressionEvent struct {
+	Type       EventType        `json:"type"`
+	ID         string           `json:"id"`
+	Status     ExpressionStatus `json:"status"`
+	Result     *float64         `json:"result,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	TasksDone  int              `json:"tasks_done"`
+	TasksTotal int              `json:"tasks_total"`
+}
+
+// WSRequest - кадр клиента /api/v1/ws. Необязательный Ref возвращается в первом
+// ответе на этот кадр, чтобы клиент мог сопоставить его с отправленным выражением.
+type WSRequest struct {
+	CalculateRequest
+	Ref string `json:"ref,omitempty"`
+}
+
+// WSResponse - кадр сервера /api/v1/ws: состояние выражения или ошибка кадра клиента
+type WSResponse struct {
+	Ref        string           `json:"ref,omitempty"`
+	ID         string           `json:"id,omitempty"`
+	Status     ExpressionStatus `json:"status,omitempty"`
+	Result     *float64         `json:"result,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Column     int              `json:"column,omitempty"`
+	TasksDone  int              `json:"tasks_done,omitempty"`
+	TasksTotal int              `json:"tasks_total,omitempty"`
 }
 
 type CalculateResponse struct {
@@ -58,7 +249,71 @@ type TaskResponse struct {
 	Task *Task `json:"task,omitempty"`
 }
 
+type TaskListResponse struct {
+	Tasks []*Task `json:"tasks"`
+}
+
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Column int    `json:"column,omitempty"`
+}
+
+// TaskResultRequest - результат задачи от агента. Непустой Error означает,
+// что вычислить задачу не удалось, и Result не используется.
 type TaskResultRequest struct {
 	ID     string  `json:"id"`
 	Result float64 `json:"result"`
-}
\ No newline at end of file
+	Error  string  `json:"error,omitempty"`
+}
+
+// TaskResultStatus - итог обработки одного результата из пакета: Status - тот же
+// HTTP-код, который вернул бы POST /internal/task для этого результата
+type TaskResultStatus struct {
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type TaskResultListResponse struct {
+	Results []TaskResultStatus `json:"results"`
+}
+
+type AgentStatus string
+
+const (
+	AgentAlive AgentStatus = "ALIVE"
+	AgentDead  AgentStatus = "DEAD"
+)
+
+// AgentRegistration - то, что агент сообщает о себе оркестратору при запуске
+type AgentRegistration struct {
+	ID         string      `json:"id"`
+	Hostname   string      `json:"hostname"`
+	Workers    int         `json:"workers"`
+	Operations []Operation `json:"operations"`
+	Version    string      `json:"version"`
+}
+
+// Agent - агент в реестре оркестратора. Агент считается мёртвым (DEAD),
+// если от него давно не было heartbeat, и его задачи отдаются другим агентам.
+type Agent struct {
+	AgentRegistration
+	Status        AgentStatus `json:"status"`
+	RegisteredAt  time.Time   `json:"registered_at"`
+	LastHeartbeat time.Time   `json:"last_heartbeat"`
+	ActiveTasks   int         `json:"active_tasks"`
+}
+
+type AgentListResponse struct {
+	Agents []Agent `json:"agents"`
+}
+
+// HeartbeatRequest перечисляет задачи, которые агент сейчас вычисляет
+type HeartbeatRequest struct {
+	TaskIDs []string `json:"task_ids"`
+}
+
+// HeartbeatResponse перечисляет задачи отменённых выражений: их вычисление можно прекратить
+type HeartbeatResponse struct {
+	CancelledTaskIDs []string `json:"cancelled_task_ids"`
+}
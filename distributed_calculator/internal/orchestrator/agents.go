@@ -0,0 +1,237 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrAgentNotRegistered возвращается на heartbeat агента, которого нет в реестре,
+	// например после перезапуска оркестратора: агенту нужно зарегистрироваться заново
+	ErrAgentNotRegistered = errors.New("agent is not registered")
+	// ErrInvalidAgent возвращается на регистрацию без ID или без воркеров
+	ErrInvalidAgent = errors.New("invalid agent registration")
+)
+
+// defaultAgentTimeout - сколько ждать heartbeat, прежде чем счесть агента мёртвым
+const defaultAgentTimeout = 10 * time.Second
+
+// agentRegistry помнит зарегистрированных агентов и задачи, выданные каждому из них.
+// Реестр живёт только в памяти: после перезапуска оркестратора агенты
+// регистрируются заново, получив ErrAgentNotRegistered на heartbeat.
+type agentRegistry struct {
+	mu     sync.Mutex
+	agents map[string]*models.Agent
+	owners map[string]string              // задача -> агент, которому она выдана
+	tasks  map[string]map[string]struct{} // агент -> выданные ему задачи
+}
+
+func newAgentRegistry() *agentRegistry {
+	return &agentRegistry{
+		agents: make(map[string]*models.Agent),
+		owners: make(map[string]string),
+		tasks:  make(map[string]map[string]struct{}),
+	}
+}
+
+// register добавляет агента или обновляет его данные. Повторная регистрация
+// означает, что процесс агента перезапущен, поэтому выданные ему задачи
+// возвращаются вызывающему для освобождения.
+func (r *agentRegistry) register(registration models.AgentRegistration, now time.Time) (models.Agent, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, exists := r.agents[registration.ID]
+	if !exists {
+		agent = &models.Agent{RegisteredAt: now}
+		r.agents[registration.ID] = agent
+	}
+	agent.AgentRegistration = registration
+	agent.Status = models.AgentAlive
+	agent.LastHeartbeat = now
+
+	return r.view(agent), r.takeTasks(registration.ID)
+}
+
+func (r *agentRegistry) heartbeat(agentID string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, exists := r.agents[agentID]
+	if !exists {
+		return false
+	}
+	agent.Status = models.AgentAlive
+	agent.LastHeartbeat = now
+	return true
+}
+
+// assign запоминает, что задача выдана агенту. Задачи незарегистрированных
+// агентов освобождаются только по истечении аренды.
+func (r *agentRegistry) assign(agentID, taskID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.agents[agentID]; !exists {
+		return
+	}
+	r.release(taskID)
+	r.owners[taskID] = agentID
+	if r.tasks[agentID] == nil {
+		r.tasks[agentID] = make(map[string]struct{})
+	}
+	r.tasks[agentID][taskID] = struct{}{}
+}
+
+// finish забывает задачи, которые больше не нужно вычислять
+func (r *agentRegistry) finish(taskIDs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, taskID := range taskIDs {
+		r.release(taskID)
+	}
+}
+
+// expire помечает мёртвыми агентов без heartbeat с момента before
+// и возвращает выданные им задачи
+func (r *agentRegistry) expire(before time.Time) map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dead := make(map[string][]string)
+	for id, agent := range r.agents {
+		if agent.Status == models.AgentDead || agent.LastHeartbeat.After(before) {
+			continue
+		}
+		agent.Status = models.AgentDead
+		dead[id] = r.takeTasks(id)
+	}
+	return dead
+}
+
+func (r *agentRegistry) list() []models.Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agents := make([]models.Agent, 0, len(r.agents))
+	for _, agent := range r.agents {
+		agents = append(agents, r.view(agent))
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].ID < agents[j].ID
+	})
+	return agents
+}
+
+// view возвращает копию агента с числом выданных ему задач. Вызывается под mu.
+func (r *agentRegistry) view(agent *models.Agent) models.Agent {
+	view := *agent
+	view.Operations = append([]models.Operation(nil), agent.Operations...)
+	view.ActiveTasks = len(r.tasks[agent.ID])
+	return view
+}
+
+// takeTasks забирает у агента все выданные ему задачи. Вызывается под mu.
+func (r *agentRegistry) takeTasks(agentID string) []string {
+	taskIDs := make([]string, 0, len(r.tasks[agentID]))
+	for taskID := range r.tasks[agentID] {
+		taskIDs = append(taskIDs, taskID)
+		delete(r.owners, taskID)
+	}
+	delete(r.tasks, agentID)
+	sort.Strings(taskIDs)
+	return taskIDs
+}
+
+// release снимает задачу с агента, которому она выдана. Вызывается под mu.
+func (r *agentRegistry) release(taskID string) {
+	agentID, exists := r.owners[taskID]
+	if !exists {
+		return
+	}
+	delete(r.owners, taskID)
+	delete(r.tasks[agentID], taskID)
+}
+
+// SetAgentTimeout задаёт, сколько ждать heartbeat, прежде чем счесть агента мёртвым
+func (s *Service) SetAgentTimeout(timeout time.Duration) {
+	s.agentTimeout = timeout
+}
+
+// RegisterAgent добавляет агента в реестр. Если агент с таким ID уже был
+// зарегистрирован, его прежние задачи сразу отдаются другим агентам.
+func (s *Service) RegisterAgent(registration models.AgentRegistration) (*models.Agent, error) {
+	if registration.ID == "" || registration.Workers <= 0 {
+		return nil, fmt.Errorf("%w: id and a positive number of workers are required", ErrInvalidAgent)
+	}
+
+	agent, orphaned := s.agents.register(registration, s.now())
+	if err := s.releaseTasks(orphaned); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Agent %s registered: %s, %d workers, version %s", agent.ID, agent.Hostname, agent.Workers, agent.Version)
+	return &agent, nil
+}
+
+// AgentHeartbeat отмечает, что агент жив, продлевает аренду его задач и
+// возвращает среди них задачи отменённых выражений
+func (s *Service) AgentHeartbeat(agentID string, taskIDs []string) ([]string, error) {
+	if !s.agents.heartbeat(agentID, s.now()) {
+		return nil, ErrAgentNotRegistered
+	}
+
+	cancelled, err := s.renewLeases(taskIDs)
+	if err != nil {
+		return nil, err
+	}
+	s.agents.finish(cancelled...)
+
+	return cancelled, nil
+}
+
+func (s *Service) GetAgents() []models.Agent {
+	return s.agents.list()
+}
+
+// ExpireAgents помечает мёртвыми агентов, от которых не было heartbeat дольше
+// agentTimeout, и возвращает их задачи в очередь. Возвращает число таких агентов.
+func (s *Service) ExpireAgents() (int, error) {
+	dead := s.agents.expire(s.now().Add(-s.agentTimeout))
+
+	for agentID, taskIDs := range dead {
+		if err := s.releaseTasks(taskIDs); err != nil {
+			return 0, err
+		}
+		log.Printf("Agent %s missed heartbeats, marked dead; %d tasks released", agentID, len(taskIDs))
+	}
+
+	return len(dead), nil
+}
+
+// releaseTasks возвращает в очередь задачи, которые агент уже не посчитает
+func (s *Service) releaseTasks(taskIDs []string) error {
+	released := 0
+	for _, id := range taskIDs {
+		err := s.repo.ReleaseTask(id)
+		if errors.Is(err, ErrTaskNotAvailable) {
+			// Задача уже посчитана, отменена или её аренда истекла
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to release task: %w", err)
+		}
+		released++
+	}
+
+	if released > 0 {
+		s.notifier.Notify()
+	}
+	return nil
+}
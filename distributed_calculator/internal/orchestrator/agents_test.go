@@ -0,0 +1,104 @@
+package orchestrator
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAgentRegistryReleasesTasksOfDeadAgents(t *testing.T) {
+	repo, clock := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{models.Addition: 60000}, time.Minute)
+	service.SetClock(clock.Now)
+	service.SetAgentTimeout(10 * time.Second)
+
+	if _, err := service.RegisterAgent(models.AgentRegistration{ID: "a1"}); !errors.Is(err, ErrInvalidAgent) {
+		t.Errorf("Expected ErrInvalidAgent without workers, got %v", err)
+	}
+	for _, id := range []string{"a1", "a2"} {
+		registration := models.AgentRegistration{ID: id, Hostname: "host-" + id, Workers: 2, Operations: []models.Operation{models.Addition}, Version: "test"}
+		if _, err := service.RegisterAgent(registration); err != nil {
+			t.Fatalf("Failed to register agent: %v", err)
+		}
+	}
+
+	if _, err := service.ProcessExpression("(1 + 2) + (3 + 4)"); err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	first, err := service.WaitForTask(context.Background(), "a1", 0)
+	if err != nil || first == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", first, err)
+	}
+	second, err := service.WaitForTask(context.Background(), "a2", 0)
+	if err != nil || second == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", second, err)
+	}
+
+	// a2 продолжает присылать heartbeat, а a1 пропал
+	clock.Advance(6 * time.Second)
+	if _, err := service.AgentHeartbeat("a2", []string{second.ID}); err != nil {
+		t.Fatalf("Failed to send heartbeat: %v", err)
+	}
+	clock.Advance(5 * time.Second)
+
+	if dead, err := service.ExpireAgents(); err != nil || dead != 1 {
+		t.Fatalf("Expected one dead agent, got %d (%v)", dead, err)
+	}
+
+	agents := service.GetAgents()
+	if len(agents) != 2 || agents[0].Status != models.AgentDead || agents[0].ActiveTasks != 0 ||
+		agents[1].Status != models.AgentAlive || agents[1].ActiveTasks != 1 || agents[1].Hostname != "host-a2" {
+		t.Errorf("Unexpected agents: %+v", agents)
+	}
+
+	// Задача мёртвого агента не ждёт истечения аренды
+	task, err := service.WaitForTask(context.Background(), "a2", 0)
+	if err != nil || task == nil || task.ID != first.ID {
+		t.Errorf("Expected task of the dead agent to be handed out again, got %+v (%v)", task, err)
+	}
+	if dead, _ := service.ExpireAgents(); dead != 0 {
+		t.Errorf("Expected dead agent to be reported once, got %d", dead)
+	}
+
+	// Агент, вернувшийся после перезапуска, снова жив, а его прежние задачи освобождены
+	if _, err := service.AgentHeartbeat("unknown", nil); !errors.Is(err, ErrAgentNotRegistered) {
+		t.Errorf("Expected ErrAgentNotRegistered, got %v", err)
+	}
+	if _, err := service.RegisterAgent(models.AgentRegistration{ID: "a2", Workers: 4}); err != nil {
+		t.Fatalf("Failed to register agent again: %v", err)
+	}
+	if task, _ := service.GetTaskForProcessing(); task == nil || (task.ID != first.ID && task.ID != second.ID) {
+		t.Errorf("Expected tasks of the restarted agent to be released, got %+v", task)
+	}
+	if agents := service.GetAgents(); agents[1].Workers != 4 || agents[1].ActiveTasks != 0 {
+		t.Errorf("Expected re-registration to update the agent, got %+v", agents[1])
+	}
+}
+
+func TestAgentHeartbeatCancelsUnknownTasks(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+
+	if _, err := service.RegisterAgent(models.AgentRegistration{ID: "a1", Workers: 2}); err != nil {
+		t.Fatalf("Failed to register agent: %v", err)
+	}
+	if _, err := service.ProcessExpression("1 + 2"); err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, err := service.WaitForTask(context.Background(), "a1", 0)
+	if err != nil || task == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", task, err)
+	}
+
+	// Задачу, о которой оркестратор не знает (например, после его перезапуска),
+	// агент должен бросить, а аренда остальных задач продлевается как обычно
+	cancelled, err := service.AgentHeartbeat("a1", []string{task.ID, "unknown"})
+	if err != nil {
+		t.Fatalf("Failed to send heartbeat: %v", err)
+	}
+	if len(cancelled) != 1 || cancelled[0] != "unknown" {
+		t.Errorf("Expected unknown task to be cancelled, got %v", cancelled)
+	}
+}
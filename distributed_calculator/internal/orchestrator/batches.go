@@ -0,0 +1,189 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/calculator"
+	"distributed-calculator/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// maxBatchSize ограничивает число выражений в одном POST /api/v1/calculate/batch
+const maxBatchSize = 10000
+
+// ErrInvalidBatch возвращается на пустой или слишком большой пакет и на повторяющиеся ключи
+var ErrInvalidBatch = errors.New("invalid batch")
+
+// ProcessBatch принимает выражения пакета по отдельности: ошибка в одном выражении
+// не мешает принять остальные и возвращается в его элементе пакета
+func (s *Service) ProcessBatch(requests []models.BatchItemRequest) (*models.Batch, error) {
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("%w: no expressions", ErrInvalidBatch)
+	}
+	if len(requests) > maxBatchSize {
+		return nil, fmt.Errorf("%w: at most %d expressions are allowed, got %d", ErrInvalidBatch, maxBatchSize, len(requests))
+	}
+
+	keys := make(map[string]bool)
+	for _, request := range requests {
+		if request.Key == "" {
+			continue
+		}
+		if keys[request.Key] {
+			return nil, fmt.Errorf("%w: duplicate key %q", ErrInvalidBatch, request.Key)
+		}
+		keys[request.Key] = true
+	}
+
+	// Сначала проверяем и разбираем все выражения: ошибка хранилища на середине пакета
+	// не должна оставить уже созданные выражения без пакета
+	batch := &models.Batch{
+		ID:        uuid.New().String(),
+		Items:     make([]models.BatchItem, 0, len(requests)),
+		CreatedAt: s.now(),
+	}
+	prepared := make([]*batchExpression, len(requests))
+	for i, request := range requests {
+		item := models.BatchItem{Key: request.Key}
+		prepared[i], item.Error, item.Column = s.prepareBatchItem(request)
+		batch.Items = append(batch.Items, item)
+	}
+
+	// Созданные выражения запоминаем отдельно: выражение, чьи задачи не удалось
+	// сохранить, тоже нужно откатить
+	created := []*models.Expression{}
+	for i, item := range prepared {
+		if item == nil {
+			continue
+		}
+		if err := s.repo.SaveExpression(item.expression); err != nil {
+			s.rollbackBatch(batch.ID, created)
+			return nil, fmt.Errorf("failed to save expression: %w", err)
+		}
+		created = append(created, item.expression)
+		if err := s.startExpression(item.expression, item.plan); err != nil {
+			s.rollbackBatch(batch.ID, created)
+			return nil, err
+		}
+		batch.Items[i].ExpressionID = item.expression.ID
+	}
+
+	if err := s.repo.SaveBatch(batch); err != nil {
+		s.rollbackBatch(batch.ID, created)
+		return nil, fmt.Errorf("failed to save batch: %w", err)
+	}
+
+	// Итоги выражений без задач отправляем, только когда пакет принят
+	for _, expression := range created {
+		s.deliverResult(expression)
+	}
+
+	return batch, nil
+}
+
+// batchExpression - проверенное выражение пакета вместе с его планом
+type batchExpression struct {
+	expression *models.Expression
+	plan       *calculator.Plan
+}
+
+// prepareBatchItem проверяет и разбирает выражение пакета. Если выражение не будет принято,
+// возвращает nil и ошибку для элемента пакета.
+func (s *Service) prepareBatchItem(request models.BatchItemRequest) (*batchExpression, string, int) {
+	if request.Expression == "" {
+		return nil, "Expression is required", 0
+	}
+
+	expression, err := s.newExpression(uuid.New().String(), request.CalculateRequest)
+	if err != nil {
+		return nil, err.Error(), 0
+	}
+
+	plan, err := calculator.Compile(expression.ID, request.Expression, s.operationTimes)
+	var parseErr *calculator.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		return nil, parseErr.Error(), parseErr.Column()
+	case err != nil:
+		return nil, err.Error(), 0
+	case len(plan.Tasks) == 0:
+		if _, err := strconv.ParseFloat(plan.Root, 64); err != nil {
+			return nil, "Invalid expression", 0
+		}
+	}
+	return &batchExpression{expression: expression, plan: plan}, "", 0
+}
+
+// rollbackBatch отменяет уже созданные выражения пакета, который не удалось сохранить.
+// Клиент не получил их ID, поэтому итоги на callback_url не отправляются.
+func (s *Service) rollbackBatch(batchID string, created []*models.Expression) {
+	for _, expression := range created {
+		if _, err := s.repo.TransitionExpression(expression.ID, expression.Status, models.StatusCancelled, ""); err != nil {
+			log.Printf("Failed to roll back expression %s of batch %s: %v", expression.ID, batchID, err)
+			continue
+		}
+		if err := s.repo.CancelTasks(expression.ID); err != nil {
+			log.Printf("Failed to cancel tasks of expression %s of batch %s: %v", expression.ID, batchID, err)
+		}
+	}
+}
+
+// GetBatchProgress сводит состояние выражений пакета. Результаты выражений
+// возвращаются, когда все они завершены.
+func (s *Service) GetBatchProgress(id string) (*models.BatchProgress, error) {
+	batch, err := s.repo.GetBatchByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	expressions, err := s.repo.GetBatchExpressions(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get batch expressions: %w", err)
+	}
+	byID := make(map[string]*models.Expression, len(expressions))
+	for _, expression := range expressions {
+		byID[expression.ID] = expression
+	}
+
+	progress := &models.BatchProgress{
+		ID:        batch.ID,
+		Total:     len(batch.Items),
+		CreatedAt: batch.CreatedAt,
+	}
+	items := make([]models.BatchItemResult, 0, len(batch.Items))
+
+	for _, item := range batch.Items {
+		result := models.BatchItemResult{BatchItem: item}
+
+		if item.ExpressionID != "" {
+			if expression, exists := byID[item.ExpressionID]; exists {
+				result.Status = expression.Status
+				result.Result = expression.Result
+				result.Error = expression.Error
+			} else {
+				result.Error = fmt.Sprintf("expression with ID %s not found", item.ExpressionID)
+			}
+		}
+
+		switch {
+		case result.Status == models.StatusCompleted:
+			progress.Finished++
+			progress.Completed++
+		case result.Status == "" || result.Status.Final():
+			// Пустой статус - выражение не было принято
+			progress.Finished++
+			progress.Failed++
+		}
+		items = append(items, result)
+	}
+
+	progress.Done = progress.Finished == progress.Total
+	if progress.Done {
+		progress.Items = items
+	}
+
+	return progress, nil
+}
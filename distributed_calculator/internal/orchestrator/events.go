@@ -0,0 +1,166 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// eventBufferSize - сколько событий подписчик может не забирать, прежде чем
+// новые события начнут вытеснять старые
+const eventBufferSize = 16
+
+// Subscription получает события одного выражения из EventBus. События - снимки
+// состояния выражения, поэтому медленный подписчик теряет только промежуточные
+// события, а последнее (в том числе итоговое EventResult) получает всегда.
+type Subscription struct {
+	expressionID string
+	events       chan models.ExpressionEvent
+}
+
+// Events закрывается после Unsubscribe
+func (s *Subscription) Events() <-chan models.ExpressionEvent {
+	return s.events
+}
+
+// send не блокируется: если буфер полон, вытесняет самое старое событие
+func (s *Subscription) send(event models.ExpressionEvent) {
+	for {
+		select {
+		case s.events <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-s.events:
+		default:
+		}
+	}
+}
+
+// EventBus рассылает события выражений подписчикам. Publish никогда не ждёт
+// подписчиков, поэтому не замедляет обработку результатов задач.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*Subscription]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[string]map[*Subscription]struct{})}
+}
+
+func (b *EventBus) Subscribe(expressionID string) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscription := &Subscription{
+		expressionID: expressionID,
+		events:       make(chan models.ExpressionEvent, eventBufferSize),
+	}
+	if b.subscribers[expressionID] == nil {
+		b.subscribers[expressionID] = make(map[*Subscription]struct{})
+	}
+	b.subscribers[expressionID][subscription] = struct{}{}
+	return subscription
+}
+
+// Unsubscribe отменяет подписку и закрывает её канал. Повторный вызов ничего не делает.
+func (b *EventBus) Unsubscribe(subscription *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscribers := b.subscribers[subscription.expressionID]
+	if _, exists := subscribers[subscription]; !exists {
+		return
+	}
+	delete(subscribers, subscription)
+	if len(subscribers) == 0 {
+		delete(b.subscribers, subscription.expressionID)
+	}
+	close(subscription.events)
+}
+
+// Subscribed сообщает, есть ли у выражения подписчики: без них событие можно не собирать
+func (b *EventBus) Subscribed(expressionID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers[expressionID]) > 0
+}
+
+func (b *EventBus) Publish(event models.ExpressionEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for subscription := range b.subscribers[event.ID] {
+		subscription.send(event)
+	}
+}
+
+// Subscribe подписывает на события выражения. Подписку нужно отменить через Unsubscribe.
+// Текущее состояние выражения стоит получить через ExpressionEvent после подписки,
+// чтобы не пропустить изменения между ними.
+func (s *Service) Subscribe(expressionID string) *Subscription {
+	return s.events.Subscribe(expressionID)
+}
+
+func (s *Service) Unsubscribe(subscription *Subscription) {
+	s.events.Unsubscribe(subscription)
+}
+
+// ExpressionEvent возвращает текущее состояние выражения: EventResult, если оно
+// уже завершено, и EventStatus иначе
+func (s *Service) ExpressionEvent(id string) (models.ExpressionEvent, error) {
+	expression, err := s.repo.GetExpressionByID(id)
+	if err != nil {
+		return models.ExpressionEvent{}, fmt.Errorf("failed to get expression: %w", err)
+	}
+
+	eventType := models.EventStatus
+	if expression.Status.Final() {
+		eventType = models.EventResult
+	}
+	return s.expressionEvent(expression, eventType)
+}
+
+// publish сообщает подписчикам выражения о посчитанной задаче или о завершении выражения
+func (s *Service) publish(expressionID string) {
+	if !s.events.Subscribed(expressionID) {
+		return
+	}
+
+	expression, err := s.repo.GetExpressionByID(expressionID)
+	if err != nil {
+		log.Printf("Failed to publish event for expression %s: %v", expressionID, err)
+		return
+	}
+
+	eventType := models.EventProgress
+	if expression.Status.Final() {
+		eventType = models.EventResult
+	}
+	event, err := s.expressionEvent(expression, eventType)
+	if err != nil {
+		log.Printf("Failed to publish event for expression %s: %v", expressionID, err)
+		return
+	}
+	s.events.Publish(event)
+}
+
+func (s *Service) expressionEvent(expression *models.Expression, eventType models.EventType) (models.ExpressionEvent, error) {
+	completed, total, err := s.repo.CountTasks(expression.ID)
+	if err != nil {
+		return models.ExpressionEvent{}, err
+	}
+
+	return models.ExpressionEvent{
+		Type:       eventType,
+		ID:         expression.ID,
+		Status:     expression.Status,
+		Result:     expression.Result,
+		Error:      expression.Error,
+		TasksDone:  completed,
+		TasksTotal: total,
+	}, nil
+}
@@ -0,0 +1,50 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"testing"
+)
+
+func TestEventBusKeepsLatestEventsForSlowSubscribers(t *testing.T) {
+	bus := NewEventBus()
+	subscription := bus.Subscribe("e1")
+	other := bus.Subscribe("e2")
+
+	for i := 1; i <= 3*eventBufferSize; i++ {
+		bus.Publish(models.ExpressionEvent{Type: models.EventProgress, ID: "e1", TasksDone: i})
+	}
+	result := 5.0
+	bus.Publish(models.ExpressionEvent{Type: models.EventResult, ID: "e1", Status: models.StatusCompleted, Result: &result})
+
+	if len(other.Events()) != 0 {
+		t.Errorf("Subscriber of another expression received %d events", len(other.Events()))
+	}
+
+	// Подписчик, не успевавший забирать события, теряет старые, но получает итог
+	received := []models.ExpressionEvent{}
+	for len(subscription.Events()) > 0 {
+		received = append(received, <-subscription.Events())
+	}
+	if len(received) != eventBufferSize {
+		t.Fatalf("Expected %d buffered events, got %d", eventBufferSize, len(received))
+	}
+	if last := received[len(received)-1]; last.Type != models.EventResult || *last.Result != 5 {
+		t.Errorf("Expected final event to be delivered, got %+v", last)
+	}
+	if first := received[0]; first.TasksDone != 2*eventBufferSize+2 {
+		t.Errorf("Expected oldest events to be dropped, first is %+v", first)
+	}
+
+	if !bus.Subscribed("e1") {
+		t.Errorf("Expected e1 to have subscribers")
+	}
+	bus.Unsubscribe(subscription)
+	bus.Unsubscribe(subscription)
+	if _, open := <-subscription.Events(); open {
+		t.Errorf("Expected subscription channel to be closed")
+	}
+	if bus.Subscribed("e1") {
+		t.Errorf("Expected e1 to have no subscribers after unsubscribe")
+	}
+	bus.Publish(models.ExpressionEvent{Type: models.EventProgress, ID: "e1"})
+}
@@ -0,0 +1,202 @@
+package orchestrator
+
+import (
+	"context"
+	"distributed-calculator/internal/agentpb"
+	"distributed-calculator/internal/models"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer отдаёт агентам задачи по gRPC. Протокол тот же, что у /internal/task,
+// но задачи приходят по постоянному потоку, без повторных запросов.
+type GRPCServer struct {
+	agentpb.UnimplementedAgentServiceServer
+	service *Service
+}
+
+func NewGRPCServer(service *Service) *GRPCServer {
+	return &GRPCServer{service: service}
+}
+
+func (g *GRPCServer) Register(ctx context.Context, request *agentpb.RegisterRequest) (*agentpb.RegisterResponse, error) {
+	operations := make([]models.Operation, 0, len(request.GetOperations()))
+	for _, operation := range request.GetOperations() {
+		operations = append(operations, models.Operation(operation))
+	}
+
+	_, err := g.service.RegisterAgent(models.AgentRegistration{
+		ID:         request.GetAgentId(),
+		Hostname:   request.GetHostname(),
+		Workers:    int(request.GetWorkers()),
+		Operations: operations,
+		Version:    request.GetVersion(),
+	})
+	if errors.Is(err, ErrInvalidAgent) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &agentpb.RegisterResponse{}, nil
+}
+
+// GetTask на каждое сообщение агента присылает одну задачу, как только она станет готовой.
+// Останавливаясь, агент закрывает отправку сообщений: тогда задачи на оставшиеся
+// сообщения больше не ждутся, а поток закрывается после уже отправленных задач.
+func (g *GRPCServer) GetTask(stream agentpb.AgentService_GetTaskServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	requests := &taskRequests{changed: make(chan struct{}, 1)}
+	go requests.read(stream, cancel)
+
+	for {
+		agentID, ok := requests.next()
+		if !ok {
+			if errors.Is(requests.err, io.EOF) {
+				return nil
+			}
+			return requests.err
+		}
+
+		task, err := g.nextTask(ctx, agentID)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if task == nil {
+			// Агент закрыл поток, пока задача не появилась
+			continue
+		}
+
+		if err := stream.Send(taskToProto(task)); err != nil {
+			// Задача вернётся в очередь, когда истечёт её аренда
+			log.Printf("Failed to send task %s to agent: %v", task.ID, err)
+			return err
+		}
+	}
+}
+
+// taskRequests читает сообщения агента, не дожидаясь выдачи задач на предыдущие,
+// чтобы сразу заметить, что агент закрыл поток
+type taskRequests struct {
+	mu      sync.Mutex
+	queue   []string // ID агентов из сообщений, на которые ещё не выдана задача
+	done    bool
+	err     error // чем закончилось чтение, io.EOF - агент закрыл отправку
+	changed chan struct{}
+}
+
+// read отменяет ожидание задач через cancel, когда сообщений больше не будет
+func (q *taskRequests) read(stream agentpb.AgentService_GetTaskServer, cancel context.CancelFunc) {
+	for {
+		request, err := stream.Recv()
+
+		q.mu.Lock()
+		if err != nil {
+			q.done, q.err = true, err
+		} else {
+			q.queue = append(q.queue, request.GetAgentId())
+		}
+		q.mu.Unlock()
+
+		select {
+		case q.changed <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			cancel()
+			return
+		}
+	}
+}
+
+// next возвращает ID агента из следующего сообщения или false, если сообщений больше не будет
+func (q *taskRequests) next() (string, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) > 0 {
+			agentID := q.queue[0]
+			q.queue = q.queue[1:]
+			q.mu.Unlock()
+			return agentID, true
+		}
+		done := q.done
+		q.mu.Unlock()
+
+		if done {
+			return "", false
+		}
+		<-q.changed
+	}
+}
+
+// nextTask ждёт готовую задачу, пока агент не закроет поток
+func (g *GRPCServer) nextTask(ctx context.Context, agentID string) (*models.Task, error) {
+	for ctx.Err() == nil {
+		task, err := g.service.WaitForTask(ctx, agentID, maxTaskWait)
+		if err != nil || task != nil {
+			return task, err
+		}
+	}
+	return nil, nil
+}
+
+func (g *GRPCServer) SubmitResult(ctx context.Context, request *agentpb.SubmitResultRequest) (*agentpb.SubmitResultResponse, error) {
+	if request.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "task ID is required")
+	}
+
+	if err := g.service.ProcessTaskResult(request.GetId(), request.GetResult()); err != nil {
+		return nil, taskStatusError(err)
+	}
+	return &agentpb.SubmitResultResponse{}, nil
+}
+
+func (g *GRPCServer) ReportFailure(ctx context.Context, request *agentpb.ReportFailureRequest) (*agentpb.ReportFailureResponse, error) {
+	if request.GetId() == "" || request.GetError() == "" {
+		return nil, status.Error(codes.InvalidArgument, "task ID and error are required")
+	}
+
+	if err := g.service.ProcessTaskFailure(request.GetId(), request.GetError()); err != nil {
+		return nil, taskStatusError(err)
+	}
+	return &agentpb.ReportFailureResponse{}, nil
+}
+
+func (g *GRPCServer) Heartbeat(ctx context.Context, request *agentpb.HeartbeatRequest) (*agentpb.HeartbeatResponse, error) {
+	cancelled, err := g.service.AgentHeartbeat(request.GetAgentId(), request.GetTaskIds())
+	if errors.Is(err, ErrAgentNotRegistered) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &agentpb.HeartbeatResponse{CancelledTaskIds: cancelled}, nil
+}
+
+// taskStatusError переводит ошибку обработки результата в код gRPC так же,
+// как ProcessTaskResultHandler переводит её в HTTP-статус
+func taskStatusError(err error) error {
+	if errors.Is(err, ErrTaskCancelled) {
+		return status.Error(codes.Aborted, err.Error())
+	}
+	if errors.Is(err, ErrInvalidResult) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.NotFound, err.Error())
+}
+
+func taskToProto(task *models.Task) *agentpb.Task {
+	return &agentpb.Task{
+		Id:            task.ID,
+		Args:          task.Args,
+		Operation:     string(task.Operation),
+		OperationTime: task.OperationTime,
+	}
+}
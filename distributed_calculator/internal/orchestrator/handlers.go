@@ -1,15 +1,22 @@
 package orchestrator
 
 import (
+	"distributed-calculator/internal/calculator"
 	"distributed-calculator/internal/models"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type Handlers struct {
-	service *Service
+	service             *Service
+	trustClientIDHeader bool
 }
 
 func NewHandlers(service *Service) *Handlers {
@@ -18,22 +25,64 @@ func NewHandlers(service *Service) *Handlers {
 	}
 }
 
+// SetTrustClientIDHeader разрешает определять клиента по заголовку X-Client-ID.
+// Включать стоит только за прокси, который сам выставляет этот заголовок:
+// иначе клиент может выдать себя за другого или занять несколько очередей планировщика.
+func (h *Handlers) SetTrustClientIDHeader(trust bool) {
+	h.trustClientIDHeader = trust
+}
+
+const (
+	// maxRequestBodySize ограничивает тело запроса и кадр WebSocket: выражение
+	// из предельного числа лексем в него заведомо помещается
+	maxRequestBodySize = 1 << 20
+	maxBatchBodySize   = 64 << 20
+)
+
 func (h *Handlers) CalculateHandler(w http.ResponseWriter, r *http.Request) {
 	// Декодируем запрос
 	var request models.CalculateRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+	if !decodeBody(w, r, maxRequestBodySize, &request) {
 		return
 	}
 	
 	if request.Expression == "" {
-		http.Error(w, "Expression is required", http.StatusUnprocessableEntity)
+		writeError(w, http.StatusUnprocessableEntity, "Expression is required")
 		return
 	}
+	request.ClientID = h.clientID(r)
 	
-	expression, err := h.service.ProcessExpression(request.Expression)
+	// Повтор с тем же Idempotency-Key возвращает уже созданное выражение
+	var expression *models.Expression
+	var err error
+	status := http.StatusCreated
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		var replayed bool
+		expression, replayed, err = h.service.ProcessIdempotentRequest(key, request)
+		if replayed {
+			status = http.StatusOK
+		}
+	} else {
+		expression, err = h.service.ProcessRequest(request)
+	}
+	if errors.Is(err, ErrIdempotencyKeyConflict) || errors.Is(err, ErrIdempotencyKeyInProgress) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, ErrInvalidDeadline) || errors.Is(err, ErrInvalidCallbackURL) || errors.Is(err, ErrInvalidIdempotencyKey) {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	var parseErr *calculator.ParseError
+	if errors.As(err, &parseErr) {
+		writeJSON(w, http.StatusUnprocessableEntity, models.ErrorResponse{
+			Error:  parseErr.Error(),
+			Column: parseErr.Column(),
+		})
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -42,17 +91,64 @@ func (h *Handlers) CalculateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+}
+
+// CalculateBatchHandler принимает пакет выражений. Пакет создаётся, даже если
+// часть выражений не разобрана: их ошибки возвращаются в соответствующих элементах.
+func (h *Handlers) CalculateBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.BatchCalculateRequest
+	if !decodeBody(w, r, maxBatchBodySize, &request) {
+		return
+	}
+	
+	client := h.clientID(r)
+	for i := range request.Expressions {
+		request.Expressions[i].ClientID = client
+	}
+	
+	batch, err := h.service.ProcessBatch(request.Expressions)
+	if errors.Is(err, ErrInvalidBatch) {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	
+	writeJSON(w, http.StatusCreated, models.BatchCalculateResponse{
+		ID:    batch.ID,
+		Items: batch.Items,
+	})
+}
+
+func (h *Handlers) GetBatchHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	
+	progress, err := h.service.GetBatchProgress(id)
+	if errors.Is(err, ErrBatchNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	
+	writeJSON(w, http.StatusOK, models.BatchResponse{
+		Batch: *progress,
+	})
 }
 
 func (h *Handlers) GetExpressionsHandler(w http.ResponseWriter, r *http.Request) {
 	expressions, err := h.service.GetAllExpressions()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	
@@ -67,7 +163,7 @@ func (h *Handlers) GetExpressionsHandler(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Failed to encode response")
 		return
 	}
 }
@@ -78,7 +174,7 @@ func (h *Handlers) GetExpressionHandler(w http.ResponseWriter, r *http.Request)
 	
 	expression, err := h.service.GetExpressionByID(id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, http.StatusNotFound, err.Error())
 		return
 	}
 	
@@ -89,16 +185,110 @@ func (h *Handlers) GetExpressionHandler(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+}
+
+func (h *Handlers) CancelExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	
+	expression, err := h.service.CancelExpression(id)
+	if errors.Is(err, ErrExpressionFinished) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	
+	writeJSON(w, http.StatusOK, models.ExpressionResponse{
+		Expression: *expression,
+	})
+}
+
+// sseKeepAliveInterval - как часто в молчащий поток событий пишется комментарий,
+// чтобы прокси не закрывали соединение
+const sseKeepAliveInterval = 15 * time.Second
+
+// ExpressionEventsHandler отдаёт события выражения в формате Server-Sent Events:
+// сначала текущее состояние, затем progress на каждую посчитанную задачу
+// и итоговое result, после которого поток закрывается
+func (h *Handlers) ExpressionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	
+	// Подписываемся до чтения состояния, чтобы не пропустить изменения между ними
+	subscription := h.service.Subscribe(id)
+	defer h.service.Unsubscribe(subscription)
+	
+	event, err := h.service.ExpressionEvent(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	
+	if !writeEvent(w, flusher, event) || event.Type == models.EventResult {
 		return
 	}
+	
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-subscription.Events():
+			if !writeEvent(w, flusher, event) || event.Type == models.EventResult {
+				return
+			}
+		}
+	}
 }
 
+// writeEvent пишет событие в поток SSE и возвращает false, если клиент отключился
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event models.ExpressionEvent) bool {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return false
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return false
+	}
+	flusher.Flush()
+	return true
+}
+
+// maxTaskWait ограничивает long-poll, чтобы соединения агентов не висели бесконечно
+const maxTaskWait = time.Minute
+
 func (h *Handlers) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
-	// Получаем задачу для обработки
-	task, err := h.service.GetTaskForProcessing()
+	wait, ok := parseWait(w, r)
+	if !ok {
+		return
+	}
+	
+	// Получаем задачу для обработки; зарегистрированный агент передаёт свой ID в X-Agent-ID
+	task, err := h.service.WaitForTask(r.Context(), r.Header.Get("X-Agent-ID"), wait)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	
@@ -109,7 +299,7 @@ func (h *Handlers) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
 			Task: nil,
 		}
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, "Failed to encode response")
 		}
 		return
 	}
@@ -121,27 +311,213 @@ func (h *Handlers) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+}
+
+// maxTaskBatch ограничивает число задач, выдаваемых одним запросом /internal/tasks
+const maxTaskBatch = 100
+
+// GetTasksHandler выдаёт до max задач за один запрос: ждёт первую, как GetTaskHandler,
+// и добавляет к ней уже готовые. Если задач не появилось, возвращает пустой список.
+func (h *Handlers) GetTasksHandler(w http.ResponseWriter, r *http.Request) {
+	max := 1
+	if value := r.URL.Query().Get("max"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid max")
+			return
+		}
+		max = parsed
+		if max > maxTaskBatch {
+			max = maxTaskBatch
+		}
+	}
+	
+	wait, ok := parseWait(w, r)
+	if !ok {
+		return
+	}
+	
+	tasks, err := h.service.WaitForTasks(r.Context(), r.Header.Get("X-Agent-ID"), max, wait)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	
+	if tasks == nil {
+		tasks = []*models.Task{}
+	}
+	writeJSON(w, http.StatusOK, models.TaskListResponse{
+		Tasks: tasks,
+	})
+}
+
+// parseWait читает параметр wait (например ?wait=30s), с которым запрос ждёт
+// появления готовой задачи. При ошибке отвечает 400 и возвращает false.
+func parseWait(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	value := r.URL.Query().Get("wait")
+	if value == "" {
+		return 0, true
+	}
+	
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid wait duration")
+		return 0, false
+	}
+	if wait > maxTaskWait {
+		wait = maxTaskWait
+	}
+	return wait, true
 }
 
 func (h *Handlers) ProcessTaskResultHandler(w http.ResponseWriter, r *http.Request) {
 	var request models.TaskResultRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusUnprocessableEntity)
+	if !decodeBody(w, r, maxRequestBodySize, &request) {
+		return
+	}
+	
+	if status, err := h.processTaskResult(request); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	
+	w.WriteHeader(http.StatusOK)
+}
+
+// ProcessTaskResultsHandler принимает пакет результатов. Каждый результат
+// обрабатывается отдельно, и ответ содержит итог для каждого из них.
+func (h *Handlers) ProcessTaskResultsHandler(w http.ResponseWriter, r *http.Request) {
+	var requests []models.TaskResultRequest
+	if !decodeBody(w, r, maxRequestBodySize, &requests) {
 		return
 	}
 	
+	response := models.TaskResultListResponse{
+		Results: make([]models.TaskResultStatus, 0, len(requests)),
+	}
+	for _, request := range requests {
+		status, err := h.processTaskResult(request)
+		result := models.TaskResultStatus{ID: request.ID, Status: status}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		response.Results = append(response.Results, result)
+	}
+	
+	writeJSON(w, http.StatusOK, response)
+}
+
+// processTaskResult передаёт результат задачи сервису и возвращает HTTP-статус итога
+func (h *Handlers) processTaskResult(request models.TaskResultRequest) (int, error) {
 	if request.ID == "" {
-		http.Error(w, "Task ID is required", http.StatusUnprocessableEntity)
+		return http.StatusUnprocessableEntity, errors.New("Task ID is required")
+	}
+	
+	var err error
+	if request.Error != "" {
+		err = h.service.ProcessTaskFailure(request.ID, request.Error)
+	} else {
+		err = h.service.ProcessTaskResult(request.ID, request.Result)
+	}
+	if errors.Is(err, ErrTaskCancelled) {
+		// 410 отличает отменённую задачу от неизвестной, и агент просто отбрасывает результат
+		return http.StatusGone, err
+	}
+	if errors.Is(err, ErrInvalidResult) {
+		return http.StatusUnprocessableEntity, err
+	}
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	
+	return http.StatusOK, nil
+}
+
+func (h *Handlers) RegisterAgentHandler(w http.ResponseWriter, r *http.Request) {
+	var registration models.AgentRegistration
+	if !decodeBody(w, r, maxRequestBodySize, &registration) {
 		return
 	}
 	
-	if err := h.service.ProcessTaskResult(request.ID, request.Result); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	agent, err := h.service.RegisterAgent(registration)
+	if errors.Is(err, ErrInvalidAgent) {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	
-	w.WriteHeader(http.StatusOK)
-}
\ No newline at end of file
+	writeJSON(w, http.StatusOK, agent)
+}
+
+func (h *Handlers) AgentHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var request models.HeartbeatRequest
+	if !decodeBody(w, r, maxRequestBodySize, &request) {
+		return
+	}
+	
+	cancelled, err := h.service.AgentHeartbeat(mux.Vars(r)["id"], request.TaskIDs)
+	if errors.Is(err, ErrAgentNotRegistered) {
+		// Агент должен зарегистрироваться заново
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	
+	writeJSON(w, http.StatusOK, models.HeartbeatResponse{
+		CancelledTaskIDs: cancelled,
+	})
+}
+
+func (h *Handlers) GetAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, models.AgentListResponse{
+		Agents: h.service.GetAgents(),
+	})
+}
+
+// clientID определяет отправителя для справедливого планирования и ключей идемпотентности:
+// по адресу клиента, а если заголовку доверяют - по X-Client-ID
+func (h *Handlers) clientID(r *http.Request) string {
+	if id := r.Header.Get("X-Client-ID"); h.trustClientIDHeader && id != "" {
+		return id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// decodeBody читает JSON-тело запроса не длиннее limit байт. При ошибке отвечает
+// клиенту сам и возвращает false.
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", limit))
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "Invalid request body")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, models.ErrorResponse{Error: message})
+}
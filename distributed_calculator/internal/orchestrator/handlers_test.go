@@ -0,0 +1,561 @@
+package orchestrator
+
+import (
+	"bufio"
+	"distributed-calculator/internal/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func newTestHandlers() *Handlers {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	return NewHandlers(service)
+}
+
+func TestCalculateHandlerRejectsMalformedExpressions(t *testing.T) {
+	handlers := newTestHandlers()
+
+	tests := []struct {
+		expression string
+		column     int
+	}{
+		{"2+", 3},
+		{"*3", 1},
+		{"(2+3", 5},
+		{"2++", 4},
+	}
+
+	for _, tt := range tests {
+		body := `{"expression": "` + tt.expression + `"}`
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+
+		handlers.CalculateHandler(recorder, request)
+
+		if recorder.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %q, got %d", tt.expression, recorder.Code)
+			continue
+		}
+		var response models.ErrorResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Errorf("Failed to decode error body for %q: %v", tt.expression, err)
+			continue
+		}
+		if response.Column != tt.column || response.Error == "" {
+			t.Errorf("Incorrect error for %q: %+v", tt.expression, response)
+		}
+	}
+}
+
+func TestCalculateHandlerRejectsInvalidTimeout(t *testing.T) {
+	handlers := newTestHandlers()
+
+	body := `{"expression": "2 + 2", "timeout_ms": -5}`
+	recorder := httptest.NewRecorder()
+	handlers.CalculateHandler(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for negative timeout, got %d", recorder.Code)
+	}
+}
+
+func TestCalculateHandlerLimitsExpressionSize(t *testing.T) {
+	handlers := newTestHandlers()
+
+	// Тело больше предела не читается целиком
+	body := `{"expression": "` + strings.Repeat("1+", maxRequestBodySize) + `1"}`
+	recorder := httptest.NewRecorder()
+	handlers.CalculateHandler(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for oversized body, got %d", recorder.Code)
+	}
+
+	// Длинное выражение в пределах тела отклоняется разбором, а не роняет процесс
+	body = `{"expression": "` + strings.Repeat("1+", 100000) + `1"}`
+	recorder = httptest.NewRecorder()
+	handlers.CalculateHandler(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body)))
+	var response models.ErrorResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || recorder.Code != http.StatusUnprocessableEntity || response.Column == 0 {
+		t.Errorf("Expected 422 with column for too long expression, got %d %+v", recorder.Code, response)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	handler := RecoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 after panic, got %d", recorder.Code)
+	}
+	var response models.ErrorResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response.Error == "" {
+		t.Errorf("Expected JSON error body, got %q", recorder.Body.String())
+	}
+}
+
+func TestCancelExpressionHandler(t *testing.T) {
+	handlers := newTestHandlers()
+
+	expression, err := handlers.service.ProcessExpression("2 * 3 + 4")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, _ := handlers.service.GetTaskForProcessing()
+
+	cancel := func(id string) *httptest.ResponseRecorder {
+		request := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/api/v1/expressions/"+id, nil), map[string]string{"id": id})
+		recorder := httptest.NewRecorder()
+		handlers.CancelExpressionHandler(recorder, request)
+		return recorder
+	}
+
+	recorder := cancel(expression.ID)
+	var response models.ExpressionResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with expression, got %d: %v", recorder.Code, err)
+	}
+	if response.Expression.Status != models.StatusCancelled {
+		t.Errorf("Expected CANCELLED status, got %s", response.Expression.Status)
+	}
+
+	if recorder := cancel("missing"); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown expression, got %d", recorder.Code)
+	}
+
+	// Агент узнаёт об отмене по 410 в ответ на результат
+	body := `{"id": "` + task.ID + `", "result": 6}`
+	recorder = httptest.NewRecorder()
+	handlers.ProcessTaskResultHandler(recorder, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+	if recorder.Code != http.StatusGone {
+		t.Errorf("Expected 410 for result of cancelled task, got %d", recorder.Code)
+	}
+
+	completed, _ := handlers.service.ProcessExpression("1")
+	if recorder := cancel(completed.ID); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for completed expression, got %d", recorder.Code)
+	}
+}
+
+func TestGetTaskHandlerLongPoll(t *testing.T) {
+	handlers := newTestHandlers()
+
+	recorder := httptest.NewRecorder()
+	handlers.GetTaskHandler(recorder, httptest.NewRequest(http.MethodGet, "/internal/task?wait=soon", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid wait, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handlers.GetTaskHandler(recorder, httptest.NewRequest(http.MethodGet, "/internal/task?wait=20ms", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after wait without tasks, got %d", recorder.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		recorder := httptest.NewRecorder()
+		handlers.GetTaskHandler(recorder, httptest.NewRequest(http.MethodGet, "/internal/task?wait=10s", nil))
+		done <- recorder
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := handlers.service.ProcessExpression("2 + 2"); err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	select {
+	case recorder := <-done:
+		var response models.TaskResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || recorder.Code != http.StatusOK || response.Task == nil {
+			t.Errorf("Expected waiting request to receive the new task, got %d: %q", recorder.Code, recorder.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Waiting request was not woken by the new task")
+	}
+}
+
+func TestAgentHandlers(t *testing.T) {
+	handlers := newTestHandlers()
+
+	register := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handlers.RegisterAgentHandler(recorder, httptest.NewRequest(http.MethodPost, "/internal/agents", strings.NewReader(body)))
+		return recorder
+	}
+	heartbeat := func(id string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/internal/agents/"+id+"/heartbeat", strings.NewReader(`{"task_ids":[]}`))
+		recorder := httptest.NewRecorder()
+		handlers.AgentHeartbeatHandler(recorder, mux.SetURLVars(request, map[string]string{"id": id}))
+		return recorder
+	}
+
+	if recorder := register(`{"id":"a1"}`); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for registration without workers, got %d", recorder.Code)
+	}
+	if recorder := register(`{"id":"a1","hostname":"worker-1","workers":4,"operations":["+","-"],"version":"1.0"}`); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for registration, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := heartbeat("a1"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected 200 for heartbeat, got %d", recorder.Code)
+	}
+	if recorder := heartbeat("a2"); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for heartbeat of unknown agent, got %d", recorder.Code)
+	}
+
+	recorder := httptest.NewRecorder()
+	handlers.GetAgentsHandler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/agents", nil))
+	var response models.AgentListResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Agents) != 1 || response.Agents[0].ID != "a1" || response.Agents[0].Workers != 4 ||
+		len(response.Agents[0].Operations) != 2 || response.Agents[0].Status != models.AgentAlive {
+		t.Errorf("Unexpected agents: %+v", response.Agents)
+	}
+}
+
+func TestTaskBatchHandlers(t *testing.T) {
+	handlers := newTestHandlers()
+
+	if _, err := handlers.service.ProcessExpression("(1 + 2) * (3 + 4) + (5 + 6)"); err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handlers.GetTasksHandler(recorder, httptest.NewRequest(http.MethodGet, "/internal/tasks?max=zero", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid max, got %d", recorder.Code)
+	}
+
+	// Готовы три сложения, но агент просит не больше двух задач
+	recorder = httptest.NewRecorder()
+	handlers.GetTasksHandler(recorder, httptest.NewRequest(http.MethodGet, "/internal/tasks?max=2", nil))
+	var batch models.TaskListResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&batch); err != nil || recorder.Code != http.StatusOK || len(batch.Tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %d: %q", recorder.Code, recorder.Body.String())
+	}
+
+	body := `[{"id":"` + batch.Tasks[0].ID + `","result":3},{"id":"missing","result":1},{"id":""},{"id":"` + batch.Tasks[1].ID + `","error":"overflow"}]`
+	recorder = httptest.NewRecorder()
+	handlers.ProcessTaskResultsHandler(recorder, httptest.NewRequest(http.MethodPost, "/internal/tasks/results", strings.NewReader(body)))
+	var results models.TaskResultListResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&results); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %q", recorder.Code, recorder.Body.String())
+	}
+
+	expected := []int{http.StatusOK, http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusOK}
+	if len(results.Results) != len(expected) {
+		t.Fatalf("Expected %d results, got %+v", len(expected), results.Results)
+	}
+	for i, status := range expected {
+		if results.Results[i].Status != status {
+			t.Errorf("Expected status %d for result %d, got %+v", status, i, results.Results[i])
+		}
+	}
+
+	// Ошибка второй задачи отменила выражение, и её запоздавший результат отклоняется
+	recorder = httptest.NewRecorder()
+	handlers.ProcessTaskResultsHandler(recorder, httptest.NewRequest(http.MethodPost, "/internal/tasks/results", strings.NewReader(`[{"id":"`+batch.Tasks[1].ID+`","result":7}]`)))
+	if err := json.NewDecoder(recorder.Body).Decode(&results); err != nil || len(results.Results) != 1 || results.Results[0].Status != http.StatusGone {
+		t.Errorf("Expected 410 for result of cancelled expression, got %+v (%v)", results.Results, err)
+	}
+
+	recorder = httptest.NewRecorder()
+	handlers.GetTasksHandler(recorder, httptest.NewRequest(http.MethodGet, "/internal/tasks?max=5", nil))
+	if err := json.NewDecoder(recorder.Body).Decode(&batch); err != nil || recorder.Code != http.StatusOK || batch.Tasks == nil || len(batch.Tasks) != 0 {
+		t.Errorf("Expected empty task list, got %d: %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestExpressionEventsHandler(t *testing.T) {
+	handlers := newTestHandlers()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/expressions/{id}/events", handlers.ExpressionEventsHandler).Methods("GET")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL + "/api/v1/expressions/missing/events"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown expression, got %v (%v)", resp, err)
+	}
+
+	expression, err := handlers.service.ProcessExpression("(1 + 2) * 3")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/expressions/" + expression.ID + "/events")
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Expected event stream, got %s", contentType)
+	}
+
+	events := make(chan models.ExpressionEvent)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, found := strings.CutPrefix(scanner.Text(), "data: "); found {
+				var event models.ExpressionEvent
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					t.Errorf("Failed to decode event %q: %v", data, err)
+				}
+				events <- event
+			}
+		}
+	}()
+
+	next := func() models.ExpressionEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event")
+			return models.ExpressionEvent{}
+		}
+	}
+
+	if event := next(); event.Type != models.EventStatus || event.Status != models.StatusProcessing || event.TasksDone != 0 || event.TasksTotal != 2 {
+		t.Errorf("Expected initial status event, got %+v", event)
+	}
+
+	for _, expected := range []models.ExpressionEvent{
+		{Type: models.EventProgress, Status: models.StatusProcessing, TasksDone: 1, TasksTotal: 2},
+		{Type: models.EventResult, Status: models.StatusCompleted, TasksDone: 2, TasksTotal: 2},
+	} {
+		task, err := handlers.service.GetTaskForProcessing()
+		if err != nil || task == nil {
+			t.Fatalf("Failed to get task: %+v (%v)", task, err)
+		}
+		if err := handlers.service.ProcessTaskResult(task.ID, evaluateTestTask(t, task)); err != nil {
+			t.Fatalf("Failed to process task result: %v", err)
+		}
+
+		event := next()
+		if event.Type != expected.Type || event.Status != expected.Status || event.TasksDone != expected.TasksDone || event.TasksTotal != expected.TasksTotal {
+			t.Errorf("Expected %+v, got %+v", expected, event)
+		}
+		if event.Type == models.EventResult && (event.Result == nil || *event.Result != 9) {
+			t.Errorf("Expected result 9, got %+v", event)
+		}
+	}
+
+	// После итогового события поток закрывается
+	if _, open := <-events; open {
+		t.Errorf("Expected stream to be closed after result")
+	}
+}
+
+func TestCalculateBatchHandlers(t *testing.T) {
+	handlers := newTestHandlers()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/calculate/batch", handlers.CalculateBatchHandler).Methods("POST")
+	router.HandleFunc("/api/v1/batches/{id}", handlers.GetBatchHandler).Methods("GET")
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+
+	for _, body := range []string{
+		`{"expressions": []}`,
+		`{"expressions": [{"expression": "1 + 1", "key": "a"}, {"expression": "2 + 2", "key": "a"}]}`,
+		`[`,
+	} {
+		if recorder := serve(http.MethodPost, "/api/v1/calculate/batch", body); recorder.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %s, got %d", body, recorder.Code)
+		}
+	}
+	if recorder := serve(http.MethodGet, "/api/v1/batches/missing", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown batch, got %d", recorder.Code)
+	}
+
+	recorder := serve(http.MethodPost, "/api/v1/calculate/batch",
+		`{"expressions": [{"expression": "2 * 3", "key": "a"}, {"expression": "2 +", "key": "b"}, {"expression": "7"}, {"expression": "1 + 4", "key": "c"}]}`)
+	var submitted models.BatchCalculateResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&submitted); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %q", recorder.Code, recorder.Body.String())
+	}
+	if len(submitted.Items) != 4 || submitted.ID == "" {
+		t.Fatalf("Unexpected batch: %+v", submitted)
+	}
+	if item := submitted.Items[1]; item.Key != "b" || item.ExpressionID != "" || item.Error == "" || item.Column != 4 {
+		t.Errorf("Expected parse error for item b, got %+v", item)
+	}
+	for _, i := range []int{0, 2, 3} {
+		if submitted.Items[i].ExpressionID == "" || submitted.Items[i].Error != "" {
+			t.Errorf("Expected accepted item %d, got %+v", i, submitted.Items[i])
+		}
+	}
+
+	progress := func() models.BatchProgress {
+		recorder := serve(http.MethodGet, "/api/v1/batches/"+submitted.ID, "")
+		var response models.BatchResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %q", recorder.Code, recorder.Body.String())
+		}
+		return response.Batch
+	}
+
+	// Число без операций посчитано сразу, а ошибка разбора сразу считается неудачей
+	if batch := progress(); batch.Done || batch.Total != 4 || batch.Finished != 2 || batch.Completed != 1 || batch.Failed != 1 || batch.Items != nil {
+		t.Errorf("Unexpected progress: %+v", batch)
+	}
+
+	for i := 0; i < 2; i++ {
+		task, err := handlers.service.GetTaskForProcessing()
+		if err != nil || task == nil {
+			t.Fatalf("Failed to get task: %+v (%v)", task, err)
+		}
+		if err := handlers.service.ProcessTaskResult(task.ID, evaluateTestTask(t, task)); err != nil {
+			t.Fatalf("Failed to process task result: %v", err)
+		}
+	}
+
+	batch := progress()
+	if !batch.Done || batch.Finished != 4 || batch.Completed != 3 || batch.Failed != 1 || len(batch.Items) != 4 {
+		t.Fatalf("Unexpected progress: %+v", batch)
+	}
+	for i, expected := range []float64{6, 0, 7, 5} {
+		item := batch.Items[i]
+		if item.Key != submitted.Items[i].Key || item.ExpressionID != submitted.Items[i].ExpressionID {
+			t.Errorf("Item %d does not match submission: %+v", i, item)
+		}
+		if i == 1 {
+			if item.Status != "" || item.Error == "" {
+				t.Errorf("Expected rejected item, got %+v", item)
+			}
+			continue
+		}
+		if item.Status != models.StatusCompleted || item.Result == nil || *item.Result != expected {
+			t.Errorf("Expected result %g for item %d, got %+v", expected, i, item)
+		}
+	}
+}
+
+// brokenBatchRepository не может прочитать ни один пакет
+type brokenBatchRepository struct {
+	Repository
+}
+
+func (r *brokenBatchRepository) GetBatchByID(id string) (*models.Batch, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestGetBatchHandlerReportsStorageErrors(t *testing.T) {
+	repo, _ := newTestRepository()
+	handlers := NewHandlers(NewService(&brokenBatchRepository{Repository: repo}, map[models.Operation]int64{}, time.Second))
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/batches/{id}", handlers.GetBatchHandler).Methods("GET")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/batches/b1", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for storage error, got %d", recorder.Code)
+	}
+}
+
+func TestCalculateHandlerIdempotencyKey(t *testing.T) {
+	handlers := newTestHandlers()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	handlers.service.SetClock(clock.Now)
+	handlers.service.SetIdempotencyTTL(time.Hour)
+
+	calculateAs := func(client, key, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		req.RemoteAddr = client + ":1234"
+		recorder := httptest.NewRecorder()
+		handlers.CalculateHandler(recorder, req)
+
+		var response models.CalculateResponse
+		_ = json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Code, response.ID
+	}
+	calculate := func(key, body string) (int, string) {
+		return calculateAs("192.0.2.1", key, body)
+	}
+
+	status, id := calculate("k1", `{"expression": "2 + 2"}`)
+	if status != http.StatusCreated || id == "" {
+		t.Fatalf("Expected 201 with ID, got %d %q", status, id)
+	}
+
+	// Повтор того же запроса, даже в другом форматировании, возвращает то же выражение
+	if status, replayed := calculate("k1", `{ "expression":"2 + 2" }`); status != http.StatusOK || replayed != id {
+		t.Errorf("Expected 200 with %s, got %d %q", id, status, replayed)
+	}
+	if status, _ := calculate("k1", `{"expression": "2 + 3"}`); status != http.StatusConflict {
+		t.Errorf("Expected 409 for different body, got %d", status)
+	}
+	if status, other := calculate("k2", `{"expression": "2 + 2"}`); status != http.StatusCreated || other == id {
+		t.Errorf("Expected new expression for another key, got %d %q", status, other)
+	}
+	// Ключи разных клиентов не пересекаются
+	if status, other := calculateAs("192.0.2.2", "k1", `{"expression": "2 + 2"}`); status != http.StatusCreated || other == id {
+		t.Errorf("Expected new expression for the same key of another client, got %d %q", status, other)
+	}
+
+	// Отклонённый запрос не занимает ключ
+	for i := 0; i < 2; i++ {
+		if status, _ := calculate("k3", `{"expression": "2 +"}`); status != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for malformed expression, got %d", status)
+		}
+	}
+	if status, _ := calculate(strings.Repeat("k", 256), `{"expression": "2 + 2"}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for too long key, got %d", status)
+	}
+
+	expressions, _ := handlers.service.GetAllExpressions()
+	accepted := 0
+	for _, expression := range expressions {
+		if expression.Status != models.StatusError {
+			accepted++
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("Expected 3 accepted expressions, got %d", accepted)
+	}
+
+	clock.Advance(time.Hour)
+	if status, renewed := calculate("k1", `{"expression": "2 + 3"}`); status != http.StatusCreated || renewed == id {
+		t.Errorf("Expected expired key to create new expression, got %d %q", status, renewed)
+	}
+}
+
+func TestClientIDTrustsHeaderOnlyWhenEnabled(t *testing.T) {
+	handlers := newTestHandlers()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	request.Header.Set("X-Client-ID", "someone-else")
+
+	// По умолчанию клиент не может выбрать себе очередь планировщика
+	if client := handlers.clientID(request); client != "192.0.2.1" {
+		t.Errorf("Expected client to be identified by address, got %q", client)
+	}
+
+	handlers.SetTrustClientIDHeader(true)
+	if client := handlers.clientID(request); client != "someone-else" {
+		t.Errorf("Expected trusted header to identify client, got %q", client)
+	}
+	request.Header.Del("X-Client-ID")
+	if client := handlers.clientID(request); client != "192.0.2.1" {
+		t.Errorf("Expected address without header, got %q", client)
+	}
+}
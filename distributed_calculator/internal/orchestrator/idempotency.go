@@ -0,0 +1,106 @@
+package orchestrator
+
+import (
+	"crypto/sha256"
+	"distributed-calculator/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultIdempotencyTTL = 24 * time.Hour
+	// maxIdempotencyKeyLength ограничивает длину заголовка Idempotency-Key
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	// ErrInvalidIdempotencyKey возвращается на слишком длинный Idempotency-Key
+	ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+	// ErrIdempotencyKeyConflict возвращается, если ключ уже использован с другим телом запроса
+	ErrIdempotencyKeyConflict = errors.New("idempotency key was used with a different request")
+	// ErrIdempotencyKeyInProgress возвращается, пока первый запрос с этим ключом ещё не сохранил выражение
+	ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+// SetIdempotencyTTL задаёт, сколько времени повтор с тем же Idempotency-Key
+// возвращает уже созданное выражение
+func (s *Service) SetIdempotencyTTL(ttl time.Duration) {
+	s.idempotencyTTL = ttl
+}
+
+// ProcessIdempotentRequest создаёт выражение не больше одного раза на ключ клиента
+// request.ClientID: повтор с тем же ключом и тем же запросом возвращает первое
+// выражение и replayed = true. Одинаковые ключи разных клиентов не связаны.
+// ID выражения резервируется вместе с ключом, поэтому одновременные повторы не
+// создают второе выражение.
+func (s *Service) ProcessIdempotentRequest(key string, request models.CalculateRequest) (expression *models.Expression, replayed bool, err error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, false, fmt.Errorf("%w: must be at most %d characters", ErrInvalidIdempotencyKey, maxIdempotencyKeyLength)
+	}
+
+	hash, err := requestHash(request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := s.now()
+	reservation := &models.IdempotencyKey{
+		ClientID:     request.ClientID,
+		Key:          key,
+		RequestHash:  hash,
+		ExpressionID: uuid.New().String(),
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(s.idempotencyTTL),
+	}
+
+	existing, err := s.repo.ReserveIdempotencyKey(reservation)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+	if existing != nil {
+		if existing.RequestHash != hash {
+			return nil, false, ErrIdempotencyKeyConflict
+		}
+		expression, err := s.repo.GetExpressionByID(existing.ExpressionID)
+		if err != nil {
+			return nil, false, ErrIdempotencyKeyInProgress
+		}
+		return expression, true, nil
+	}
+
+	expression, err = s.processRequest(reservation.ExpressionID, request)
+	if err != nil {
+		// Повтор отклонённого запроса должен снова получить ошибку, а не ID выражения
+		if err := s.repo.DeleteIdempotencyKey(request.ClientID, key); err != nil {
+			log.Printf("Failed to release idempotency key %q: %v", key, err)
+		}
+		return nil, false, err
+	}
+
+	return expression, false, nil
+}
+
+// ExpireIdempotencyKeys удаляет истёкшие ключи и возвращает их число
+func (s *Service) ExpireIdempotencyKeys() (int, error) {
+	deleted, err := s.repo.DeleteExpiredIdempotencyKeys(s.now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+	return deleted, nil
+}
+
+// requestHash не зависит от форматирования тела: запросы сравниваются после разбора
+func requestHash(request models.CalculateRequest) (string, error) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode request: %w", err)
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
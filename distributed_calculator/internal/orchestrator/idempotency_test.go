@@ -0,0 +1,58 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessIdempotentRequestCreatesOneExpression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calculator.db")
+	repo, _ := newTestSQLiteRepository(t, path)
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	request := models.CalculateRequest{Expression: "(1 + 2) * 3"}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ids := map[string]int{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expression, _, err := service.ProcessIdempotentRequest("retry", request)
+			if errors.Is(err, ErrIdempotencyKeyInProgress) {
+				return
+			}
+			if err != nil {
+				t.Errorf("Failed to process request: %v", err)
+				return
+			}
+			mu.Lock()
+			ids[expression.ID]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(ids) != 1 {
+		t.Fatalf("Expected all retries to get one expression, got %v", ids)
+	}
+	expressions, err := service.GetAllExpressions()
+	if err != nil || len(expressions) != 1 {
+		t.Errorf("Expected 1 stored expression, got %d (%v)", len(expressions), err)
+	}
+
+	// Повтор после перезапуска оркестратора находит ключ в хранилище
+	repo.Close()
+	reopened, _ := newTestSQLiteRepository(t, path)
+	service = NewService(reopened, map[models.Operation]int64{}, time.Second)
+	for id := range ids {
+		expression, replayed, err := service.ProcessIdempotentRequest("retry", request)
+		if err != nil || !replayed || expression.ID != id {
+			t.Errorf("Expected replay of %s, got %+v, %v (%v)", id, expression, replayed, err)
+		}
+	}
+}
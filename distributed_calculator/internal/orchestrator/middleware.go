@@ -0,0 +1,25 @@
+package orchestrator
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// RecoveryMiddleware не даёт панике в обработчике уронить соединение:
+// паника логируется, а клиент получает 500 с JSON-описанием ошибки.
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				log.Printf("Panic while handling %s %s: %v\n%s", r.Method, r.URL.Path, recovered, debug.Stack())
+				writeError(w, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
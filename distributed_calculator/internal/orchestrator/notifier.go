@@ -0,0 +1,102 @@
+package orchestrator
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"log"
+	"sync"
+	"time"
+)
+
+// taskNotifier будит всех ожидающих агентов, когда могли появиться готовые задачи.
+// Каждое ожидание получает текущий канал, а Notify закрывает его и заводит новый.
+type taskNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newTaskNotifier() *taskNotifier {
+	return &taskNotifier{ch: make(chan struct{})}
+}
+
+func (n *taskNotifier) Wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+func (n *taskNotifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// waitRecheckInterval - как часто ожидающий агент сам проверяет очередь: задача
+// может стать готовой без сохранения, когда истекает аренда другого агента
+const waitRecheckInterval = time.Second
+
+// WaitForTask выдаёт агенту agentID готовую задачу, а если её нет - ждёт её появления
+// не дольше wait. Возвращает nil, если задача так и не появилась или ctx отменён.
+// agentID может быть пустым, если агент не зарегистрирован.
+func (s *Service) WaitForTask(ctx context.Context, agentID string, wait time.Duration) (*models.Task, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		// Канал берём до попытки аренды, чтобы не пропустить задачу,
+		// сохранённую между арендой и началом ожидания
+		ready := s.notifier.Wait()
+
+		task, err := s.leaseFor(agentID)
+		if err != nil || task != nil || wait <= 0 {
+			return task, err
+		}
+
+		select {
+		case <-ready:
+		case <-recheck.C:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// WaitForTasks ждёт первую задачу так же, как WaitForTask, и добавляет к ней
+// до max-1 задач, готовых в тот же момент
+func (s *Service) WaitForTasks(ctx context.Context, agentID string, max int, wait time.Duration) ([]*models.Task, error) {
+	task, err := s.WaitForTask(ctx, agentID, wait)
+	if err != nil || task == nil {
+		return nil, err
+	}
+
+	tasks := []*models.Task{task}
+	for len(tasks) < max {
+		task, err := s.leaseFor(agentID)
+		if err != nil {
+			// Уже арендованные задачи отдаём, иначе они простоят до истечения аренды
+			log.Printf("Failed to lease more tasks for batch: %v", err)
+			break
+		}
+		if task == nil {
+			break
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+// leaseFor арендует следующую задачу и записывает её за агентом agentID
+func (s *Service) leaseFor(agentID string) (*models.Task, error) {
+	task, err := s.GetTaskForProcessing()
+	if task != nil && agentID != "" {
+		s.agents.assign(agentID, task.ID)
+	}
+	return task, err
+}
@@ -0,0 +1,174 @@
+package orchestrator
+
+import (
+	"container/heap"
+	"container/list"
+	"time"
+)
+
+// readyQueue - очередь готовых к выдаче задач в порядке их готовности.
+// Вставка, извлечение и удаление произвольной задачи выполняются за O(1).
+type readyQueue struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newReadyQueue() *readyQueue {
+	return &readyQueue{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (q *readyQueue) Push(taskID string) {
+	if _, exists := q.elements[taskID]; exists {
+		return
+	}
+	q.elements[taskID] = q.order.PushBack(taskID)
+}
+
+// Front возвращает ID задачи, раньше всех ставшей готовой, не удаляя её из очереди
+func (q *readyQueue) Front() (string, bool) {
+	front := q.order.Front()
+	if front == nil {
+		return "", false
+	}
+	return front.Value.(string), true
+}
+
+func (q *readyQueue) Remove(taskID string) {
+	element, exists := q.elements[taskID]
+	if !exists {
+		return
+	}
+	q.order.Remove(element)
+	delete(q.elements, taskID)
+}
+
+func (q *readyQueue) Contains(taskID string) bool {
+	_, exists := q.elements[taskID]
+	return exists
+}
+
+func (q *readyQueue) Len() int {
+	return q.order.Len()
+}
+
+func (q *readyQueue) IDs() []string {
+	ids := make([]string, 0, q.order.Len())
+	for element := q.order.Front(); element != nil; element = element.Next() {
+		ids = append(ids, element.Value.(string))
+	}
+	return ids
+}
+
+type leaseEntry struct {
+	taskID    string
+	expiresAt time.Time
+}
+
+// leaseHeap упорядочивает выданные задачи по сроку окончания аренды,
+// чтобы просроченные можно было вернуть в очередь, не просматривая все задачи
+type leaseHeap []leaseEntry
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h leaseHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *leaseHeap) Push(x interface{}) {
+	*h = append(*h, x.(leaseEntry))
+}
+
+func (h *leaseHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// popExpired извлекает все записи, срок аренды которых истёк к моменту now
+func (h *leaseHeap) popExpired(now time.Time) []leaseEntry {
+	expired := []leaseEntry{}
+	for h.Len() > 0 && !now.Before((*h)[0].expiresAt) {
+		expired = append(expired, heap.Pop(h).(leaseEntry))
+	}
+	return expired
+}
+
+// laneKey - дорожка планировщика: готовые задачи одного клиента с одним приоритетом
+type laneKey struct {
+	priority int
+	clientID string
+}
+
+type laneEntry struct {
+	taskID      string
+	submittedAt time.Time
+	rank        int64
+	seq         uint64
+}
+
+// bySubmission - порядок дорожки клиента: сначала выражения, отправленные раньше,
+// а задачи одного выражения - по порядку готовности
+func bySubmission(a, b laneEntry) bool {
+	if !a.submittedAt.Equal(b.submittedAt) {
+		return a.submittedAt.Before(b.submittedAt)
+	}
+	return a.seq < b.seq
+}
+
+// byRank - порядок критического пути: сначала задачи с самым длинным путём до корня
+func byRank(a, b laneEntry) bool {
+	if a.rank != b.rank {
+		return a.rank > b.rank
+	}
+	return a.seq < b.seq
+}
+
+// laneQueue - куча готовых задач в порядке less. Индекс позиций позволяет
+// удалять произвольную задачу за O(log n).
+type laneQueue struct {
+	entries []laneEntry
+	index   map[string]int
+	less    func(a, b laneEntry) bool
+}
+
+func newLaneQueue(less func(a, b laneEntry) bool) *laneQueue {
+	return &laneQueue{index: make(map[string]int), less: less}
+}
+
+func (q *laneQueue) Len() int { return len(q.entries) }
+
+func (q *laneQueue) Less(i, j int) bool {
+	return q.less(q.entries[i], q.entries[j])
+}
+
+func (q *laneQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.index[q.entries[i].taskID] = i
+	q.index[q.entries[j].taskID] = j
+}
+
+func (q *laneQueue) Push(x interface{}) {
+	entry := x.(laneEntry)
+	q.index[entry.taskID] = len(q.entries)
+	q.entries = append(q.entries, entry)
+}
+
+func (q *laneQueue) Pop() interface{} {
+	entry := q.entries[len(q.entries)-1]
+	q.entries = q.entries[:len(q.entries)-1]
+	delete(q.index, entry.taskID)
+	return entry
+}
+
+// Head возвращает ID первой задачи; очередь не должна быть пустой
+func (q *laneQueue) Head() string {
+	return q.entries[0].taskID
+}
+
+func (q *laneQueue) Remove(taskID string) {
+	if i, exists := q.index[taskID]; exists {
+		heap.Remove(q, i)
+	}
+}
@@ -0,0 +1,76 @@
+package orchestrator
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const deadlineExceededMessage = "deadline exceeded"
+
+// ExpireDeadlines переводит в TIMEOUT выражения, срок которых истёк, и отменяет
+// их задачи: агенты их больше не получат, а запоздавшие результаты будут отклонены.
+// Возвращает число просроченных выражений.
+func (s *Service) ExpireDeadlines() (int, error) {
+	expired, err := s.repo.GetExpiredExpressions(s.now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired expressions: %w", err)
+	}
+
+	count := 0
+	for _, candidate := range expired {
+		// Выражение могло досчитаться или быть отменено после выборки просроченных
+		expression, err := s.repo.TransitionExpression(candidate.ID, models.StatusProcessing, models.StatusTimeout, deadlineExceededMessage)
+		if errors.Is(err, ErrExpressionStatusChanged) {
+			continue
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to update expression: %w", err)
+		}
+		count++
+
+		if err := s.repo.CancelTasks(expression.ID); err != nil {
+			return count, fmt.Errorf("failed to cancel tasks: %w", err)
+		}
+
+		log.Printf("Expression %s exceeded its deadline %s", expression.ID, expression.Deadline.Format(time.RFC3339Nano))
+		s.publish(expression.ID)
+		s.deliverResult(expression)
+	}
+
+	return count, nil
+}
+
+// idempotencyCleanupInterval - как часто удаляются истёкшие ключи идемпотентности.
+// Истёкший ключ и так не мешает повторному использованию, поэтому спешить некуда.
+const idempotencyCleanupInterval = time.Minute
+
+// RunReaper каждые interval проверяет сроки выражений и heartbeat агентов,
+// а раз в минуту удаляет истёкшие ключи идемпотентности, пока не отменён ctx
+func (s *Service) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(idempotencyCleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.ExpireDeadlines(); err != nil {
+				log.Printf("Failed to expire deadlines: %v", err)
+			}
+			if _, err := s.ExpireAgents(); err != nil {
+				log.Printf("Failed to expire agents: %v", err)
+			}
+		case <-cleanup.C:
+			if _, err := s.ExpireIdempotencyKeys(); err != nil {
+				log.Printf("Failed to expire idempotency keys: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"fmt"
+	"log"
+)
+
+// RecoveryReport описывает, что было исправлено при запуске оркестратора
+type RecoveryReport struct {
+	ReleasedLeases       int
+	RebuiltTasks         int
+	FinalizedExpressions int
+	FailedExpressions    int
+	// ResumedWebhooks - сколько недоставленных итогов выражений снова отправляется на callback_url
+	ResumedWebhooks int
+}
+
+const interruptedMessage = "expression was interrupted by orchestrator restart"
+
+// Recover согласует сохранённое состояние после перезапуска оркестратора.
+// Должен вызываться до того, как оркестратор начнёт принимать запросы:
+//   - задачи, выданные агентам до перезапуска, снова становятся готовыми;
+//   - счётчики зависимостей пересчитываются, чтобы задачи с уже посчитанными
+//     аргументами попали в очередь и получили результаты своих зависимостей;
+//   - выражения, корневая задача которых уже посчитана, завершаются;
+//   - выражения, задачи которых не успели сохраниться, переводятся в ошибку;
+//   - недоставленные итоги выражений снова отправляются на их callback_url.
+func (s *Service) Recover() (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+
+	released, err := s.repo.ReleaseLeases()
+	if err != nil {
+		return nil, fmt.Errorf("failed to release leases: %w", err)
+	}
+	report.ReleasedLeases = released
+
+	rebuilt, err := s.repo.RebuildDependencies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild dependencies: %w", err)
+	}
+	report.RebuiltTasks = rebuilt
+
+	expressions, err := s.repo.GetAllExpressions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expressions: %w", err)
+	}
+
+	for _, expression := range expressions {
+		if expression.Status == models.StatusProcessing {
+			finalized, err := s.recoverExpression(expression)
+			if err != nil {
+				return nil, fmt.Errorf("failed to recover expression %s: %w", expression.ID, err)
+			}
+
+			switch finalized {
+			case models.StatusCompleted:
+				report.FinalizedExpressions++
+			case models.StatusError:
+				report.FailedExpressions++
+			}
+		}
+
+		// Доставка итога могла прерваться перезапуском или ещё не начаться
+		if s.webhookPending(expression) {
+			s.deliverResult(expression)
+			report.ResumedWebhooks++
+		}
+	}
+
+	log.Printf("Recovery: released %d leases, rebuilt %d tasks, finalized %d expressions, failed %d expressions, resumed %d webhooks",
+		report.ReleasedLeases, report.RebuiltTasks, report.FinalizedExpressions, report.FailedExpressions, report.ResumedWebhooks)
+
+	return report, nil
+}
+
+// recoverExpression возвращает новый статус выражения или пустую строку, если выражение продолжает считаться
+func (s *Service) recoverExpression(expression *models.Expression) (models.ExpressionStatus, error) {
+	if expression.RootTaskID == "" {
+		// Оркестратор упал между сохранением выражения и сохранением его задач
+		return s.failInterrupted(expression)
+	}
+
+	root, err := s.repo.GetTaskByID(expression.RootTaskID)
+	if err != nil {
+		return s.failInterrupted(expression)
+	}
+
+	if !root.Completed || root.Result == nil {
+		return "", nil
+	}
+
+	result := *root.Result
+	expression.Status = models.StatusCompleted
+	expression.Result = &result
+	if err := s.repo.UpdateExpression(expression); err != nil {
+		return "", err
+	}
+
+	log.Printf("Recovery: expression %s completed with result %g", expression.ID, result)
+	return models.StatusCompleted, nil
+}
+
+func (s *Service) failInterrupted(expression *models.Expression) (models.ExpressionStatus, error) {
+	expression.Status = models.StatusError
+	expression.Error = interruptedMessage
+	if err := s.repo.UpdateExpression(expression); err != nil {
+		return "", err
+	}
+	if err := s.repo.CancelTasks(expression.ID); err != nil {
+		return "", err
+	}
+
+	log.Printf("Recovery: expression %s has incomplete task graph, marked as failed", expression.ID)
+	return models.StatusError, nil
+}
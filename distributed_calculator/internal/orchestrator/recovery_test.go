@@ -0,0 +1,94 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRecoverAfterCrash имитирует падение оркестратора посреди вычислений:
+// часть задач выдана агентам, счётчики зависимостей рассогласованы,
+// а одно выражение не успело получить статус после подсчёта корневой задачи.
+func TestRecoverAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calculator.db")
+	repo, _ := newTestSQLiteRepository(t, path)
+	service := NewService(repo, map[models.Operation]int64{}, time.Hour)
+
+	running, err := service.ProcessExpression("(1 + 2) * (3 + 4)")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	finished, err := service.ProcessExpression("5 * 6")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	// Агенты забрали все готовые задачи, но успели вернуть только часть результатов
+	leased := []*models.Task{}
+	for {
+		task, _ := service.GetTaskForProcessing()
+		if task == nil {
+			break
+		}
+		leased = append(leased, task)
+	}
+	if len(leased) != 3 {
+		t.Fatalf("Expected 3 leased tasks, got %d", len(leased))
+	}
+	for _, task := range leased {
+		if task.Operation == models.Multiplication || (task.Args[0] == "1" && task.Args[1] == "2") {
+			if err := service.ProcessTaskResult(task.ID, evaluateTestTask(t, task)); err != nil {
+				t.Fatalf("Failed to process task result: %v", err)
+			}
+		}
+	}
+
+	// Повреждаем состояние так, как его мог оставить незавершённый процесс
+	if _, err := repo.db.Exec(`UPDATE tasks SET pending_deps = 2, ready_seq = NULL WHERE id = ?`, running.RootTaskID); err != nil {
+		t.Fatalf("Failed to corrupt dependency counter: %v", err)
+	}
+	if _, err := repo.db.Exec(`UPDATE expressions SET status = ?, result = NULL WHERE id = ?`, models.StatusProcessing, finished.ID); err != nil {
+		t.Fatalf("Failed to reset expression status: %v", err)
+	}
+	orphan := &models.Expression{ID: "orphan", Expression: "1 + 1", Status: models.StatusProcessing}
+	if err := repo.SaveExpression(orphan); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+	repo.Close()
+
+	reopened, _ := newTestSQLiteRepository(t, path)
+	service = NewService(reopened, map[models.Operation]int64{}, time.Hour)
+
+	report, err := service.Recover()
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	expected := RecoveryReport{ReleasedLeases: 1, RebuiltTasks: 1, FinalizedExpressions: 1, FailedExpressions: 1}
+	if *report != expected {
+		t.Errorf("Expected report %+v, got %+v", expected, *report)
+	}
+
+	stored, _ := service.GetExpressionByID(finished.ID)
+	if stored.Status != models.StatusCompleted || stored.Result == nil || *stored.Result != 30 {
+		t.Errorf("Expected finished expression to complete with 30, got %+v", stored)
+	}
+	stored, _ = service.GetExpressionByID(orphan.ID)
+	if stored.Status != models.StatusError || stored.Error == "" {
+		t.Errorf("Expected expression without tasks to fail, got %+v", stored)
+	}
+
+	// Аренды сняты сразу: задачи не ждут истечения часового таймаута
+	runAgents(t, service, 2)
+
+	stored, _ = service.GetExpressionByID(running.ID)
+	if stored.Status != models.StatusCompleted || stored.Result == nil || *stored.Result != 21 {
+		t.Errorf("Expected interrupted expression to complete with 21, got %+v", stored)
+	}
+
+	// Повторный запуск восстановления ничего не меняет
+	report, err = service.Recover()
+	if err != nil || *report != (RecoveryReport{}) {
+		t.Errorf("Expected second recovery to be a no-op, got %+v (%v)", report, err)
+	}
+}
@@ -1,43 +1,136 @@
 package orchestrator
 
 import (
+	"container/heap"
 	"distributed-calculator/internal/models"
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
 )
 
+var ErrTaskNotAvailable = errors.New("task is not available for leasing")
+
+// ErrTaskNotFound возвращается на неизвестный ID задачи
+var ErrTaskNotFound = errors.New("task not found")
+
+// ErrExpressionStatusChanged возвращается TransitionExpression, если статус выражения
+// успел измениться, например корневая задача посчитана одновременно с отменой
+var ErrExpressionStatusChanged = errors.New("expression status has changed")
+
+// ErrBatchNotFound возвращается GetBatchByID на неизвестный пакет
+var ErrBatchNotFound = errors.New("batch not found")
+
 type Repository interface {
 	SaveExpression(expression *models.Expression) error
+	// UpdateExpression не меняет Deliveries: попытки доставки добавляются только через RecordDelivery
 	UpdateExpression(expression *models.Expression) error
+	// TransitionExpression атомарно переводит выражение из статуса from в to с ошибкой
+	// message и возвращает его. ErrExpressionStatusChanged, если статус уже не from.
+	TransitionExpression(id string, from, to models.ExpressionStatus, message string) (*models.Expression, error)
 	GetExpressionByID(id string) (*models.Expression, error)
 	GetAllExpressions() ([]*models.Expression, error)
+	// GetExpiredExpressions возвращает выражения в PROCESSING, срок которых наступил к now
+	GetExpiredExpressions(now time.Time) ([]*models.Expression, error)
+	// RecordDelivery добавляет попытку доставки итога в конец Deliveries выражения
+	RecordDelivery(expressionID string, delivery models.WebhookDelivery) error
+	SaveBatch(batch *models.Batch) error
+	GetBatchByID(id string) (*models.Batch, error)
+	// GetBatchExpressions возвращает принятые выражения пакета в произвольном порядке
+	GetBatchExpressions(batchID string) ([]*models.Expression, error)
+	// ReserveIdempotencyKey сохраняет ключ, если у клиента key.ClientID такого ключа нет
+	// или он истёк к key.CreatedAt, и возвращает nil. Иначе возвращает уже сохранённый ключ.
+	ReserveIdempotencyKey(key *models.IdempotencyKey) (*models.IdempotencyKey, error)
+	DeleteIdempotencyKey(clientID, key string) error
+	// DeleteExpiredIdempotencyKeys удаляет ключи, истёкшие к now, и возвращает их число
+	DeleteExpiredIdempotencyKeys(now time.Time) (int, error)
 	SaveTask(task *models.Task) error
 	UpdateTask(task *models.Task) error
 	GetTaskByID(id string) (*models.Task, error)
 	GetReadyTasks() ([]*models.Task, error)
+	// CountTasks возвращает число посчитанных задач выражения и число всех его задач
+	CountTasks(expressionID string) (completed int, total int, err error)
+	// GetReadyHeads возвращает по одной готовой задаче на каждую пару (приоритет, клиент):
+	// задачу самого раннего выражения, а в нём - раньше всех ставшую готовой
+	GetReadyHeads() ([]*models.Task, error)
+	// Аренда задачи длится её OperationTime плюс timeout
+	LeaseTask(id string, timeout time.Duration) (*models.Task, error)
+	LeaseNextTask(timeout time.Duration) (*models.Task, error)
+	// LeaseCriticalTask арендует готовую задачу с наибольшим рангом (Task.Rank)
+	LeaseCriticalTask(timeout time.Duration) (*models.Task, error)
+	// RenewLease продлевает ещё не истёкшую аренду задачи до now + timeout.
+	// Аренда никогда не сокращается; ErrTaskNotAvailable, если задача не арендована.
+	RenewLease(id string, timeout time.Duration) error
+	// ReleaseTask досрочно снимает аренду задачи, возвращая её в очередь готовых.
+	// ErrTaskNotAvailable, если задача не арендована.
+	ReleaseTask(id string) error
+	// CompleteTask атомарно сохраняет результат задачи и продвигает зависящие от неё задачи.
+	// Если это корневая задача выражения в PROCESSING, выражение завершается и возвращается,
+	// иначе возвращается nil. ErrTaskNotAvailable, если задача уже посчитана или отменена.
+	CompleteTask(id string, result float64) (*models.Expression, error)
+	// FailTask атомарно записывает ошибку задачи и отменяет её, чтобы её больше не выдавали.
+	// ErrTaskNotAvailable, если задача уже посчитана или отменена.
+	FailTask(id string, message string) error
+	CancelTasks(expressionID string) error
+	// ReleaseLeases возвращает в очередь все выданные, но не посчитанные задачи
+	ReleaseLeases() (int, error)
+	// RebuildDependencies пересчитывает счётчики зависимостей по фактическому
+	// состоянию задач и возвращает число исправленных задач
+	RebuildDependencies() (int, error)
 }
 
+// InMemoryRepository хранит копии выражений и задач и поддерживает индекс готовых задач:
+// у каждой задачи есть счётчик непосчитанных зависимостей, и задача попадает
+// в очередь readyTasks, когда он обнуляется. Поэтому выдача задачи не требует
+// просмотра всех когда-либо сохранённых задач.
+// Если нужны обе блокировки, taskMutex берётся раньше expressionMutex.
 type InMemoryRepository struct {
 	expressions     map[string]*models.Expression
+	batches         map[string]*models.Batch
+	idempotencyKeys map[idempotencyScope]*models.IdempotencyKey
 	tasks           map[string]*models.Task
-	tasksByExprID   map[string][]*models.Task
+	tasksByExprID   map[string][]string
+	pendingDeps     map[string]int
+	dependents      map[string][]string
+	readyTasks      *readyQueue
+	lanes           map[laneKey]*laneQueue
+	critical        *laneQueue
+	readyOrder      map[string]uint64
+	readySeq        uint64
+	leases          leaseHeap
 	expressionMutex sync.RWMutex
 	taskMutex       sync.RWMutex
+	now             func() time.Time
 }
 
 func NewInMemoryRepository() *InMemoryRepository {
 	return &InMemoryRepository{
-		expressions:   make(map[string]*models.Expression),
-		tasks:         make(map[string]*models.Task),
-		tasksByExprID: make(map[string][]*models.Task),
+		expressions:     make(map[string]*models.Expression),
+		batches:         make(map[string]*models.Batch),
+		idempotencyKeys: make(map[idempotencyScope]*models.IdempotencyKey),
+		tasks:           make(map[string]*models.Task),
+		tasksByExprID:   make(map[string][]string),
+		pendingDeps:     make(map[string]int),
+		dependents:      make(map[string][]string),
+		readyTasks:      newReadyQueue(),
+		lanes:           make(map[laneKey]*laneQueue),
+		critical:        newLaneQueue(byRank),
+		readyOrder:      make(map[string]uint64),
+		now:             time.Now,
 	}
 }
 
+// SetClock подменяет источник текущего времени, по которому истекают аренды задач
+func (r *InMemoryRepository) SetClock(now func() time.Time) {
+	r.now = now
+}
+
 func (r *InMemoryRepository) SaveExpression(expression *models.Expression) error {
 	r.expressionMutex.Lock()
 	defer r.expressionMutex.Unlock()
 	
-	r.expressions[expression.ID] = expression
+	r.expressions[expression.ID] = cloneExpression(expression)
 	return nil
 }
 
@@ -45,14 +138,34 @@ func (r *InMemoryRepository) UpdateExpression(expression *models.Expression) err
 	r.expressionMutex.Lock()
 	defer r.expressionMutex.Unlock()
 	
-	if _, exists := r.expressions[expression.ID]; !exists {
+	stored, exists := r.expressions[expression.ID]
+	if !exists {
 		return fmt.Errorf("expression with ID %s not found", expression.ID)
 	}
 	
-	r.expressions[expression.ID] = expression
+	updated := cloneExpression(expression)
+	updated.Deliveries = stored.Deliveries
+	r.expressions[expression.ID] = updated
 	return nil
 }
 
+func (r *InMemoryRepository) TransitionExpression(id string, from, to models.ExpressionStatus, message string) (*models.Expression, error) {
+	r.expressionMutex.Lock()
+	defer r.expressionMutex.Unlock()
+
+	expression, exists := r.expressions[id]
+	if !exists {
+		return nil, fmt.Errorf("expression with ID %s not found", id)
+	}
+	if expression.Status != from {
+		return nil, ErrExpressionStatusChanged
+	}
+
+	expression.Status = to
+	expression.Error = message
+	return cloneExpression(expression), nil
+}
+
 func (r *InMemoryRepository) GetExpressionByID(id string) (*models.Expression, error) {
 	r.expressionMutex.RLock()
 	defer r.expressionMutex.RUnlock()
@@ -62,7 +175,7 @@ func (r *InMemoryRepository) GetExpressionByID(id string) (*models.Expression, e
 		return nil, fmt.Errorf("expression with ID %s not found", id)
 	}
 	
-	return expression, nil
+	return cloneExpression(expression), nil
 }
 
 func (r *InMemoryRepository) GetAllExpressions() ([]*models.Expression, error) {
@@ -71,122 +184,607 @@ func (r *InMemoryRepository) GetAllExpressions() ([]*models.Expression, error) {
 	
 	expressions := make([]*models.Expression, 0, len(r.expressions))
 	for _, expression := range r.expressions {
-		expressions = append(expressions, expression)
+		expressions = append(expressions, cloneExpression(expression))
 	}
 	
 	return expressions, nil
 }
 
+func (r *InMemoryRepository) GetExpiredExpressions(now time.Time) ([]*models.Expression, error) {
+	r.expressionMutex.RLock()
+	defer r.expressionMutex.RUnlock()
+
+	expired := []*models.Expression{}
+	for _, expression := range r.expressions {
+		if expression.Status == models.StatusProcessing && expression.Deadline != nil && !now.Before(*expression.Deadline) {
+			expired = append(expired, cloneExpression(expression))
+		}
+	}
+
+	return expired, nil
+}
+
+func (r *InMemoryRepository) RecordDelivery(expressionID string, delivery models.WebhookDelivery) error {
+	r.expressionMutex.Lock()
+	defer r.expressionMutex.Unlock()
+
+	expression, exists := r.expressions[expressionID]
+	if !exists {
+		return fmt.Errorf("expression with ID %s not found", expressionID)
+	}
+
+	expression.Deliveries = append(expression.Deliveries, delivery)
+	return nil
+}
+
+func (r *InMemoryRepository) SaveBatch(batch *models.Batch) error {
+	r.expressionMutex.Lock()
+	defer r.expressionMutex.Unlock()
+
+	if _, exists := r.batches[batch.ID]; exists {
+		return fmt.Errorf("batch with ID %s already exists", batch.ID)
+	}
+
+	r.batches[batch.ID] = cloneBatch(batch)
+	return nil
+}
+
+func (r *InMemoryRepository) GetBatchByID(id string) (*models.Batch, error) {
+	r.expressionMutex.RLock()
+	defer r.expressionMutex.RUnlock()
+
+	batch, exists := r.batches[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBatchNotFound, id)
+	}
+
+	return cloneBatch(batch), nil
+}
+
+func (r *InMemoryRepository) GetBatchExpressions(batchID string) ([]*models.Expression, error) {
+	r.expressionMutex.RLock()
+	defer r.expressionMutex.RUnlock()
+
+	expressions := []*models.Expression{}
+	batch, exists := r.batches[batchID]
+	if !exists {
+		return expressions, nil
+	}
+
+	for _, item := range batch.Items {
+		if expression, exists := r.expressions[item.ExpressionID]; exists {
+			expressions = append(expressions, cloneExpression(expression))
+		}
+	}
+
+	return expressions, nil
+}
+
+// idempotencyScope - ключ идемпотентности в пространстве ключей одного клиента
+type idempotencyScope struct {
+	clientID string
+	key      string
+}
+
+func (r *InMemoryRepository) ReserveIdempotencyKey(key *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	r.expressionMutex.Lock()
+	defer r.expressionMutex.Unlock()
+
+	scope := idempotencyScope{clientID: key.ClientID, key: key.Key}
+	if existing, exists := r.idempotencyKeys[scope]; exists && key.CreatedAt.Before(existing.ExpiresAt) {
+		reserved := *existing
+		return &reserved, nil
+	}
+
+	reserved := *key
+	r.idempotencyKeys[scope] = &reserved
+	return nil, nil
+}
+
+func (r *InMemoryRepository) DeleteIdempotencyKey(clientID, key string) error {
+	r.expressionMutex.Lock()
+	defer r.expressionMutex.Unlock()
+
+	delete(r.idempotencyKeys, idempotencyScope{clientID: clientID, key: key})
+	return nil
+}
+
+func (r *InMemoryRepository) DeleteExpiredIdempotencyKeys(now time.Time) (int, error) {
+	r.expressionMutex.Lock()
+	defer r.expressionMutex.Unlock()
+
+	deleted := 0
+	for key, reserved := range r.idempotencyKeys {
+		if !now.Before(reserved.ExpiresAt) {
+			delete(r.idempotencyKeys, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
 func (r *InMemoryRepository) SaveTask(task *models.Task) error {
 	r.taskMutex.Lock()
 	defer r.taskMutex.Unlock()
-	
-	r.tasks[task.ID] = task
-	
-	r.tasksByExprID[task.ExpressionID] = append(r.tasksByExprID[task.ExpressionID], task)
-	
+
+	if _, exists := r.tasks[task.ID]; exists {
+		return fmt.Errorf("task with ID %s already exists", task.ID)
+	}
+
+	stored := cloneTask(task)
+	r.tasks[stored.ID] = stored
+	r.tasksByExprID[stored.ExpressionID] = append(r.tasksByExprID[stored.ExpressionID], stored.ID)
+
+	pending := 0
+	for _, depID := range stored.Dependencies {
+		if depTask, exists := r.tasks[depID]; exists && depTask.Completed {
+			continue
+		}
+		pending++
+		r.dependents[depID] = append(r.dependents[depID], stored.ID)
+	}
+	r.pendingDeps[stored.ID] = pending
+
+	if stored.Completed {
+		r.releaseDependents(stored.ID)
+	}
+	r.reindex(stored)
+
 	return nil
 }
 
 func (r *InMemoryRepository) UpdateTask(task *models.Task) error {
 	r.taskMutex.Lock()
 	defer r.taskMutex.Unlock()
-	
-	if _, exists := r.tasks[task.ID]; !exists {
-		return fmt.Errorf("task with ID %s not found", task.ID)
+
+	previous, exists := r.tasks[task.ID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, task.ID)
 	}
-	
-	r.tasks[task.ID] = task
-	
-	r.checkExpressionCompletion(task.ExpressionID)
-	
+
+	// Приоритет, клиент и время отправки определяют дорожку задачи в индексе готовых задач
+	if task.Priority != previous.Priority || task.ClientID != previous.ClientID || !task.SubmittedAt.Equal(previous.SubmittedAt) || task.Rank != previous.Rank {
+		r.unqueue(previous)
+	}
+
+	stored := cloneTask(task)
+	r.tasks[stored.ID] = stored
+
+	if stored.Completed && !previous.Completed {
+		r.releaseDependents(stored.ID)
+		r.completeExpression(stored)
+	}
+	r.reindex(stored)
+
 	return nil
 }
 
 func (r *InMemoryRepository) GetTaskByID(id string) (*models.Task, error) {
 	r.taskMutex.RLock()
 	defer r.taskMutex.RUnlock()
-	
+
 	task, exists := r.tasks[id]
 	if !exists {
-		return nil, fmt.Errorf("task with ID %s not found", id)
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
 	}
-	
-	return task, nil
+
+	return cloneTask(task), nil
 }
 
+// GetReadyTasks возвращает готовые задачи в порядке их готовности
 func (r *InMemoryRepository) GetReadyTasks() ([]*models.Task, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	r.releaseExpiredLeases(r.now())
+
+	readyTasks := make([]*models.Task, 0, r.readyTasks.Len())
+	for _, id := range r.readyTasks.IDs() {
+		readyTasks = append(readyTasks, r.resolveArgs(r.tasks[id]))
+	}
+
+	return readyTasks, nil
+}
+
+// CountTasks возвращает число посчитанных задач выражения и число всех его задач
+func (r *InMemoryRepository) CountTasks(expressionID string) (int, int, error) {
 	r.taskMutex.RLock()
 	defer r.taskMutex.RUnlock()
-	
-	readyTasks := []*models.Task{}
-	
+
+	completed := 0
+	for _, id := range r.tasksByExprID[expressionID] {
+		if r.tasks[id].Completed {
+			completed++
+		}
+	}
+	return completed, len(r.tasksByExprID[expressionID]), nil
+}
+
+func (r *InMemoryRepository) GetReadyHeads() ([]*models.Task, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	r.releaseExpiredLeases(r.now())
+
+	heads := make([]*models.Task, 0, len(r.lanes))
+	for _, lane := range r.lanes {
+		heads = append(heads, r.resolveArgs(r.tasks[lane.Head()]))
+	}
+
+	return heads, nil
+}
+
+func (r *InMemoryRepository) LeaseTask(id string, timeout time.Duration) (*models.Task, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	now := r.now()
+	r.releaseExpiredLeases(now)
+
+	task, exists := r.tasks[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+
+	if !r.readyTasks.Contains(id) {
+		return nil, ErrTaskNotAvailable
+	}
+
+	return r.lease(task, now, timeout), nil
+}
+
+// LeaseNextTask выдаёт задачу, которая раньше всех стала готовой, или nil, если готовых задач нет
+func (r *InMemoryRepository) LeaseNextTask(timeout time.Duration) (*models.Task, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	now := r.now()
+	r.releaseExpiredLeases(now)
+
+	id, exists := r.readyTasks.Front()
+	if !exists {
+		return nil, nil
+	}
+
+	return r.lease(r.tasks[id], now, timeout), nil
+}
+
+func (r *InMemoryRepository) LeaseCriticalTask(timeout time.Duration) (*models.Task, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	now := r.now()
+	r.releaseExpiredLeases(now)
+
+	if r.critical.Len() == 0 {
+		return nil, nil
+	}
+
+	return r.lease(r.tasks[r.critical.Head()], now, timeout), nil
+}
+
+func (r *InMemoryRepository) RenewLease(id string, timeout time.Duration) error {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	now := r.now()
+	task, err := r.leasedTask(id, now)
+	if err != nil {
+		return err
+	}
+
+	leaseExpiresAt := now.Add(timeout)
+	if leaseExpiresAt.After(*task.LeaseExpiresAt) {
+		task.LeaseExpiresAt = &leaseExpiresAt
+		heap.Push(&r.leases, leaseEntry{taskID: task.ID, expiresAt: leaseExpiresAt})
+	}
+
+	return nil
+}
+
+func (r *InMemoryRepository) ReleaseTask(id string) error {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	task, err := r.leasedTask(id, r.now())
+	if err != nil {
+		return err
+	}
+
+	// Запись в куче аренд станет устаревшей и будет пропущена
+	task.LeaseExpiresAt = nil
+	r.reindex(task)
+
+	return nil
+}
+
+// leasedTask возвращает задачу, если её аренда ещё не истекла, и ErrTaskNotAvailable иначе.
+// Вызывается под taskMutex.
+func (r *InMemoryRepository) leasedTask(id string, now time.Time) (*models.Task, error) {
+	r.releaseExpiredLeases(now)
+
+	task, exists := r.tasks[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+
+	if task.Completed || task.Cancelled || !task.Leased(now) {
+		return nil, ErrTaskNotAvailable
+	}
+	return task, nil
+}
+
+// CancelTasks снимает с выполнения все ещё не посчитанные задачи выражения
+func (r *InMemoryRepository) CompleteTask(id string, result float64) (*models.Expression, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	task, exists := r.tasks[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+	if task.Completed || task.Cancelled {
+		return nil, ErrTaskNotAvailable
+	}
+
+	task.Completed = true
+	task.Result = &result
+	task.LeaseExpiresAt = nil
+	r.releaseDependents(task.ID)
+	completed := r.completeExpression(task)
+	r.reindex(task)
+
+	return completed, nil
+}
+
+func (r *InMemoryRepository) FailTask(id string, message string) error {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	task, exists := r.tasks[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+	if task.Completed || task.Cancelled {
+		return ErrTaskNotAvailable
+	}
+
+	task.Error = message
+	task.Cancelled = true
+	task.LeaseExpiresAt = nil
+	r.reindex(task)
+
+	return nil
+}
+
+func (r *InMemoryRepository) CancelTasks(expressionID string) error {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	for _, id := range r.tasksByExprID[expressionID] {
+		task := r.tasks[id]
+		if task.Completed {
+			continue
+		}
+		task.Cancelled = true
+		task.LeaseExpiresAt = nil
+		r.reindex(task)
+	}
+
+	return nil
+}
+
+func (r *InMemoryRepository) ReleaseLeases() (int, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	released := 0
+	for _, task := range r.tasks {
+		if task.Completed || task.Cancelled || task.LeaseExpiresAt == nil {
+			continue
+		}
+		task.LeaseExpiresAt = nil
+		r.reindex(task)
+		released++
+	}
+
+	r.leases = nil
+
+	return released, nil
+}
+
+func (r *InMemoryRepository) RebuildDependencies() (int, error) {
+	r.taskMutex.Lock()
+	defer r.taskMutex.Unlock()
+
+	fixed := 0
+	r.dependents = make(map[string][]string)
 	for _, task := range r.tasks {
 		if task.Completed {
+			delete(r.pendingDeps, task.ID)
 			continue
 		}
 
-		allDependenciesCompleted := true
+		pending := 0
 		for _, depID := range task.Dependencies {
-			depTask, exists := r.tasks[depID]
-			if !exists || !depTask.Completed {
-				allDependenciesCompleted = false
-				break
+			if depTask, exists := r.tasks[depID]; exists && depTask.Completed {
+				continue
 			}
+			pending++
+			r.dependents[depID] = append(r.dependents[depID], task.ID)
 		}
-		
-		if allDependenciesCompleted {
-			taskCopy := *task
-			
-			// Если аргумент - это ID задачи, заменяем его на результат
-			if taskArg1, exists := r.tasks[task.Arg1]; exists && taskArg1.Completed && taskArg1.Result != nil {
-				taskCopy.Arg1 = fmt.Sprintf("%f", *taskArg1.Result)
-			}
-			
-			if taskArg2, exists := r.tasks[task.Arg2]; exists && taskArg2.Completed && taskArg2.Result != nil {
-				taskCopy.Arg2 = fmt.Sprintf("%f", *taskArg2.Result)
-			}
-			
-			readyTasks = append(readyTasks, &taskCopy)
+
+		if r.pendingDeps[task.ID] != pending {
+			r.pendingDeps[task.ID] = pending
+			fixed++
 		}
+		r.reindex(task)
 	}
-	
-	return readyTasks, nil
+
+	return fixed, nil
 }
 
+func (r *InMemoryRepository) lease(task *models.Task, now time.Time, timeout time.Duration) *models.Task {
+	r.unqueue(task)
 
-func (r *InMemoryRepository) checkExpressionCompletion(expressionID string) {
-	tasks, exists := r.tasksByExprID[expressionID]
+	leaseExpiresAt := now.Add(time.Duration(task.OperationTime)*time.Millisecond + timeout)
+	task.LeaseExpiresAt = &leaseExpiresAt
+	task.Attempts++
+	heap.Push(&r.leases, leaseEntry{taskID: task.ID, expiresAt: leaseExpiresAt})
+
+	return r.resolveArgs(task)
+}
+
+// reindex приводит положение задачи в очереди готовых задач и куче аренд
+// в соответствие с её состоянием
+func (r *InMemoryRepository) reindex(task *models.Task) {
+	now := r.now()
+
+	switch {
+	case task.Completed || task.Cancelled:
+		r.unqueue(task)
+		delete(r.readyOrder, task.ID)
+	case r.pendingDeps[task.ID] > 0:
+		r.unqueue(task)
+	case task.Leased(now):
+		r.unqueue(task)
+		heap.Push(&r.leases, leaseEntry{taskID: task.ID, expiresAt: *task.LeaseExpiresAt})
+	default:
+		r.enqueue(task)
+	}
+}
+
+// enqueue ставит задачу в общую очередь готовых задач и в дорожку её клиента
+func (r *InMemoryRepository) enqueue(task *models.Task) {
+	if r.readyTasks.Contains(task.ID) {
+		return
+	}
+	r.readyTasks.Push(task.ID)
+
+	key := laneKey{priority: task.Priority, clientID: task.ClientID}
+	lane, exists := r.lanes[key]
 	if !exists {
+		lane = newLaneQueue(bySubmission)
+		r.lanes[key] = lane
+	}
+	// Задача с истёкшей арендой сохраняет своё место среди задач выражения
+	seq, exists := r.readyOrder[task.ID]
+	if !exists {
+		r.readySeq++
+		seq = r.readySeq
+		r.readyOrder[task.ID] = seq
+	}
+	entry := laneEntry{taskID: task.ID, submittedAt: task.SubmittedAt, rank: task.Rank, seq: seq}
+	heap.Push(lane, entry)
+	heap.Push(r.critical, entry)
+}
+
+func (r *InMemoryRepository) unqueue(task *models.Task) {
+	if !r.readyTasks.Contains(task.ID) {
 		return
 	}
-	
-	var lastTask *models.Task
-	for _, task := range tasks {
-		isReferenced := false
-		for _, otherTask := range tasks {
-			for _, depID := range otherTask.Dependencies {
-				if depID == task.ID {
-					isReferenced = true
-					break
-				}
-			}
-			if isReferenced {
-				break
-			}
+	r.readyTasks.Remove(task.ID)
+	r.critical.Remove(task.ID)
+
+	key := laneKey{priority: task.Priority, clientID: task.ClientID}
+	if lane, exists := r.lanes[key]; exists {
+		lane.Remove(task.ID)
+		if lane.Len() == 0 {
+			delete(r.lanes, key)
 		}
-		
-		if !isReferenced {
-			lastTask = task
-			break
+	}
+}
+
+// releaseDependents уменьшает счётчики зависимостей у задач, ожидавших посчитанную задачу
+func (r *InMemoryRepository) releaseDependents(id string) {
+	for _, dependentID := range r.dependents[id] {
+		r.pendingDeps[dependentID]--
+		r.reindex(r.tasks[dependentID])
+	}
+	delete(r.dependents, id)
+}
+
+// releaseExpiredLeases возвращает в очередь задачи, аренда которых истекла.
+// Записи кучи для уже посчитанных или повторно выданных задач просто отбрасываются.
+func (r *InMemoryRepository) releaseExpiredLeases(now time.Time) {
+	for _, entry := range r.leases.popExpired(now) {
+		task, exists := r.tasks[entry.taskID]
+		if !exists || task.LeaseExpiresAt == nil || !task.LeaseExpiresAt.Equal(entry.expiresAt) {
+			continue
 		}
+		r.reindex(task)
 	}
-	
-	if lastTask != nil && lastTask.Completed && lastTask.Result != nil {
-		expression, exists := r.expressions[expressionID]
-		if exists {
-			expression.Status = models.StatusCompleted
-			expression.Result = lastTask.Result
+}
+
+func (r *InMemoryRepository) resolveArgs(task *models.Task) *models.Task {
+	taskCopy := cloneTask(task)
+
+	// Если аргумент - это ID задачи, заменяем его на результат
+	for i, arg := range task.Args {
+		if argTask, exists := r.tasks[arg]; exists && argTask.Completed && argTask.Result != nil {
+			taskCopy.Args[i] = strconv.FormatFloat(*argTask.Result, 'g', -1, 64)
 		}
 	}
-}
\ No newline at end of file
+
+	return taskCopy
+}
+
+// completeExpression завершает выражение, если посчитана его корневая задача, и возвращает
+// его; nil, если выражение не завершилось. Вызывается под taskMutex; expressionMutex
+// всегда берётся после taskMutex.
+func (r *InMemoryRepository) completeExpression(task *models.Task) *models.Expression {
+	if task.Result == nil {
+		return nil
+	}
+
+	r.expressionMutex.Lock()
+	defer r.expressionMutex.Unlock()
+
+	expression, exists := r.expressions[task.ExpressionID]
+	if !exists || expression.RootTaskID != task.ID || expression.Status != models.StatusProcessing {
+		return nil
+	}
+
+	result := *task.Result
+	expression.Status = models.StatusCompleted
+	expression.Result = &result
+	return cloneExpression(expression)
+}
+
+func cloneTask(task *models.Task) *models.Task {
+	clone := *task
+	clone.Args = append([]string(nil), task.Args...)
+	clone.Dependencies = append([]string(nil), task.Dependencies...)
+	if task.Result != nil {
+		result := *task.Result
+		clone.Result = &result
+	}
+	if task.LeaseExpiresAt != nil {
+		leaseExpiresAt := *task.LeaseExpiresAt
+		clone.LeaseExpiresAt = &leaseExpiresAt
+	}
+	return &clone
+}
+
+func cloneExpression(expression *models.Expression) *models.Expression {
+	clone := *expression
+	if expression.Result != nil {
+		result := *expression.Result
+		clone.Result = &result
+	}
+	if expression.Deadline != nil {
+		deadline := *expression.Deadline
+		clone.Deadline = &deadline
+	}
+	if expression.Deliveries != nil {
+		clone.Deliveries = append([]models.WebhookDelivery(nil), expression.Deliveries...)
+	}
+	return &clone
+}
+
+func cloneBatch(batch *models.Batch) *models.Batch {
+	clone := *batch
+	clone.Items = append(make([]models.BatchItem, 0, len(batch.Items)), batch.Items...)
+	return &clone
+}
@@ -0,0 +1,29 @@
+package orchestrator_test
+
+import (
+	"distributed-calculator/internal/orchestrator"
+	"distributed-calculator/internal/orchestrator/repotest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInMemoryRepositoryConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, now func() time.Time) orchestrator.Repository {
+		repo := orchestrator.NewInMemoryRepository()
+		repo.SetClock(now)
+		return repo
+	})
+}
+
+func TestSQLiteRepositoryConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, now func() time.Time) orchestrator.Repository {
+		repo, err := orchestrator.NewSQLiteRepository(filepath.Join(t.TempDir(), "calculator.db"))
+		if err != nil {
+			t.Fatalf("Failed to open SQLite repository: %v", err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		repo.SetClock(now)
+		return repo
+	})
+}
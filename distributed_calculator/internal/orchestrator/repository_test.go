@@ -0,0 +1,319 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestRepository() (*InMemoryRepository, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	repo := NewInMemoryRepository()
+	repo.now = clock.Now
+	return repo, clock
+}
+
+func TestLeaseTaskHidesTaskFromOtherAgents(t *testing.T) {
+	repo, _ := newTestRepository()
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"2", "3"}, Operation: models.Addition})
+
+	task, err := repo.LeaseTask("t1", time.Second)
+	if err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	if task.LeaseExpiresAt == nil || task.Attempts != 1 {
+		t.Errorf("Lease state is not set on leased task: %+v", task)
+	}
+
+	readyTasks, _ := repo.GetReadyTasks()
+	if len(readyTasks) != 0 {
+		t.Errorf("Expected leased task to be hidden, got %d ready tasks", len(readyTasks))
+	}
+
+	if _, err := repo.LeaseTask("t1", time.Second); !errors.Is(err, ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for second lease, got %v", err)
+	}
+}
+
+func TestExpiredLeaseReturnsTaskToReadyPool(t *testing.T) {
+	repo, clock := newTestRepository()
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"2", "3"}, Operation: models.Addition})
+
+	if _, err := repo.LeaseTask("t1", time.Second); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+
+	clock.Advance(999 * time.Millisecond)
+	readyTasks, _ := repo.GetReadyTasks()
+	if len(readyTasks) != 0 {
+		t.Errorf("Expected task to stay leased before deadline, got %d ready tasks", len(readyTasks))
+	}
+
+	clock.Advance(time.Millisecond)
+	readyTasks, _ = repo.GetReadyTasks()
+	if len(readyTasks) != 1 || readyTasks[0].ID != "t1" {
+		t.Fatalf("Expected task to return to ready pool after lease expiry, got %v", readyTasks)
+	}
+
+	task, err := repo.LeaseTask("t1", time.Second)
+	if err != nil {
+		t.Fatalf("Failed to re-lease task: %v", err)
+	}
+	if task.Attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", task.Attempts)
+	}
+}
+
+func TestLeaseTaskRequiresCompletedDependencies(t *testing.T) {
+	repo, _ := newTestRepository()
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"2", "3"}, Operation: models.Multiplication})
+	_ = repo.SaveTask(&models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"1", "t1"}, Operation: models.Addition, Dependencies: []string{"t1"}})
+
+	if _, err := repo.LeaseTask("t2", time.Second); !errors.Is(err, ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for task with pending dependency, got %v", err)
+	}
+	if _, err := repo.LeaseTask("unknown", time.Second); err == nil || errors.Is(err, ErrTaskNotAvailable) {
+		t.Errorf("Expected not found error for unknown task, got %v", err)
+	}
+}
+
+func TestServiceHandsOutEachTaskOnce(t *testing.T) {
+	repo, clock := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{models.Addition: 1000, models.Multiplication: 1000}, time.Second)
+
+	if _, err := service.ProcessExpression("2 * 3 + 4 * 5"); err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	first, _ := service.GetTaskForProcessing()
+	second, _ := service.GetTaskForProcessing()
+	third, _ := service.GetTaskForProcessing()
+	if first == nil || second == nil {
+		t.Fatalf("Expected two independent tasks to be handed out")
+	}
+	if first.ID == second.ID {
+		t.Errorf("The same task %s was handed out twice", first.ID)
+	}
+	if third != nil {
+		t.Errorf("Expected no more ready tasks, got %+v", third)
+	}
+
+	// Первый агент вернул результат, второй "упал"
+	if err := service.ProcessTaskResult(first.ID, 1); err != nil {
+		t.Fatalf("Failed to process task result: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+
+	reassigned, _ := service.GetTaskForProcessing()
+	if reassigned == nil || reassigned.ID != second.ID {
+		t.Fatalf("Expected task %s to be reassigned after lease expiry, got %+v", second.ID, reassigned)
+	}
+
+	// Запоздавший результат от первого агента не должен ломать задачу
+	if err := service.ProcessTaskResult(second.ID, 6); err != nil {
+		t.Fatalf("Failed to process task result: %v", err)
+	}
+	if err := service.ProcessTaskResult(second.ID, 7); err != nil {
+		t.Errorf("Duplicate result should be ignored, got %v", err)
+	}
+	task, _ := repo.GetTaskByID(second.ID)
+	if task.Result == nil || *task.Result != 6 || task.LeaseExpiresAt != nil {
+		t.Errorf("Unexpected task state after duplicate result: %+v", task)
+	}
+}
+
+func TestReadyQueueFollowsDependencyCounters(t *testing.T) {
+	repo, _ := newTestRepository()
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	_ = repo.SaveTask(&models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+	_ = repo.SaveTask(&models.Task{ID: "t3", ExpressionID: "e1", Args: []string{"t1", "t2"}, Operation: models.Multiplication, Dependencies: []string{"t1", "t2"}})
+
+	readyTasks, _ := repo.GetReadyTasks()
+	if len(readyTasks) != 2 || readyTasks[0].ID != "t1" || readyTasks[1].ID != "t2" {
+		t.Fatalf("Expected t1 and t2 to be ready in order, got %v", readyTasks)
+	}
+
+	completeTask(t, repo, "t1", 3)
+	if task, _ := repo.LeaseNextTask(time.Second); task == nil || task.ID != "t2" {
+		t.Fatalf("Expected t2 to be handed out next, got %+v", task)
+	}
+	if task, _ := repo.LeaseNextTask(time.Second); task != nil {
+		t.Fatalf("Expected t3 to wait for t2, got %+v", task)
+	}
+
+	completeTask(t, repo, "t2", 7.5)
+	task, err := repo.LeaseNextTask(time.Second)
+	if err != nil || task == nil || task.ID != "t3" {
+		t.Fatalf("Expected t3 to become ready, got %+v (%v)", task, err)
+	}
+	if task.Args[0] != "3" || task.Args[1] != "7.5" {
+		t.Errorf("Expected resolved arguments [3 7.5], got %v", task.Args)
+	}
+}
+
+func TestReadyQueueAcceptsDependentsSavedFirst(t *testing.T) {
+	repo, _ := newTestRepository()
+	_ = repo.SaveTask(&models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"t1", "1"}, Operation: models.Addition, Dependencies: []string{"t1"}})
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "1"}, Operation: models.Addition})
+
+	if task, _ := repo.LeaseNextTask(time.Second); task == nil || task.ID != "t1" {
+		t.Fatalf("Expected t1 to be handed out first, got %+v", task)
+	}
+	completeTask(t, repo, "t1", 2)
+	if task, _ := repo.LeaseNextTask(time.Second); task == nil || task.ID != "t2" {
+		t.Fatalf("Expected t2 to become ready, got %+v", task)
+	}
+}
+
+func TestCancelledTasksLeaveReadyQueue(t *testing.T) {
+	repo, clock := newTestRepository()
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	_ = repo.SaveTask(&models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+
+	if _, err := repo.LeaseNextTask(time.Second); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	_ = repo.CancelTasks("e1")
+	clock.Advance(time.Minute)
+
+	if task, _ := repo.LeaseNextTask(time.Second); task != nil {
+		t.Errorf("Expected no ready tasks after cancellation, got %+v", task)
+	}
+}
+
+func completeTask(t *testing.T, repo Repository, id string, result float64) {
+	t.Helper()
+	task, err := repo.GetTaskByID(id)
+	if err != nil {
+		t.Fatalf("Failed to get task %s: %v", id, err)
+	}
+	task.Completed = true
+	task.Result = &result
+	task.LeaseExpiresAt = nil
+	if err := repo.UpdateTask(task); err != nil {
+		t.Fatalf("Failed to update task %s: %v", id, err)
+	}
+}
+
+// BenchmarkHandOutTask сравнивает выдачу задачи через индекс готовых задач
+// с прежним полным просмотром всех задач при разном объёме истории
+func BenchmarkHandOutTask(b *testing.B) {
+	for _, history := range []int{100, 10000, 100000} {
+		b.Run(fmt.Sprintf("indexed/history=%d", history), func(b *testing.B) {
+			repo := newBenchmarkRepository(history)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = repo.SaveTask(&models.Task{ID: fmt.Sprintf("new-%d", i), ExpressionID: "bench", Args: []string{"1", "2"}, Operation: models.Addition})
+				if task, _ := repo.LeaseNextTask(time.Second); task == nil {
+					b.Fatal("no task handed out")
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("fair/history=%d", history), func(b *testing.B) {
+			repo := newBenchmarkRepository(history)
+			scheduler := NewFairScheduler()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = repo.SaveTask(&models.Task{ID: fmt.Sprintf("new-%d", i), ExpressionID: "bench", Args: []string{"1", "2"}, Operation: models.Addition, ClientID: fmt.Sprintf("client-%d", i%8)})
+				if task, _ := scheduler.Next(repo, time.Second); task == nil {
+					b.Fatal("no task handed out")
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("scan/history=%d", history), func(b *testing.B) {
+			repo := newBenchmarkRepository(history)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = repo.SaveTask(&models.Task{ID: fmt.Sprintf("new-%d", i), ExpressionID: "bench", Args: []string{"1", "2"}, Operation: models.Addition})
+				task := scanReadyTask(repo)
+				if task == nil {
+					b.Fatal("no task handed out")
+				}
+				if _, err := repo.LeaseTask(task.ID, time.Second); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIdlePoll(b *testing.B) {
+	for _, history := range []int{100, 10000, 100000} {
+		b.Run(fmt.Sprintf("indexed/history=%d", history), func(b *testing.B) {
+			repo := newBenchmarkRepository(history)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = repo.LeaseNextTask(time.Second)
+			}
+		})
+
+		b.Run(fmt.Sprintf("scan/history=%d", history), func(b *testing.B) {
+			repo := newBenchmarkRepository(history)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = scanReadyTask(repo)
+			}
+		})
+	}
+}
+
+// newBenchmarkRepository создаёт хранилище с history уже посчитанными задачами,
+// попарно связанными зависимостями, как в реальных выражениях
+func newBenchmarkRepository(history int) *InMemoryRepository {
+	repo := NewInMemoryRepository()
+	result := 1.0
+	for i := 0; i < history; i++ {
+		task := &models.Task{ID: fmt.Sprintf("old-%d", i), ExpressionID: fmt.Sprintf("e%d", i/2), Args: []string{"1", "1"}, Operation: models.Addition, Completed: true, Result: &result}
+		if i%2 == 1 {
+			task.Dependencies = []string{fmt.Sprintf("old-%d", i-1)}
+		}
+		_ = repo.SaveTask(task)
+	}
+	return repo
+}
+
+// scanReadyTask повторяет прежний алгоритм GetReadyTasks: просмотр всех задач
+// с проверкой зависимостей и копированием готовых
+func scanReadyTask(r *InMemoryRepository) *models.Task {
+	r.taskMutex.RLock()
+	defer r.taskMutex.RUnlock()
+
+	now := r.now()
+	readyTasks := []*models.Task{}
+	for _, task := range r.tasks {
+		if task.Completed || task.Cancelled || task.Leased(now) {
+			continue
+		}
+		ready := true
+		for _, depID := range task.Dependencies {
+			if depTask, exists := r.tasks[depID]; !exists || !depTask.Completed {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			readyTasks = append(readyTasks, r.resolveArgs(task))
+		}
+	}
+
+	if len(readyTasks) == 0 {
+		return nil
+	}
+	return readyTasks[0]
+}
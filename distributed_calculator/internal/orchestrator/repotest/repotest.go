@@ -0,0 +1,1062 @@
+// Package repotest содержит общий набор тестов для реализаций orchestrator.Repository.
+// Новое хранилище проверяется вызовом repotest.Run из его тестов.
+package repotest
+
+import (
+	"distributed-calculator/internal/models"
+	"distributed-calculator/internal/orchestrator"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory создаёт пустое хранилище, которое берёт текущее время из now.
+// Хранилище должно быть освобождено через t.Cleanup.
+type Factory func(t *testing.T, now func() time.Time) orchestrator.Repository
+
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func setup(t *testing.T, factory Factory) (orchestrator.Repository, *clock) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return factory(t, c.Now), c
+}
+
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, factory Factory)
+	}{
+		{"Expressions", testExpressions},
+		{"ExpressionNotFound", testExpressionNotFound},
+		{"ExpiredExpressions", testExpiredExpressions},
+		{"TransitionExpression", testTransitionExpression},
+		{"RecordDelivery", testRecordDelivery},
+		{"Batches", testBatches},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"Tasks", testTasks},
+		{"TaskNotFound", testTaskNotFound},
+		{"CountTasks", testCountTasks},
+		{"ReadyTasksResolveDependencies", testReadyTasksResolveDependencies},
+		{"ReadyHeads", testReadyHeads},
+		{"LeaseTask", testLeaseTask},
+		{"LeaseExpiry", testLeaseExpiry},
+		{"LeaseCriticalTask", testLeaseCriticalTask},
+		{"RenewLease", testRenewLease},
+		{"ReleaseTask", testReleaseTask},
+		{"CompleteTask", testCompleteTask},
+		{"FailTask", testFailTask},
+		{"CancelTasks", testCancelTasks},
+		{"ReleaseLeases", testReleaseLeases},
+		{"RebuildDependencies", testRebuildDependencies},
+		{"CompletionDetection", testCompletionDetection},
+		{"ConcurrentAccess", testConcurrentAccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, factory)
+		})
+	}
+}
+
+func testExpressions(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	for _, id := range []string{"e1", "e2"} {
+		if err := repo.SaveExpression(&models.Expression{ID: id, Expression: "1 + 1", Status: models.StatusProcessing}); err != nil {
+			t.Fatalf("Failed to save expression %s: %v", id, err)
+		}
+	}
+
+	result := 2.0
+	updated := &models.Expression{ID: "e1", Expression: "1 + 1", Status: models.StatusCompleted, Result: &result, RootTaskID: "t1"}
+	if err := repo.UpdateExpression(updated); err != nil {
+		t.Fatalf("Failed to update expression: %v", err)
+	}
+
+	// Хранилище не должно разделять память с переданными и возвращёнными значениями
+	result = 100
+	updated.Status = models.StatusError
+
+	expression, err := repo.GetExpressionByID("e1")
+	if err != nil {
+		t.Fatalf("Failed to get expression: %v", err)
+	}
+	if expression.Status != models.StatusCompleted || expression.Result == nil || *expression.Result != 2 || expression.RootTaskID != "t1" {
+		t.Errorf("Unexpected expression: %+v", expression)
+	}
+
+	expression.Status = models.StatusError
+	if again, _ := repo.GetExpressionByID("e1"); again.Status != models.StatusCompleted {
+		t.Errorf("Mutating a returned expression changed stored state: %+v", again)
+	}
+
+	expressions, err := repo.GetAllExpressions()
+	if err != nil {
+		t.Fatalf("Failed to list expressions: %v", err)
+	}
+	if len(expressions) != 2 {
+		t.Errorf("Expected 2 expressions, got %d", len(expressions))
+	}
+}
+
+func testExpressionNotFound(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	if _, err := repo.GetExpressionByID("missing"); err == nil {
+		t.Errorf("Expected error for missing expression")
+	}
+	if err := repo.UpdateExpression(&models.Expression{ID: "missing"}); err == nil {
+		t.Errorf("Expected error when updating missing expression")
+	}
+	if expressions, err := repo.GetAllExpressions(); err != nil || len(expressions) != 0 {
+		t.Errorf("Expected empty list, got %v (%v)", expressions, err)
+	}
+}
+
+func testExpiredExpressions(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	soon := clock.Now().Add(time.Second)
+	later := clock.Now().Add(time.Minute)
+	expressions := []*models.Expression{
+		{ID: "soon", Expression: "1 + 1", Status: models.StatusProcessing, Deadline: &soon},
+		{ID: "later", Expression: "2 + 2", Status: models.StatusProcessing, Deadline: &later},
+		{ID: "unbounded", Expression: "3 + 3", Status: models.StatusProcessing},
+		{ID: "done", Expression: "4 + 4", Status: models.StatusCompleted, Deadline: &soon},
+	}
+	for _, expression := range expressions {
+		if err := repo.SaveExpression(expression); err != nil {
+			t.Fatalf("Failed to save expression: %v", err)
+		}
+	}
+
+	stored, err := repo.GetExpressionByID("soon")
+	if err != nil || stored.Deadline == nil || !stored.Deadline.Equal(soon) {
+		t.Fatalf("Expected deadline %v to be stored, got %+v (%v)", soon, stored, err)
+	}
+
+	assertExpired := func(expected ...string) {
+		t.Helper()
+		expired, err := repo.GetExpiredExpressions(clock.Now())
+		if err != nil {
+			t.Fatalf("Failed to get expired expressions: %v", err)
+		}
+		ids := []string{}
+		for _, expression := range expired {
+			ids = append(ids, expression.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Errorf("Expected expired expressions %v, got %v", expected, ids)
+		}
+	}
+
+	assertExpired()
+
+	// Срок считается наступившим ровно в момент deadline
+	clock.Advance(time.Second)
+	assertExpired("soon")
+
+	stored.Status = models.StatusTimeout
+	if err := repo.UpdateExpression(stored); err != nil {
+		t.Fatalf("Failed to update expression: %v", err)
+	}
+	clock.Advance(time.Hour)
+	assertExpired("later")
+}
+
+func testTransitionExpression(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	if _, err := repo.TransitionExpression("missing", models.StatusProcessing, models.StatusTimeout, ""); err == nil || errors.Is(err, orchestrator.ErrExpressionStatusChanged) {
+		t.Errorf("Expected not found error for missing expression, got %v", err)
+	}
+
+	if err := repo.SaveExpression(&models.Expression{ID: "e1", Expression: "1 + 1", Status: models.StatusProcessing, RootTaskID: "t1", Priority: 3}); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+	expression, err := repo.TransitionExpression("e1", models.StatusProcessing, models.StatusTimeout, "deadline exceeded")
+	if err != nil || expression.Status != models.StatusTimeout || expression.Error != "deadline exceeded" || expression.Priority != 3 {
+		t.Fatalf("Expected timed out expression, got %+v (%v)", expression, err)
+	}
+	if _, err := repo.TransitionExpression("e1", models.StatusProcessing, models.StatusCancelled, ""); !errors.Is(err, orchestrator.ErrExpressionStatusChanged) {
+		t.Errorf("Expected ErrExpressionStatusChanged, got %v", err)
+	}
+	if stored, _ := repo.GetExpressionByID("e1"); stored.Status != models.StatusTimeout || stored.Error != "deadline exceeded" {
+		t.Errorf("Unexpected expression: %+v", stored)
+	}
+
+	// Выражение, завершённое корневой задачей, не перезаписывается
+	_ = repo.SaveExpression(&models.Expression{ID: "e2", Expression: "1 + 1", Status: models.StatusProcessing, RootTaskID: "t2"})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e2", Args: []string{"1", "1"}, Operation: models.Addition})
+	CompleteTask(t, repo, "t2", 2)
+	if _, err := repo.TransitionExpression("e2", models.StatusProcessing, models.StatusTimeout, "deadline exceeded"); !errors.Is(err, orchestrator.ErrExpressionStatusChanged) {
+		t.Errorf("Expected ErrExpressionStatusChanged for completed expression, got %v", err)
+	}
+	if stored, _ := repo.GetExpressionByID("e2"); stored.Status != models.StatusCompleted || stored.Result == nil || *stored.Result != 2 {
+		t.Errorf("Completed expression was overwritten: %+v", stored)
+	}
+}
+
+func testRecordDelivery(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	if err := repo.RecordDelivery("missing", models.WebhookDelivery{Attempt: 1}); err == nil {
+		t.Errorf("Expected error when recording delivery for missing expression")
+	}
+
+	expression := &models.Expression{ID: "e1", Expression: "1 + 1", Status: models.StatusProcessing, CallbackURL: "http://example.com/hook"}
+	if err := repo.SaveExpression(expression); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+
+	deliveries := []models.WebhookDelivery{
+		{Attempt: 1, At: clock.Now(), StatusCode: 503},
+		{Attempt: 2, At: clock.Now().Add(time.Second), Error: "connection refused"},
+	}
+	for _, delivery := range deliveries {
+		if err := repo.RecordDelivery("e1", delivery); err != nil {
+			t.Fatalf("Failed to record delivery: %v", err)
+		}
+	}
+
+	// UpdateExpression со старой копией выражения не должен терять попытки доставки
+	expression.Status = models.StatusCompleted
+	if err := repo.UpdateExpression(expression); err != nil {
+		t.Fatalf("Failed to update expression: %v", err)
+	}
+	if err := repo.RecordDelivery("e1", models.WebhookDelivery{Attempt: 3, At: clock.Now().Add(2 * time.Second), StatusCode: 200, Delivered: true}); err != nil {
+		t.Fatalf("Failed to record delivery: %v", err)
+	}
+
+	stored, err := repo.GetExpressionByID("e1")
+	if err != nil {
+		t.Fatalf("Failed to get expression: %v", err)
+	}
+	if stored.CallbackURL != "http://example.com/hook" || stored.Status != models.StatusCompleted || len(stored.Deliveries) != 3 {
+		t.Fatalf("Unexpected expression: %+v", stored)
+	}
+	for i, delivery := range append(deliveries, models.WebhookDelivery{Attempt: 3, StatusCode: 200, Delivered: true}) {
+		got := stored.Deliveries[i]
+		if got.Attempt != delivery.Attempt || got.StatusCode != delivery.StatusCode || got.Error != delivery.Error || got.Delivered != delivery.Delivered {
+			t.Errorf("Delivery %d: expected %+v, got %+v", i, delivery, got)
+		}
+	}
+	if !stored.Deliveries[1].At.Equal(deliveries[1].At) {
+		t.Errorf("Expected delivery time %s, got %s", deliveries[1].At, stored.Deliveries[1].At)
+	}
+	if !stored.Delivered() {
+		t.Errorf("Expected expression to be delivered")
+	}
+
+	stored.Deliveries[0].Attempt = 100
+	if again, _ := repo.GetExpressionByID("e1"); again.Deliveries[0].Attempt != 1 {
+		t.Errorf("Mutating returned deliveries changed stored state: %+v", again.Deliveries)
+	}
+}
+
+func testBatches(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	if _, err := repo.GetBatchByID("missing"); !errors.Is(err, orchestrator.ErrBatchNotFound) {
+		t.Errorf("Expected ErrBatchNotFound for missing batch, got %v", err)
+	}
+	if expressions, err := repo.GetBatchExpressions("missing"); err != nil || len(expressions) != 0 {
+		t.Errorf("Expected no expressions for missing batch, got %v (%v)", expressions, err)
+	}
+
+	for _, id := range []string{"e1", "e2", "other"} {
+		if err := repo.SaveExpression(&models.Expression{ID: id, Expression: "1 + 1", Status: models.StatusProcessing}); err != nil {
+			t.Fatalf("Failed to save expression %s: %v", id, err)
+		}
+	}
+
+	batch := &models.Batch{
+		ID: "b1",
+		Items: []models.BatchItem{
+			{Key: "first", ExpressionID: "e2"},
+			{Key: "broken", Error: "unexpected end of expression", Column: 3},
+			{ExpressionID: "e1"},
+		},
+		CreatedAt: clock.Now(),
+	}
+	if err := repo.SaveBatch(batch); err != nil {
+		t.Fatalf("Failed to save batch: %v", err)
+	}
+	if err := repo.SaveBatch(&models.Batch{ID: "b1"}); err == nil {
+		t.Errorf("Expected error when saving batch with existing ID")
+	}
+
+	batch.Items[0].Key = "changed"
+
+	stored, err := repo.GetBatchByID("b1")
+	if err != nil {
+		t.Fatalf("Failed to get batch: %v", err)
+	}
+	if !stored.CreatedAt.Equal(clock.Now()) || len(stored.Items) != 3 {
+		t.Fatalf("Unexpected batch: %+v", stored)
+	}
+	expected := []models.BatchItem{
+		{Key: "first", ExpressionID: "e2"},
+		{Key: "broken", Error: "unexpected end of expression", Column: 3},
+		{ExpressionID: "e1"},
+	}
+	for i, item := range expected {
+		if stored.Items[i] != item {
+			t.Errorf("Item %d: expected %+v, got %+v", i, item, stored.Items[i])
+		}
+	}
+
+	expressions, err := repo.GetBatchExpressions("b1")
+	if err != nil {
+		t.Fatalf("Failed to get batch expressions: %v", err)
+	}
+	ids := []string{}
+	for _, expression := range expressions {
+		ids = append(ids, expression.ID)
+	}
+	sort.Strings(ids)
+	if fmt.Sprint(ids) != "[e1 e2]" {
+		t.Errorf("Expected expressions [e1 e2], got %v", ids)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	start := clock.Now()
+	first := &models.IdempotencyKey{ClientID: "c1", Key: "k1", RequestHash: "h1", ExpressionID: "e1", CreatedAt: start, ExpiresAt: start.Add(time.Hour)}
+	if existing, err := repo.ReserveIdempotencyKey(first); err != nil || existing != nil {
+		t.Fatalf("Expected new key to be reserved, got %+v (%v)", existing, err)
+	}
+
+	// Повтор до истечения ключа получает первую запись
+	retry := &models.IdempotencyKey{ClientID: "c1", Key: "k1", RequestHash: "h2", ExpressionID: "e2", CreatedAt: start.Add(time.Minute), ExpiresAt: start.Add(time.Hour + time.Minute)}
+	existing, err := repo.ReserveIdempotencyKey(retry)
+	if err != nil || existing == nil {
+		t.Fatalf("Expected existing key, got %+v (%v)", existing, err)
+	}
+	if existing.ClientID != "c1" || existing.RequestHash != "h1" || existing.ExpressionID != "e1" || !existing.CreatedAt.Equal(start) || !existing.ExpiresAt.Equal(first.ExpiresAt) {
+		t.Errorf("Unexpected existing key: %+v", existing)
+	}
+
+	// Тот же ключ другого клиента не связан с первым
+	other := &models.IdempotencyKey{ClientID: "c2", Key: "k1", RequestHash: "h1", ExpressionID: "e4", CreatedAt: start.Add(time.Minute), ExpiresAt: start.Add(time.Hour)}
+	if existing, err := repo.ReserveIdempotencyKey(other); err != nil || existing != nil {
+		t.Fatalf("Expected key of another client to be reserved, got %+v (%v)", existing, err)
+	}
+
+	// После истечения ключ занимается заново
+	reused := &models.IdempotencyKey{ClientID: "c1", Key: "k1", RequestHash: "h3", ExpressionID: "e3", CreatedAt: first.ExpiresAt, ExpiresAt: first.ExpiresAt.Add(time.Hour)}
+	if existing, err := repo.ReserveIdempotencyKey(reused); err != nil || existing != nil {
+		t.Fatalf("Expected expired key to be reserved again, got %+v (%v)", existing, err)
+	}
+	if existing, _ := repo.ReserveIdempotencyKey(retry); existing == nil || existing.ExpressionID != "e3" {
+		t.Errorf("Expected reused key, got %+v", existing)
+	}
+
+	if err := repo.DeleteIdempotencyKey("c1", "k1"); err != nil {
+		t.Fatalf("Failed to delete key: %v", err)
+	}
+	if existing, _ := repo.ReserveIdempotencyKey(other); existing == nil || existing.ExpressionID != "e4" {
+		t.Errorf("Deleting a key must not touch other clients, got %+v", existing)
+	}
+	if existing, err := repo.ReserveIdempotencyKey(retry); err != nil || existing != nil {
+		t.Errorf("Expected deleted key to be reserved again, got %+v (%v)", existing, err)
+	}
+
+	soon := &models.IdempotencyKey{ClientID: "c1", Key: "k2", RequestHash: "h", ExpressionID: "e", CreatedAt: start, ExpiresAt: start.Add(time.Minute)}
+	if _, err := repo.ReserveIdempotencyKey(soon); err != nil {
+		t.Fatalf("Failed to reserve key: %v", err)
+	}
+	if deleted, err := repo.DeleteExpiredIdempotencyKeys(start.Add(time.Minute)); err != nil || deleted != 1 {
+		t.Errorf("Expected 1 expired key, got %d (%v)", deleted, err)
+	}
+	if existing, _ := repo.ReserveIdempotencyKey(retry); existing == nil || existing.ExpressionID != "e2" {
+		t.Errorf("Unexpired key was deleted: %+v", existing)
+	}
+}
+
+func testTasks(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	task := &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"sqrt", "2"}, Operation: models.Max, OperationTime: 700}
+	if err := repo.SaveTask(task); err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+	task.Args[0] = "changed"
+
+	stored, err := repo.GetTaskByID("t1")
+	if err != nil {
+		t.Fatalf("Failed to get task: %v", err)
+	}
+	if stored.ExpressionID != "e1" || stored.Operation != models.Max || stored.OperationTime != 700 || len(stored.Args) != 2 || stored.Args[0] != "sqrt" {
+		t.Errorf("Unexpected stored task: %+v", stored)
+	}
+
+	stored.Error = "failed"
+	stored.Cancelled = true
+	if err := repo.UpdateTask(stored); err != nil {
+		t.Fatalf("Failed to update task: %v", err)
+	}
+	stored.Error = "changed"
+
+	updated, _ := repo.GetTaskByID("t1")
+	if updated.Error != "failed" || !updated.Cancelled {
+		t.Errorf("Update was not persisted: %+v", updated)
+	}
+}
+
+func testCountTasks(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	if completed, total, err := repo.CountTasks("e1"); err != nil || completed != 0 || total != 0 {
+		t.Errorf("Expected no tasks for unknown expression, got %d of %d (%v)", completed, total, err)
+	}
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t3", ExpressionID: "e1", Args: []string{"t1", "t2"}, Operation: models.Multiplication, Dependencies: []string{"t1", "t2"}})
+	mustSaveTask(t, repo, &models.Task{ID: "other", ExpressionID: "e2", Args: []string{"1", "1"}, Operation: models.Addition})
+
+	CompleteTask(t, repo, "t1", 3)
+	CompleteTask(t, repo, "other", 2)
+
+	if completed, total, err := repo.CountTasks("e1"); err != nil || completed != 1 || total != 3 {
+		t.Errorf("Expected 1 of 3 tasks done, got %d of %d (%v)", completed, total, err)
+	}
+}
+
+func testTaskNotFound(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	if _, err := repo.GetTaskByID("missing"); err == nil {
+		t.Errorf("Expected error for missing task")
+	}
+	if err := repo.UpdateTask(&models.Task{ID: "missing"}); err == nil {
+		t.Errorf("Expected error when updating missing task")
+	}
+	if _, err := repo.LeaseTask("missing", time.Second); !errors.Is(err, orchestrator.ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound when leasing missing task, got %v", err)
+	}
+	if task, err := repo.LeaseNextTask(time.Second); task != nil || err != nil {
+		t.Errorf("Expected no task from empty repository, got %+v (%v)", task, err)
+	}
+}
+
+func testReadyTasksResolveDependencies(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	// (1 + 2) * (3 + 4), зависимая задача сохраняется раньше одной из своих зависимостей
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t3", ExpressionID: "e1", Args: []string{"t1", "t2"}, Operation: models.Multiplication, Dependencies: []string{"t1", "t2"}})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+
+	assertReady(t, repo, "t1", "t2")
+
+	CompleteTask(t, repo, "t1", 3)
+	assertReady(t, repo, "t2")
+
+	CompleteTask(t, repo, "t2", 0.1)
+	assertReady(t, repo, "t3")
+
+	readyTasks, _ := repo.GetReadyTasks()
+	if args := readyTasks[0].Args; args[0] != "3" || args[1] != "0.1" {
+		t.Errorf("Expected resolved arguments [3 0.1], got %v", args)
+	}
+
+	// Разрешение аргументов не должно менять сохранённую задачу
+	if stored, _ := repo.GetTaskByID("t3"); stored.Args[0] != "t1" || stored.Args[1] != "t2" {
+		t.Errorf("Stored arguments were overwritten: %v", stored.Args)
+	}
+}
+
+func testReadyHeads(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	early := clock.Now()
+	late := early.Add(time.Second)
+	tasks := []*models.Task{
+		// У клиента a задачи более позднего выражения стали готовыми раньше
+		{ID: "a-late", ExpressionID: "e2", Args: []string{"1", "1"}, Operation: models.Addition, ClientID: "a", SubmittedAt: late},
+		{ID: "a-early-1", ExpressionID: "e1", Args: []string{"1", "1"}, Operation: models.Addition, ClientID: "a", SubmittedAt: early},
+		{ID: "a-early-2", ExpressionID: "e1", Args: []string{"1", "1"}, Operation: models.Addition, ClientID: "a", SubmittedAt: early},
+		{ID: "a-urgent", ExpressionID: "e3", Args: []string{"1", "1"}, Operation: models.Addition, ClientID: "a", SubmittedAt: late, Priority: 5},
+		{ID: "b", ExpressionID: "e4", Args: []string{"1", "1"}, Operation: models.Addition, ClientID: "b", SubmittedAt: late},
+		{ID: "b-blocked", ExpressionID: "e4", Args: []string{"b", "1"}, Operation: models.Addition, ClientID: "b", SubmittedAt: early, Dependencies: []string{"b"}},
+	}
+	for _, task := range tasks {
+		mustSaveTask(t, repo, task)
+	}
+
+	assertHeads := func(expected ...string) {
+		t.Helper()
+		heads, err := repo.GetReadyHeads()
+		if err != nil {
+			t.Fatalf("Failed to get ready heads: %v", err)
+		}
+		ids := []string{}
+		for _, head := range heads {
+			ids = append(ids, head.ID)
+		}
+		sort.Strings(ids)
+		sort.Strings(expected)
+		if fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Errorf("Expected heads %v, got %v", expected, ids)
+		}
+	}
+
+	assertHeads("a-early-1", "a-urgent", "b")
+
+	stored, err := repo.GetTaskByID("a-urgent")
+	if err != nil || stored.Priority != 5 || stored.ClientID != "a" || !stored.SubmittedAt.Equal(late) {
+		t.Errorf("Expected scheduling fields to be stored, got %+v (%v)", stored, err)
+	}
+
+	if _, err := repo.LeaseTask("a-early-1", time.Second); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	CompleteTask(t, repo, "b", 2)
+	assertHeads("a-early-2", "a-urgent", "b-blocked")
+
+	// Задача с истёкшей арендой снова становится головой своей дорожки
+	clock.Advance(time.Second)
+	assertHeads("a-early-1", "a-urgent", "b-blocked")
+
+	// Дорожка, все задачи которой арендованы, не мешает найти головы следующих
+	for _, id := range []string{"a-early-1", "a-early-2", "a-late"} {
+		if _, err := repo.LeaseTask(id, time.Second); err != nil {
+			t.Fatalf("Failed to lease task: %v", err)
+		}
+	}
+	assertHeads("a-urgent", "b-blocked")
+}
+
+func testLeaseTask(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"t1", "2"}, Operation: models.Addition, Dependencies: []string{"t1"}})
+
+	if _, err := repo.LeaseTask("t2", time.Second); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for task with pending dependency, got %v", err)
+	}
+
+	task, err := repo.LeaseTask("t1", time.Second)
+	if err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	if task.ID != "t1" || task.Attempts != 1 || task.LeaseExpiresAt == nil {
+		t.Errorf("Unexpected lease state: %+v", task)
+	}
+
+	if _, err := repo.LeaseTask("t1", time.Second); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for leased task, got %v", err)
+	}
+	if next, _ := repo.LeaseNextTask(time.Second); next != nil {
+		t.Errorf("Expected no ready tasks while t1 is leased, got %+v", next)
+	}
+	assertReady(t, repo)
+
+	CompleteTask(t, repo, "t1", 3)
+	next, err := repo.LeaseNextTask(time.Second)
+	if err != nil || next == nil || next.ID != "t2" || next.Args[0] != "3" {
+		t.Errorf("Expected t2 with resolved argument, got %+v (%v)", next, err)
+	}
+}
+
+func testLeaseCriticalTask(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "short", ExpressionID: "e1", Args: []string{"1", "1"}, Operation: models.Addition, OperationTime: 1000, Rank: 1000})
+	mustSaveTask(t, repo, &models.Task{ID: "long", ExpressionID: "e2", Args: []string{"1", "1"}, Operation: models.Addition, OperationTime: 1000, Rank: 5000})
+	mustSaveTask(t, repo, &models.Task{ID: "blocked", ExpressionID: "e2", Args: []string{"long", "1"}, Operation: models.Addition, Dependencies: []string{"long"}, Rank: 9000})
+	mustSaveTask(t, repo, &models.Task{ID: "short-2", ExpressionID: "e1", Args: []string{"1", "1"}, Operation: models.Addition, OperationTime: 1000, Rank: 1000})
+
+	if stored, _ := repo.GetTaskByID("long"); stored.Rank != 5000 {
+		t.Errorf("Expected rank to be stored, got %d", stored.Rank)
+	}
+
+	for _, expected := range []string{"long", "short", "short-2"} {
+		task, err := repo.LeaseCriticalTask(time.Second)
+		if err != nil || task == nil || task.ID != expected {
+			t.Fatalf("Expected %s to be leased, got %+v (%v)", expected, task, err)
+		}
+	}
+	if task, _ := repo.LeaseCriticalTask(time.Second); task != nil {
+		t.Errorf("Expected no ready tasks, got %s", task.ID)
+	}
+
+	// После истечения аренды задача снова выдаётся первой среди задач с тем же рангом
+	clock.Advance(2 * time.Second)
+	task, err := repo.LeaseCriticalTask(time.Second)
+	if err != nil || task == nil || task.ID != "long" || task.Attempts != 2 {
+		t.Errorf("Expected long to be leased again, got %+v (%v)", task, err)
+	}
+}
+
+func testLeaseExpiry(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition, OperationTime: 1000})
+
+	task, err := repo.LeaseNextTask(time.Second)
+	if err != nil || task == nil {
+		t.Fatalf("Failed to lease task: %+v (%v)", task, err)
+	}
+	if expected := clock.Now().Add(2 * time.Second); !task.LeaseExpiresAt.Equal(expected) {
+		t.Errorf("Expected lease until %v (operation time plus timeout), got %v", expected, task.LeaseExpiresAt)
+	}
+
+	clock.Advance(2*time.Second - time.Millisecond)
+	assertReady(t, repo)
+
+	clock.Advance(time.Millisecond)
+	assertReady(t, repo, "t1")
+
+	task, err = repo.LeaseNextTask(time.Second)
+	if err != nil || task == nil || task.Attempts != 2 {
+		t.Errorf("Expected task to be reassigned with 2 attempts, got %+v (%v)", task, err)
+	}
+}
+
+func testRenewLease(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition, OperationTime: 1000})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+
+	if err := repo.RenewLease("t1", time.Second); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for task that is not leased, got %v", err)
+	}
+	if err := repo.RenewLease("missing", time.Second); !errors.Is(err, orchestrator.ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound for missing task, got %v", err)
+	}
+
+	if _, err := repo.LeaseTask("t1", time.Second); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+
+	// Продление не сокращает аренду, выданную на время операции
+	if err := repo.RenewLease("t1", time.Second); err != nil {
+		t.Fatalf("Failed to renew lease: %v", err)
+	}
+	clock.Advance(2*time.Second - time.Millisecond)
+	if err := repo.RenewLease("t1", time.Second); err != nil {
+		t.Fatalf("Failed to renew lease: %v", err)
+	}
+
+	clock.Advance(time.Second - time.Millisecond)
+	assertReady(t, repo, "t2")
+	if stored, _ := repo.GetTaskByID("t1"); stored.LeaseExpiresAt == nil || !stored.LeaseExpiresAt.Equal(clock.Now().Add(time.Millisecond)) {
+		t.Errorf("Expected renewed lease to be stored, got %+v", stored.LeaseExpiresAt)
+	}
+
+	clock.Advance(time.Millisecond)
+	assertReady(t, repo, "t1", "t2")
+	if err := repo.RenewLease("t1", time.Second); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for expired lease, got %v", err)
+	}
+
+	if _, err := repo.LeaseTask("t1", time.Second); err != nil {
+		t.Fatalf("Failed to lease task again: %v", err)
+	}
+	if err := repo.CancelTasks("e1"); err != nil {
+		t.Fatalf("Failed to cancel tasks: %v", err)
+	}
+	if err := repo.RenewLease("t1", time.Second); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for cancelled task, got %v", err)
+	}
+}
+
+func testReleaseTask(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition, OperationTime: 1000})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+
+	if err := repo.ReleaseTask("t1"); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for task that is not leased, got %v", err)
+	}
+	if err := repo.ReleaseTask("missing"); !errors.Is(err, orchestrator.ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound for missing task, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := repo.LeaseNextTask(time.Minute); err != nil {
+			t.Fatalf("Failed to lease task: %v", err)
+		}
+	}
+	assertReady(t, repo)
+
+	if err := repo.ReleaseTask("t1"); err != nil {
+		t.Fatalf("Failed to release task: %v", err)
+	}
+	assertReady(t, repo, "t1")
+	if stored, _ := repo.GetTaskByID("t1"); stored.LeaseExpiresAt != nil || stored.Attempts != 1 {
+		t.Errorf("Expected lease to be cleared, got %+v", stored)
+	}
+
+	// Освобождённая задача выдаётся снова, а посчитанная - нет
+	task, err := repo.LeaseNextTask(time.Minute)
+	if err != nil || task == nil || task.ID != "t1" || task.Attempts != 2 {
+		t.Errorf("Expected t1 to be leased again, got %+v (%v)", task, err)
+	}
+	CompleteTask(t, repo, "t2", 7)
+	if err := repo.ReleaseTask("t2"); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for completed task, got %v", err)
+	}
+	assertReady(t, repo)
+}
+
+func testReleaseLeases(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition, OperationTime: 1000})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+
+	if _, err := repo.LeaseTask("t1", time.Minute); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	if _, err := repo.LeaseTask("t2", time.Minute); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	CompleteTask(t, repo, "t2", 7)
+	assertReady(t, repo)
+
+	released, err := repo.ReleaseLeases()
+	if err != nil {
+		t.Fatalf("Failed to release leases: %v", err)
+	}
+	if released != 1 {
+		t.Errorf("Expected 1 released lease, got %d", released)
+	}
+
+	// Аренда снята сразу, не дожидаясь её истечения
+	assertReady(t, repo, "t1")
+	if task, _ := repo.GetTaskByID("t1"); task.LeaseExpiresAt != nil || task.Attempts != 1 {
+		t.Errorf("Expected released task to keep attempts and have no lease, got %+v", task)
+	}
+
+	task, err := repo.LeaseNextTask(time.Minute)
+	if err != nil || task == nil || task.ID != "t1" || task.Attempts != 2 {
+		t.Errorf("Expected released task to be leased again, got %+v (%v)", task, err)
+	}
+}
+
+func testRebuildDependencies(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t3", ExpressionID: "e1", Args: []string{"t1", "t2"}, Operation: models.Multiplication, Dependencies: []string{"t1", "t2"}})
+	CompleteTask(t, repo, "t1", 3)
+
+	// На согласованном хранилище исправлять нечего
+	fixed, err := repo.RebuildDependencies()
+	if err != nil {
+		t.Fatalf("Failed to rebuild dependencies: %v", err)
+	}
+	if fixed != 0 {
+		t.Errorf("Expected no fixed tasks on a consistent store, got %d", fixed)
+	}
+	assertReady(t, repo, "t2")
+
+	CompleteTask(t, repo, "t2", 7)
+	if fixed, _ := repo.RebuildDependencies(); fixed != 0 {
+		t.Errorf("Expected no fixed tasks after completion, got %d", fixed)
+	}
+
+	readyTasks, err := repo.GetReadyTasks()
+	if err != nil || len(readyTasks) != 1 || readyTasks[0].ID != "t3" {
+		t.Fatalf("Expected t3 to be ready after rebuild, got %v (%v)", readyTasks, err)
+	}
+	if args := readyTasks[0].Args; args[0] != "3" || args[1] != "7" {
+		t.Errorf("Expected resolved arguments [3 7], got %v", args)
+	}
+}
+
+func testCompleteTask(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	if err := repo.SaveExpression(&models.Expression{ID: "e1", Expression: "(1 + 2) * 3", Status: models.StatusProcessing, RootTaskID: "t2"}); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"t1", "3"}, Operation: models.Multiplication, Dependencies: []string{"t1"}})
+
+	if _, err := repo.CompleteTask("missing", 1); !errors.Is(err, orchestrator.ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound for missing task, got %v", err)
+	}
+
+	if _, err := repo.LeaseTask("t1", time.Second); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	completed, err := repo.CompleteTask("t1", 3)
+	if err != nil || completed != nil {
+		t.Fatalf("Expected no completed expression for inner task, got %+v (%v)", completed, err)
+	}
+	stored, _ := repo.GetTaskByID("t1")
+	if !stored.Completed || stored.Result == nil || *stored.Result != 3 || stored.LeaseExpiresAt != nil {
+		t.Errorf("Expected task to be completed with 3, got %+v", stored)
+	}
+	if _, err := repo.CompleteTask("t1", 4); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for completed task, got %v", err)
+	}
+	assertReady(t, repo, "t2")
+
+	// Выражение возвращает только тот вызов, который его завершил
+	completed, err = repo.CompleteTask("t2", 9)
+	if err != nil || completed == nil || completed.Status != models.StatusCompleted || completed.Result == nil || *completed.Result != 9 {
+		t.Fatalf("Expected completed expression with 9, got %+v (%v)", completed, err)
+	}
+	if _, err := repo.CompleteTask("t2", 9); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for completed root task, got %v", err)
+	}
+
+	mustSaveTask(t, repo, &models.Task{ID: "t3", ExpressionID: "e2", Args: []string{"1", "1"}, Operation: models.Addition})
+	if err := repo.CancelTasks("e2"); err != nil {
+		t.Fatalf("Failed to cancel tasks: %v", err)
+	}
+	if _, err := repo.CompleteTask("t3", 2); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for cancelled task, got %v", err)
+	}
+}
+
+func testFailTask(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "0"}, Operation: models.Division})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+
+	if err := repo.FailTask("missing", "boom"); !errors.Is(err, orchestrator.ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound for missing task, got %v", err)
+	}
+
+	if _, err := repo.LeaseTask("t1", time.Second); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+	if err := repo.FailTask("t1", "division by zero"); err != nil {
+		t.Fatalf("Failed to fail task: %v", err)
+	}
+	stored, _ := repo.GetTaskByID("t1")
+	if !stored.Cancelled || stored.Error != "division by zero" || stored.LeaseExpiresAt != nil {
+		t.Errorf("Expected failed task to be cancelled with its error, got %+v", stored)
+	}
+
+	// Проваленная задача не возвращается в очередь ни сразу, ни после срока аренды
+	clock.Advance(time.Hour)
+	assertReady(t, repo, "t2")
+
+	if err := repo.FailTask("t1", "again"); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for failed task, got %v", err)
+	}
+	CompleteTask(t, repo, "t2", 3)
+	if err := repo.FailTask("t2", "late"); !errors.Is(err, orchestrator.ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for completed task, got %v", err)
+	}
+	if stored, _ := repo.GetTaskByID("t2"); stored.Cancelled || stored.Error != "" {
+		t.Errorf("Completed task must not be changed, got %+v", stored)
+	}
+}
+
+func testCancelTasks(t *testing.T, factory Factory) {
+	repo, clock := setup(t, factory)
+
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t3", ExpressionID: "e1", Args: []string{"t1", "t2"}, Operation: models.Addition, Dependencies: []string{"t1", "t2"}})
+	mustSaveTask(t, repo, &models.Task{ID: "other", ExpressionID: "e2", Args: []string{"1", "1"}, Operation: models.Addition})
+
+	CompleteTask(t, repo, "t1", 3)
+	if _, err := repo.LeaseTask("t2", time.Second); err != nil {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+
+	if err := repo.CancelTasks("e1"); err != nil {
+		t.Fatalf("Failed to cancel tasks: %v", err)
+	}
+	clock.Advance(time.Hour)
+
+	assertReady(t, repo, "other")
+
+	if task, _ := repo.GetTaskByID("t1"); task.Cancelled || !task.Completed {
+		t.Errorf("Completed task must not be cancelled: %+v", task)
+	}
+	for _, id := range []string{"t2", "t3"} {
+		if task, _ := repo.GetTaskByID(id); !task.Cancelled || task.LeaseExpiresAt != nil {
+			t.Errorf("Expected %s to be cancelled without lease, got %+v", id, task)
+		}
+	}
+}
+
+func testCompletionDetection(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	if err := repo.SaveExpression(&models.Expression{ID: "e1", Expression: "(1 + 2) * 3", Status: models.StatusProcessing, RootTaskID: "t2"}); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+	mustSaveTask(t, repo, &models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	mustSaveTask(t, repo, &models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"t1", "3"}, Operation: models.Multiplication, Dependencies: []string{"t1"}})
+
+	CompleteTask(t, repo, "t1", 3)
+	if expression, _ := repo.GetExpressionByID("e1"); expression.Status != models.StatusProcessing || expression.Result != nil {
+		t.Errorf("Expression must not complete before its root task: %+v", expression)
+	}
+
+	CompleteTask(t, repo, "t2", 9)
+	expression, _ := repo.GetExpressionByID("e1")
+	if expression.Status != models.StatusCompleted || expression.Result == nil || *expression.Result != 9 {
+		t.Errorf("Expected expression to complete with 9, got %+v", expression)
+	}
+
+	// Выражение в статусе ошибки не завершается, даже если корневая задача досчиталась
+	_ = repo.SaveExpression(&models.Expression{ID: "e2", Expression: "1 + 1", Status: models.StatusError, RootTaskID: "t3"})
+	mustSaveTask(t, repo, &models.Task{ID: "t3", ExpressionID: "e2", Args: []string{"1", "1"}, Operation: models.Addition})
+	CompleteTask(t, repo, "t3", 2)
+	if expression, _ := repo.GetExpressionByID("e2"); expression.Status != models.StatusError {
+		t.Errorf("Failed expression must stay in ERROR, got %+v", expression)
+	}
+}
+
+func testConcurrentAccess(t *testing.T, factory Factory) {
+	repo, _ := setup(t, factory)
+
+	const expressions = 20
+	for i := 0; i < expressions; i++ {
+		id := fmt.Sprintf("e%d", i)
+		_ = repo.SaveExpression(&models.Expression{ID: id, Status: models.StatusProcessing, RootTaskID: id + "-root"})
+		mustSaveTask(t, repo, &models.Task{ID: id + "-a", ExpressionID: id, Args: []string{"1", "2"}, Operation: models.Addition})
+		mustSaveTask(t, repo, &models.Task{ID: id + "-b", ExpressionID: id, Args: []string{"3", "4"}, Operation: models.Addition})
+		mustSaveTask(t, repo, &models.Task{ID: id + "-root", ExpressionID: id, Args: []string{id + "-a", id + "-b"}, Operation: models.Multiplication, Dependencies: []string{id + "-a", id + "-b"}})
+	}
+
+	var mu sync.Mutex
+	handedOut := map[string]int{}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idle := 0; idle < 50; {
+				task, err := repo.LeaseNextTask(time.Hour)
+				if err != nil {
+					t.Errorf("Failed to lease task: %v", err)
+					return
+				}
+				if task == nil {
+					idle++
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				idle = 0
+
+				mu.Lock()
+				handedOut[task.ID]++
+				mu.Unlock()
+
+				stored, err := repo.GetTaskByID(task.ID)
+				if err != nil {
+					t.Errorf("Failed to get task: %v", err)
+					return
+				}
+				result := 1.0
+				stored.Completed = true
+				stored.Result = &result
+				stored.LeaseExpiresAt = nil
+				if err := repo.UpdateTask(stored); err != nil {
+					t.Errorf("Failed to update task: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Параллельные читатели
+	for reader := 0; reader < 2; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, _ = repo.GetAllExpressions()
+				_, _ = repo.GetReadyTasks()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(handedOut) != expressions*3 {
+		t.Errorf("Expected %d tasks to be handed out, got %d", expressions*3, len(handedOut))
+	}
+	for id, count := range handedOut {
+		if count != 1 {
+			t.Errorf("Task %s was handed out %d times", id, count)
+		}
+	}
+	for i := 0; i < expressions; i++ {
+		expression, _ := repo.GetExpressionByID(fmt.Sprintf("e%d", i))
+		if expression.Status != models.StatusCompleted {
+			t.Errorf("Expression %s did not complete: %+v", expression.ID, expression)
+		}
+	}
+}
+
+// CompleteTask сохраняет результат задачи так же, как это делает orchestrator.Service
+func CompleteTask(t *testing.T, repo orchestrator.Repository, id string, result float64) {
+	t.Helper()
+
+	if _, err := repo.CompleteTask(id, result); err != nil {
+		t.Fatalf("Failed to complete task %s: %v", id, err)
+	}
+}
+
+func mustSaveTask(t *testing.T, repo orchestrator.Repository, task *models.Task) {
+	t.Helper()
+
+	if err := repo.SaveTask(task); err != nil {
+		t.Fatalf("Failed to save task %s: %v", task.ID, err)
+	}
+}
+
+func assertReady(t *testing.T, repo orchestrator.Repository, expected ...string) {
+	t.Helper()
+
+	readyTasks, err := repo.GetReadyTasks()
+	if err != nil {
+		t.Fatalf("Failed to get ready tasks: %v", err)
+	}
+
+	ids := map[string]bool{}
+	for _, task := range readyTasks {
+		ids[task.ID] = true
+	}
+	if len(ids) != len(expected) || len(readyTasks) != len(expected) {
+		t.Errorf("Expected ready tasks %v, got %d tasks: %v", expected, len(readyTasks), ids)
+		return
+	}
+	for _, id := range expected {
+		if !ids[id] {
+			t.Errorf("Expected ready tasks %v, got %v", expected, ids)
+			return
+		}
+	}
+}
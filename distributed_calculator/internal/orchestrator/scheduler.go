@@ -0,0 +1,111 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scheduler решает, какую из готовых задач выдать агенту следующей, и арендует её.
+// Возвращает nil, если готовых задач нет.
+type Scheduler interface {
+	Next(repo Repository, timeout time.Duration) (*models.Task, error)
+}
+
+// FIFOScheduler выдаёт задачи в том порядке, в котором они стали готовыми
+type FIFOScheduler struct{}
+
+func (FIFOScheduler) Next(repo Repository, timeout time.Duration) (*models.Task, error) {
+	return repo.LeaseNextTask(timeout)
+}
+
+// CriticalPathScheduler выдаёт задачу с самым длинным оставшимся путём до корня
+// выражения (наибольшим Task.Rank). Пока агенты заняты короткими ветвями, длинная
+// цепочка не простаивает, и выражения с несбалансированным деревом считаются быстрее.
+// Приоритеты и клиенты при этом не учитываются.
+type CriticalPathScheduler struct{}
+
+func (CriticalPathScheduler) Next(repo Repository, timeout time.Duration) (*models.Task, error) {
+	return repo.LeaseCriticalTask(timeout)
+}
+
+// maxScheduleAttempts ограничивает число повторов, если выбранную задачу
+// успели арендовать в обход планировщика
+const maxScheduleAttempts = 3
+
+// FairScheduler сначала берёт задачи с наибольшим приоритетом, а среди клиентов
+// с задачами этого приоритета выдаёт задачи по кругу. У одного клиента раньше
+// выдаются задачи выражения, отправленного раньше. Так клиент с огромным
+// выражением не может занять всех агентов.
+type FairScheduler struct {
+	mu         sync.Mutex
+	lastClient string
+}
+
+func NewFairScheduler() *FairScheduler {
+	return &FairScheduler{}
+}
+
+func (s *FairScheduler) Next(repo Repository, timeout time.Duration) (*models.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; attempt < maxScheduleAttempts; attempt++ {
+		heads, err := repo.GetReadyHeads()
+		if err != nil {
+			return nil, err
+		}
+
+		head := s.pick(heads)
+		if head == nil {
+			return nil, nil
+		}
+
+		task, err := repo.LeaseTask(head.ID, timeout)
+		if errors.Is(err, ErrTaskNotAvailable) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s.lastClient = head.ClientID
+		return task, nil
+	}
+
+	return nil, nil
+}
+
+// pick выбирает среди голов дорожек задачу с наибольшим приоритетом от клиента,
+// следующего по кругу за последним обслуженным
+func (s *FairScheduler) pick(heads []*models.Task) *models.Task {
+	if len(heads) == 0 {
+		return nil
+	}
+
+	top := heads[0].Priority
+	for _, head := range heads {
+		if head.Priority > top {
+			top = head.Priority
+		}
+	}
+
+	candidates := []*models.Task{}
+	for _, head := range heads {
+		if head.Priority == top {
+			candidates = append(candidates, head)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ClientID < candidates[j].ClientID
+	})
+
+	for _, candidate := range candidates {
+		if candidate.ClientID > s.lastClient {
+			return candidate
+		}
+	}
+	return candidates[0]
+}
@@ -0,0 +1,220 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFairSchedulerPrefersPriority(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+
+	low, _ := service.ProcessRequest(models.CalculateRequest{Expression: "1 + 1", ClientID: "a"})
+	high, _ := service.ProcessRequest(models.CalculateRequest{Expression: "2 + 2", ClientID: "b", Priority: 10})
+	normal, _ := service.ProcessRequest(models.CalculateRequest{Expression: "3 + 3", ClientID: "c", Priority: 1})
+
+	for _, expected := range []*models.Expression{high, normal, low} {
+		task, err := service.GetTaskForProcessing()
+		if err != nil || task == nil || task.ExpressionID != expected.ID {
+			t.Fatalf("Expected task of %q (priority %d), got %+v (%v)", expected.Expression, expected.Priority, task, err)
+		}
+	}
+}
+
+func TestPriorityIsClamped(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+
+	// Огромный приоритет не обгоняет максимальный, а отрицательный не опускается ниже обычного
+	greedy, _ := service.ProcessRequest(models.CalculateRequest{Expression: "1 + 1", ClientID: "a", Priority: 1 << 30})
+	urgent, _ := service.ProcessRequest(models.CalculateRequest{Expression: "2 + 2", ClientID: "b", Priority: models.MaxPriority})
+	negative, _ := service.ProcessRequest(models.CalculateRequest{Expression: "3 + 3", ClientID: "c", Priority: -5})
+
+	if greedy.Priority != models.MaxPriority || urgent.Priority != models.MaxPriority || negative.Priority != models.MinPriority {
+		t.Errorf("Expected priorities to be clamped, got %d, %d and %d", greedy.Priority, urgent.Priority, negative.Priority)
+	}
+	task, _ := service.GetTaskForProcessing()
+	if task == nil || task.Priority != models.MaxPriority {
+		t.Errorf("Expected task with clamped priority, got %+v", task)
+	}
+}
+
+func TestFairSchedulerRoundRobinsClients(t *testing.T) {
+	repo, clock := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+	service.SetClock(clock.Now)
+
+	// Клиент a отправил огромное выражение раньше всех
+	terms := make([]string, 50)
+	for i := range terms {
+		terms[i] = "1 * 1"
+	}
+	if _, err := service.ProcessRequest(models.CalculateRequest{Expression: strings.Join(terms, " + "), ClientID: "a"}); err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	clock.Advance(time.Second)
+	first, _ := service.ProcessRequest(models.CalculateRequest{Expression: "2 * 2", ClientID: "b"})
+	clock.Advance(time.Second)
+	second, _ := service.ProcessRequest(models.CalculateRequest{Expression: "3 * 3", ClientID: "b"})
+	clock.Advance(time.Second)
+	third, _ := service.ProcessRequest(models.CalculateRequest{Expression: "4 * 4", ClientID: "c"})
+
+	clients := []string{}
+	for i := 0; i < 6; i++ {
+		task, err := service.GetTaskForProcessing()
+		if err != nil || task == nil {
+			t.Fatalf("Failed to get task: %+v (%v)", task, err)
+		}
+		clients = append(clients, task.ClientID)
+
+		// У клиента b раньше выдаётся задача раньше отправленного выражения
+		if task.ExpressionID == second.ID && !repoTaskLeased(t, repo, first.RootTaskID) {
+			t.Errorf("Task of the later expression of client b was handed out first")
+		}
+	}
+
+	if got := strings.Join(clients, ","); got != "a,b,c,a,b,a" {
+		t.Errorf("Expected clients to be served round-robin, got %s", got)
+	}
+	if !repoTaskLeased(t, repo, third.RootTaskID) {
+		t.Errorf("Client c was starved")
+	}
+}
+
+func TestFIFOScheduler(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+	service.SetScheduler(FIFOScheduler{})
+
+	first, _ := service.ProcessRequest(models.CalculateRequest{Expression: "1 + 1", ClientID: "a"})
+	_, _ = service.ProcessRequest(models.CalculateRequest{Expression: "2 + 2", ClientID: "b", Priority: 10})
+
+	task, err := service.GetTaskForProcessing()
+	if err != nil || task == nil || task.ExpressionID != first.ID {
+		t.Errorf("Expected FIFO scheduler to ignore priority, got %+v (%v)", task, err)
+	}
+}
+
+func repoTaskLeased(t *testing.T, repo Repository, id string) bool {
+	t.Helper()
+
+	task, err := repo.GetTaskByID(id)
+	if err != nil {
+		t.Fatalf("Failed to get task: %v", err)
+	}
+	return task.LeaseExpiresAt != nil
+}
+
+type runningTask struct {
+	task     *models.Task
+	finishAt time.Time
+}
+
+// simulateMakespan прогоняет выражения через планировщик в виртуальном времени:
+// agents агентов берут задачи, как только освобождаются, и тратят на каждую
+// её OperationTime. Возвращает время, за которое посчитаны все выражения.
+func simulateMakespan(t testing.TB, scheduler Scheduler, expressions []string, operationTimes map[models.Operation]int64, agents int) time.Duration {
+	t.Helper()
+
+	repo, clock := newTestRepository()
+	service := NewService(repo, operationTimes, time.Hour)
+	service.SetScheduler(scheduler)
+	service.SetClock(clock.Now)
+
+	start := clock.Now()
+	ids := []string{}
+	for _, expression := range expressions {
+		created, err := service.ProcessExpression(expression)
+		if err != nil {
+			t.Fatalf("Failed to process expression %q: %v", expression, err)
+		}
+		ids = append(ids, created.ID)
+	}
+
+	running := []runningTask{}
+	for {
+		for len(running) < agents {
+			task, err := service.GetTaskForProcessing()
+			if err != nil {
+				t.Fatalf("Failed to get task: %v", err)
+			}
+			if task == nil {
+				break
+			}
+			running = append(running, runningTask{task: task, finishAt: clock.Now().Add(time.Duration(task.OperationTime) * time.Millisecond)})
+		}
+		if len(running) == 0 {
+			break
+		}
+
+		next := 0
+		for i := range running {
+			if running[i].finishAt.Before(running[next].finishAt) {
+				next = i
+			}
+		}
+		done := running[next]
+		running = append(running[:next], running[next+1:]...)
+
+		clock.Advance(done.finishAt.Sub(clock.Now()))
+		if err := service.ProcessTaskResult(done.task.ID, evaluateTestTask(t, done.task)); err != nil {
+			t.Fatalf("Failed to process task result: %v", err)
+		}
+	}
+
+	for _, id := range ids {
+		if stored, _ := service.GetExpressionByID(id); stored.Status != models.StatusCompleted {
+			t.Fatalf("Expression %s was not completed: %+v", id, stored)
+		}
+	}
+
+	return clock.Now().Sub(start)
+}
+
+// unbalancedWorkload - короткое широкое выражение, отправленное раньше
+// несбалансированного, у которого длинная цепочка (1+2)*(3+4) -> / -> +7
+var unbalancedWorkload = []string{"(1-1)+(2-2)+(3-3)+(4-4)", "((1+2)*(3+4))/(5-6)+7"}
+
+var simulationTimes = map[models.Operation]int64{
+	models.Addition:       1000,
+	models.Subtraction:    1000,
+	models.Multiplication: 2000,
+	models.Division:       3000,
+}
+
+func TestCriticalPathSchedulerReducesMakespan(t *testing.T) {
+	fifo := simulateMakespan(t, FIFOScheduler{}, unbalancedWorkload, simulationTimes, 2)
+	critical := simulateMakespan(t, CriticalPathScheduler{}, unbalancedWorkload, simulationTimes, 2)
+
+	// Критический путь несбалансированного выражения - 7s, и он не должен
+	// ждать, пока агенты посчитают короткие ветви первого выражения
+	if fifo != 10*time.Second || critical != 8*time.Second {
+		t.Errorf("Expected makespan 10s with FIFO and 8s with critical path, got %v and %v", fifo, critical)
+	}
+}
+
+func BenchmarkSchedulerMakespan(b *testing.B) {
+	policies := []struct {
+		name      string
+		scheduler func() Scheduler
+	}{
+		{"fifo", func() Scheduler { return FIFOScheduler{} }},
+		{"fair", func() Scheduler { return NewFairScheduler() }},
+		{"critical-path", func() Scheduler { return CriticalPathScheduler{} }},
+	}
+
+	for _, policy := range policies {
+		for _, agents := range []int{2, 3} {
+			b.Run(fmt.Sprintf("%s/agents=%d", policy.name, agents), func(b *testing.B) {
+				var makespan time.Duration
+				for i := 0; i < b.N; i++ {
+					makespan = simulateMakespan(b, policy.scheduler(), unbalancedWorkload, simulationTimes, agents)
+				}
+				b.ReportMetric(makespan.Seconds(), "makespan-s")
+			})
+		}
+	}
+}
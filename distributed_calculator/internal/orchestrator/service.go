@@ -3,38 +3,90 @@ package orchestrator
 import (
 	"distributed-calculator/internal/calculator"
 	"distributed-calculator/internal/models"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrTaskCancelled возвращается на результат задачи отменённого выражения,
+	// чтобы агент мог отбросить его
+	ErrTaskCancelled = errors.New("task was cancelled")
+	// ErrExpressionFinished возвращается при попытке отменить уже завершённое выражение
+	ErrExpressionFinished = errors.New("expression is already finished")
+	// ErrInvalidDeadline возвращается на отрицательный timeout_ms или уже прошедший deadline
+	ErrInvalidDeadline = errors.New("invalid deadline")
+	// ErrInvalidResult возвращается на бесконечный результат или NaN: такое выражение
+	// нельзя было бы отдать клиенту в JSON
+	ErrInvalidResult = errors.New("task result must be a finite number")
+)
+
 type Service struct {
 	repo           Repository
 	operationTimes map[models.Operation]int64
+	leaseTimeout   time.Duration
+	scheduler      Scheduler
+	notifier       *taskNotifier
+	agents         *agentRegistry
+	agentTimeout   time.Duration
+	events         *EventBus
+	webhooks       *WebhookSender
+	idempotencyTTL time.Duration
+	now            func() time.Time
 }
 
-func NewService(repo Repository, operationTimes map[models.Operation]int64) *Service {
+// leaseTimeout - запас времени сверх OperationTime, после которого
+// невозвращённая агентом задача снова выдаётся другим агентам
+func NewService(repo Repository, operationTimes map[models.Operation]int64, leaseTimeout time.Duration) *Service {
 	return &Service{
 		repo:           repo,
 		operationTimes: operationTimes,
+		leaseTimeout:   leaseTimeout,
+		scheduler:      NewFairScheduler(),
+		notifier:       newTaskNotifier(),
+		agents:         newAgentRegistry(),
+		agentTimeout:   defaultAgentTimeout,
+		events:         NewEventBus(),
+		webhooks:       NewWebhookSender("", defaultWebhookAttempts, defaultWebhookBackoff),
+		idempotencyTTL: defaultIdempotencyTTL,
+		now:            time.Now,
 	}
 }
 
+// SetScheduler меняет порядок выдачи задач агентам
+func (s *Service) SetScheduler(scheduler Scheduler) {
+	s.scheduler = scheduler
+}
+
+// SetClock подменяет источник времени для сроков выражений (используется в тестах)
+func (s *Service) SetClock(now func() time.Time) {
+	s.now = now
+}
+
 func (s *Service) ProcessExpression(expr string) (*models.Expression, error) {
-	expressionID := uuid.New().String()
+	return s.ProcessRequest(models.CalculateRequest{Expression: expr})
+}
 
-	expression := &models.Expression{
-		ID:         expressionID,
-		Expression: expr,
-		Status:     models.StatusProcessing,
+func (s *Service) ProcessRequest(request models.CalculateRequest) (*models.Expression, error) {
+	return s.processRequest(uuid.New().String(), request)
+}
+
+func (s *Service) processRequest(expressionID string, request models.CalculateRequest) (*models.Expression, error) {
+	expression, err := s.newExpression(expressionID, request)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := s.repo.SaveExpression(expression); err != nil {
 		return nil, fmt.Errorf("failed to save expression: %w", err)
 	}
 
-	tasks, err := calculator.ParseExpression(expressionID, expr, s.operationTimes)
+	plan, err := calculator.Compile(expressionID, request.Expression, s.operationTimes)
 	if err != nil {
 		expression.Status = models.StatusError
 		expression.Error = err.Error()
@@ -42,31 +94,78 @@ func (s *Service) ProcessExpression(expr string) (*models.Expression, error) {
 		return nil, fmt.Errorf("failed to parse expression: %w", err)
 	}
 
+	if err := s.startExpression(expression, plan); err != nil {
+		return nil, err
+	}
+	s.deliverResult(expression)
+
+	return expression, nil
+}
+
+// newExpression проверяет сроки и callback_url запроса и возвращает ещё не сохранённое выражение
+func (s *Service) newExpression(expressionID string, request models.CalculateRequest) (*models.Expression, error) {
+	deadline, err := s.deadline(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCallbackURL(request.CallbackURL); err != nil {
+		return nil, err
+	}
+
+	return &models.Expression{
+		ID:          expressionID,
+		Expression:  request.Expression,
+		Status:      models.StatusProcessing,
+		Deadline:    deadline,
+		Priority:    clampPriority(request.Priority),
+		ClientID:    request.ClientID,
+		SubmittedAt: s.now(),
+		CallbackURL: request.CallbackURL,
+	}, nil
+}
+
+// startExpression сохраняет задачи плана сохранённого выражения. Выражение без задач
+// сразу завершается; отправить его итог на callback_url должен вызывающий.
+func (s *Service) startExpression(expression *models.Expression, plan *calculator.Plan) error {
+	tasks := plan.Tasks
 	if len(tasks) == 0 {
-		value, err := strconv.ParseFloat(expr, 64)
+		value, err := strconv.ParseFloat(plan.Root, 64)
 		if err != nil {
 			expression.Status = models.StatusError
 			expression.Error = "Invalid expression"
 			_ = s.repo.UpdateExpression(expression)
-			return nil, fmt.Errorf("invalid expression: %s", expr)
+			return fmt.Errorf("invalid expression: %s", expression.Expression)
 		}
 
 		expression.Status = models.StatusCompleted
 		expression.Result = &value
 		_ = s.repo.UpdateExpression(expression)
-		return expression, nil
+		return nil
+	}
+
+	// Выражение считается посчитанным, когда будет готов результат корневой задачи
+	expression.RootTaskID = plan.Root
+	if err := s.repo.UpdateExpression(expression); err != nil {
+		return fmt.Errorf("failed to update expression: %w", err)
 	}
 
 	for _, task := range tasks {
+		task.Priority = expression.Priority
+		task.ClientID = expression.ClientID
+		task.SubmittedAt = expression.SubmittedAt
+
 		if err := s.repo.SaveTask(task); err != nil {
 			expression.Status = models.StatusError
 			expression.Error = err.Error()
 			_ = s.repo.UpdateExpression(expression)
-			return nil, fmt.Errorf("failed to save task: %w", err)
+			return fmt.Errorf("failed to save task: %w", err)
 		}
 	}
 
-	return expression, nil
+	// Будим агентов, ожидающих задачи в WaitForTask
+	s.notifier.Notify()
+
+	return nil
 }
 
 func (s *Service) GetExpressionByID(id string) (*models.Expression, error) {
@@ -78,30 +177,206 @@ func (s *Service) GetAllExpressions() ([]*models.Expression, error) {
 }
 
 func (s *Service) GetTaskForProcessing() (*models.Task, error) {
-	readyTasks, err := s.repo.GetReadyTasks()
+	task, err := s.scheduler.Next(s.repo, s.leaseTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get ready tasks: %w", err)
+		return nil, fmt.Errorf("failed to lease task: %w", err)
 	}
 
-	if len(readyTasks) == 0 {
-		return nil, nil
+	if task != nil && task.Attempts > 1 {
+		log.Printf("Task %s lease expired, reassigning (attempt %d)", task.ID, task.Attempts)
 	}
 
-	return readyTasks[0], nil
+	return task, nil
 }
 
 func (s *Service) ProcessTaskResult(taskID string, result float64) error {
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return ErrInvalidResult
+	}
+
 	task, err := s.repo.GetTaskByID(taskID)
 	if err != nil {
 		return fmt.Errorf("failed to get task: %w", err)
 	}
+	s.agents.finish(taskID)
+
+	if task.Cancelled {
+		return ErrTaskCancelled
+	}
+	if task.Completed {
+		// Результат от агента, чья аренда истекла и задача уже посчитана повторно
+		return nil
+	}
+
+	completed, err := s.repo.CompleteTask(task.ID, result)
+	if errors.Is(err, ErrTaskNotAvailable) {
+		// Задачу успели посчитать или отменить: повторная проверка вернёт итог
+		return s.ProcessTaskResult(taskID, result)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update task: %w", err)
+	}
 
-	task.Completed = true
-	task.Result = &result
+	// Результат мог сделать готовыми зависящие задачи
+	s.notifier.Notify()
+	s.publish(task.ExpressionID)
+	// Итог отправляет только тот, чей результат завершил выражение
+	if completed != nil {
+		s.deliverResult(completed)
+	}
+
+	return nil
+}
+
+// ProcessTaskFailure переводит выражение в статус ошибки, если агент не смог
+// вычислить одну из его задач, и отменяет оставшиеся задачи выражения
+func (s *Service) ProcessTaskFailure(taskID string, message string) error {
+	task, err := s.repo.GetTaskByID(taskID)
+	if err != nil {
+		return fmt.Errorf("failed to get task: %w", err)
+	}
+	s.agents.finish(taskID)
+
+	if task.Cancelled {
+		return ErrTaskCancelled
+	}
+	if task.Completed {
+		return nil
+	}
 
-	if err := s.repo.UpdateTask(task); err != nil {
+	// Задача отменяется вместе с записью ошибки, поэтому её не выдадут другому агенту,
+	// а одновременные отмена или результат не будут перезаписаны
+	err = s.repo.FailTask(task.ID, message)
+	if errors.Is(err, ErrTaskNotAvailable) {
+		// Задачу успели посчитать или отменить: повторная проверка вернёт итог
+		return s.ProcessTaskFailure(taskID, message)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to update task: %w", err)
 	}
 
+	// Отменённое, просроченное или уже посчитанное выражение не переводим в ERROR
+	expression, err := s.repo.TransitionExpression(task.ExpressionID, models.StatusProcessing, models.StatusError, message)
+	if errors.Is(err, ErrExpressionStatusChanged) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update expression: %w", err)
+	}
+
+	if err := s.repo.CancelTasks(task.ExpressionID); err != nil {
+		return fmt.Errorf("failed to cancel tasks: %w", err)
+	}
+
+	log.Printf("Task %s failed: %s; expression %s cancelled", task.ID, message, task.ExpressionID)
+	s.publish(task.ExpressionID)
+	s.deliverResult(expression)
+
 	return nil
 }
+
+// renewLeases продлевает аренду задач, которые агент ещё вычисляет, и возвращает
+// среди них задачи отменённых выражений и неизвестные оркестратору задачи:
+// их вычисление можно прекратить
+func (s *Service) renewLeases(taskIDs []string) ([]string, error) {
+	cancelled := []string{}
+	for _, id := range taskIDs {
+		err := s.repo.RenewLease(id, s.leaseTimeout)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrTaskNotFound) {
+			// Например, задача выдана до перезапуска оркестратора без постоянного хранилища
+			cancelled = append(cancelled, id)
+			continue
+		}
+		if !errors.Is(err, ErrTaskNotAvailable) {
+			return nil, fmt.Errorf("failed to renew lease: %w", err)
+		}
+
+		// Аренда могла истечь раньше: тогда результат агента всё равно будет принят
+		task, err := s.repo.GetTaskByID(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get task: %w", err)
+		}
+		if task.Cancelled {
+			cancelled = append(cancelled, id)
+		}
+	}
+
+	return cancelled, nil
+}
+
+// CancelExpression останавливает вычисление выражения: его задачи больше не
+// выдаются агентам, а запоздавшие результаты отклоняются с ErrTaskCancelled.
+// Повторная отмена не считается ошибкой.
+func (s *Service) CancelExpression(id string) (*models.Expression, error) {
+	expression, err := s.repo.GetExpressionByID(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expression: %w", err)
+	}
+
+	if expression.Status == models.StatusCancelled {
+		return expression, nil
+	}
+	if expression.Status.Final() {
+		return nil, ErrExpressionFinished
+	}
+
+	// Статус меняем до отмены задач: если корневая задача посчитается в этот момент,
+	// выражение уже не будет в PROCESSING и не перейдёт в COMPLETED. И наоборот,
+	// выражение, успевшее завершиться после чтения, отмена не перезапишет.
+	expression, err = s.repo.TransitionExpression(id, models.StatusProcessing, models.StatusCancelled, "")
+	if errors.Is(err, ErrExpressionStatusChanged) {
+		return s.CancelExpression(id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update expression: %w", err)
+	}
+
+	if err := s.repo.CancelTasks(id); err != nil {
+		return nil, fmt.Errorf("failed to cancel tasks: %w", err)
+	}
+
+	log.Printf("Expression %s cancelled", id)
+	s.publish(id)
+	s.deliverResult(expression)
+
+	return expression, nil
+}
+
+// clampPriority ограничивает приоритет, чтобы клиент не мог бесконечно обгонять остальных
+func clampPriority(priority int) int {
+	if priority < models.MinPriority {
+		return models.MinPriority
+	}
+	if priority > models.MaxPriority {
+		return models.MaxPriority
+	}
+	return priority
+}
+
+// deadline вычисляет срок выражения из timeout_ms и deadline запроса
+func (s *Service) deadline(request models.CalculateRequest) (*time.Time, error) {
+	if request.TimeoutMs < 0 {
+		return nil, fmt.Errorf("%w: timeout_ms must not be negative", ErrInvalidDeadline)
+	}
+
+	now := s.now()
+	var deadline *time.Time
+	if request.TimeoutMs > 0 {
+		timeoutDeadline := now.Add(time.Duration(request.TimeoutMs) * time.Millisecond)
+		deadline = &timeoutDeadline
+	}
+	if request.Deadline != nil {
+		if !request.Deadline.After(now) {
+			return nil, fmt.Errorf("%w: deadline %s has already passed", ErrInvalidDeadline, request.Deadline.Format(time.RFC3339))
+		}
+		if deadline == nil || request.Deadline.Before(*deadline) {
+			requestDeadline := *request.Deadline
+			deadline = &requestDeadline
+		}
+	}
+
+	return deadline, nil
+}
@@ -0,0 +1,654 @@
+package orchestrator
+
+import (
+	"context"
+	"distributed-calculator/internal/models"
+	"errors"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaskFailureFailsExpression(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+
+	expression, err := service.ProcessExpression("1 / 0 + 2 * 3")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	var division *models.Task
+	for {
+		task, _ := service.GetTaskForProcessing()
+		if task == nil {
+			break
+		}
+		if task.Operation == models.Division {
+			division = task
+		}
+	}
+	if division == nil {
+		t.Fatalf("Division task was not handed out")
+	}
+
+	if err := service.ProcessTaskFailure(division.ID, "division by zero"); err != nil {
+		t.Fatalf("Failed to process task failure: %v", err)
+	}
+
+	stored, _ := service.GetExpressionByID(expression.ID)
+	if stored.Status != models.StatusError || stored.Error != "division by zero" {
+		t.Errorf("Expected expression to fail with agent error, got %+v", stored)
+	}
+
+	// Оставшиеся задачи выражения больше не выдаются, даже после истечения аренды
+	readyTasks, _ := repo.GetReadyTasks()
+	if len(readyTasks) != 0 {
+		t.Errorf("Expected remaining tasks to be cancelled, got %d ready tasks", len(readyTasks))
+	}
+	for _, taskID := range repo.tasksByExprID[expression.ID] {
+		task, _ := repo.GetTaskByID(taskID)
+		if !task.Cancelled {
+			t.Errorf("Task %s %s was not cancelled", task.ID, task.Operation)
+		}
+	}
+
+	// Запоздавший результат отменённой задачи отклоняется и не меняет статус выражения
+	if err := service.ProcessTaskResult(division.ID, 1); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Expected ErrTaskCancelled for late result, got %v", err)
+	}
+	stored, _ = service.GetExpressionByID(expression.ID)
+	if stored.Status != models.StatusError {
+		t.Errorf("Expected expression to stay in ERROR, got %s", stored.Status)
+	}
+}
+
+func TestTaskFailureKeepsFinishedExpression(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+
+	expression, err := service.ProcessExpression("1 / 0")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, _ := service.GetTaskForProcessing()
+	if task == nil {
+		t.Fatalf("Expected a task to be handed out")
+	}
+
+	// Ошибка агента пришла, когда выражение уже просрочено, но задачи ещё не отменены
+	if _, err := repo.TransitionExpression(expression.ID, models.StatusProcessing, models.StatusTimeout, deadlineExceededMessage); err != nil {
+		t.Fatalf("Failed to expire expression: %v", err)
+	}
+	if err := service.ProcessTaskFailure(task.ID, "division by zero"); err != nil {
+		t.Fatalf("Failed to process task failure: %v", err)
+	}
+
+	stored, _ := service.GetExpressionByID(expression.ID)
+	if stored.Status != models.StatusTimeout || stored.Error != deadlineExceededMessage {
+		t.Errorf("Expected expression to stay timed out, got %+v", stored)
+	}
+}
+
+// cancellingRepository вызывает between после чтения задачи, как если бы
+// выражение отменили, пока обрабатывается ошибка агента
+type cancellingRepository struct {
+	Repository
+	between func()
+}
+
+func (r *cancellingRepository) GetTaskByID(id string) (*models.Task, error) {
+	task, err := r.Repository.GetTaskByID(id)
+	if r.between != nil {
+		between := r.between
+		r.between = nil
+		between()
+	}
+	return task, err
+}
+
+func TestTaskFailureKeepsConcurrentCancellation(t *testing.T) {
+	inner, clock := newTestRepository()
+	repo := &cancellingRepository{Repository: inner}
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+
+	expression, err := service.ProcessExpression("1 / 0")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, _ := service.GetTaskForProcessing()
+	if task == nil {
+		t.Fatalf("Expected a task to be handed out")
+	}
+
+	repo.between = func() {
+		if _, err := service.CancelExpression(expression.ID); err != nil {
+			t.Errorf("Failed to cancel expression: %v", err)
+		}
+	}
+	if err := service.ProcessTaskFailure(task.ID, "division by zero"); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Expected ErrTaskCancelled, got %v", err)
+	}
+
+	stored, _ := inner.GetTaskByID(task.ID)
+	if !stored.Cancelled || stored.Error != "" {
+		t.Errorf("Expected task to stay cancelled without error, got %+v", stored)
+	}
+	// Отменённая задача не возвращается в очередь и после срока аренды
+	clock.Advance(time.Hour)
+	if next, _ := service.GetTaskForProcessing(); next != nil {
+		t.Errorf("Expected no tasks to be handed out, got %+v", next)
+	}
+	if stored, _ := service.GetExpressionByID(expression.ID); stored.Status != models.StatusCancelled {
+		t.Errorf("Expected expression to stay cancelled, got %+v", stored)
+	}
+}
+
+func TestProcessTaskResultRejectsNonFiniteResults(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+
+	expression, err := service.ProcessExpression("1e308 * 10")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, _ := service.GetTaskForProcessing()
+
+	for _, result := range []float64{math.Inf(1), math.Inf(-1), math.NaN()} {
+		if err := service.ProcessTaskResult(task.ID, result); !errors.Is(err, ErrInvalidResult) {
+			t.Errorf("Expected ErrInvalidResult for %g, got %v", result, err)
+		}
+	}
+	if stored, _ := service.GetExpressionByID(expression.ID); stored.Status != models.StatusProcessing || stored.Result != nil {
+		t.Errorf("Expected expression to stay in PROCESSING, got %+v", stored)
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+
+	expression, err := service.ProcessExpression("(1 + 2) * (3 + 4)")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	leased, _ := service.GetTaskForProcessing()
+	if leased == nil {
+		t.Fatalf("Expected a task to be handed out")
+	}
+
+	cancelled, err := service.CancelExpression(expression.ID)
+	if err != nil || cancelled.Status != models.StatusCancelled {
+		t.Fatalf("Failed to cancel expression: %+v (%v)", cancelled, err)
+	}
+
+	if task, _ := service.GetTaskForProcessing(); task != nil {
+		t.Errorf("Expected no tasks after cancellation, got %+v", task)
+	}
+	if err := service.ProcessTaskResult(leased.ID, 3); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Expected ErrTaskCancelled for late result, got %v", err)
+	}
+	if err := service.ProcessTaskFailure(leased.ID, "boom"); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Expected ErrTaskCancelled for late failure, got %v", err)
+	}
+
+	stored, _ := service.GetExpressionByID(expression.ID)
+	if stored.Status != models.StatusCancelled || stored.Error != "" {
+		t.Errorf("Expected expression to stay cancelled, got %+v", stored)
+	}
+
+	// Повторная отмена идемпотентна, а посчитанное выражение отменить нельзя
+	if _, err := service.CancelExpression(expression.ID); err != nil {
+		t.Errorf("Expected repeated cancellation to succeed, got %v", err)
+	}
+	finished, _ := service.ProcessExpression("2 + 2")
+	runAgents(t, service, 1)
+	if _, err := service.CancelExpression(finished.ID); !errors.Is(err, ErrExpressionFinished) {
+		t.Errorf("Expected ErrExpressionFinished, got %v", err)
+	}
+}
+
+func TestExpressionDeadlines(t *testing.T) {
+	repo, clock := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	service.SetClock(clock.Now)
+
+	deadline := clock.Now().Add(2 * time.Second)
+	tests := []struct {
+		request  models.CalculateRequest
+		deadline *time.Time
+	}{
+		{models.CalculateRequest{Expression: "1 + 1"}, nil},
+		{models.CalculateRequest{Expression: "1 + 1", TimeoutMs: 5000}, timePtr(clock.Now().Add(5 * time.Second))},
+		{models.CalculateRequest{Expression: "1 + 1", Deadline: &deadline}, &deadline},
+		// Из двух сроков действует более ранний
+		{models.CalculateRequest{Expression: "1 + 1", TimeoutMs: 1000, Deadline: &deadline}, timePtr(clock.Now().Add(time.Second))},
+	}
+	for _, tt := range tests {
+		expression, err := service.ProcessRequest(tt.request)
+		if err != nil {
+			t.Fatalf("Failed to process request %+v: %v", tt.request, err)
+		}
+		if (expression.Deadline == nil) != (tt.deadline == nil) || (tt.deadline != nil && !expression.Deadline.Equal(*tt.deadline)) {
+			t.Errorf("Expected deadline %v for %+v, got %v", tt.deadline, tt.request, expression.Deadline)
+		}
+	}
+
+	past := clock.Now().Add(-time.Second)
+	for _, request := range []models.CalculateRequest{
+		{Expression: "1 + 1", TimeoutMs: -1},
+		{Expression: "1 + 1", Deadline: &past},
+	} {
+		if _, err := service.ProcessRequest(request); !errors.Is(err, ErrInvalidDeadline) {
+			t.Errorf("Expected ErrInvalidDeadline for %+v, got %v", request, err)
+		}
+	}
+}
+
+func TestExpireDeadlines(t *testing.T) {
+	repo, clock := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	service.SetClock(clock.Now)
+
+	slow, err := service.ProcessRequest(models.CalculateRequest{Expression: "(1 + 2) * (3 + 4)", TimeoutMs: 5000})
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	unbounded, _ := service.ProcessExpression("5 * 6")
+
+	task, _ := service.GetTaskForProcessing()
+	if task == nil || task.ExpressionID != slow.ID {
+		t.Fatalf("Expected a task of the first expression, got %+v", task)
+	}
+
+	clock.Advance(5*time.Second - time.Millisecond)
+	if expired, err := service.ExpireDeadlines(); err != nil || expired != 0 {
+		t.Fatalf("Expected no expired expressions before the deadline, got %d (%v)", expired, err)
+	}
+
+	clock.Advance(time.Millisecond)
+	if expired, err := service.ExpireDeadlines(); err != nil || expired != 1 {
+		t.Fatalf("Expected one expired expression, got %d (%v)", expired, err)
+	}
+
+	stored, _ := service.GetExpressionByID(slow.ID)
+	if stored.Status != models.StatusTimeout || stored.Error == "" {
+		t.Errorf("Expected expression to time out, got %+v", stored)
+	}
+
+	// Задачи просроченного выражения больше не выдаются, а результаты отклоняются
+	for {
+		next, _ := service.GetTaskForProcessing()
+		if next == nil {
+			break
+		}
+		if next.ExpressionID == slow.ID {
+			t.Errorf("Task %s of timed out expression was handed out", next.ID)
+		}
+	}
+	if err := service.ProcessTaskResult(task.ID, 3); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("Expected ErrTaskCancelled for late result, got %v", err)
+	}
+
+	// Просроченное выражение уже завершено, и отмена его не меняет
+	if _, err := service.CancelExpression(slow.ID); !errors.Is(err, ErrExpressionFinished) {
+		t.Errorf("Expected ErrExpressionFinished when cancelling timed out expression, got %v", err)
+	}
+	if stored, _ := service.GetExpressionByID(slow.ID); stored.Status != models.StatusTimeout {
+		t.Errorf("Expected expression to stay timed out, got %+v", stored)
+	}
+
+	stored, _ = service.GetExpressionByID(unbounded.ID)
+	if stored.Status != models.StatusProcessing {
+		t.Errorf("Expression without deadline must not expire, got %+v", stored)
+	}
+}
+
+// racingRepository вызывает between после выборки просроченных выражений,
+// как если бы агент успел вернуть результат до их обновления
+type racingRepository struct {
+	Repository
+	between func()
+}
+
+func (r *racingRepository) GetExpiredExpressions(now time.Time) ([]*models.Expression, error) {
+	expired, err := r.Repository.GetExpiredExpressions(now)
+	r.between()
+	return expired, err
+}
+
+func TestExpireDeadlinesKeepsConcurrentlyCompletedExpression(t *testing.T) {
+	inner, clock := newTestRepository()
+	repo := &racingRepository{Repository: inner}
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	service.SetClock(clock.Now)
+
+	expression, err := service.ProcessRequest(models.CalculateRequest{Expression: "1 + 1", TimeoutMs: 1000})
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, _ := service.GetTaskForProcessing()
+	if task == nil {
+		t.Fatalf("Expected a task to be handed out")
+	}
+
+	repo.between = func() {
+		if err := service.ProcessTaskResult(task.ID, 2); err != nil {
+			t.Errorf("Failed to process task result: %v", err)
+		}
+	}
+	clock.Advance(time.Second)
+	if expired, err := service.ExpireDeadlines(); err != nil || expired != 0 {
+		t.Errorf("Expected no expired expressions, got %d (%v)", expired, err)
+	}
+
+	stored, _ := service.GetExpressionByID(expression.ID)
+	if stored.Status != models.StatusCompleted || stored.Result == nil || *stored.Result != 2 {
+		t.Errorf("Expected completed expression to keep its result, got %+v", stored)
+	}
+}
+
+// failingRepository отказывает в сохранении выражений после saveLimit успешных и в сохранении пакетов
+type failingRepository struct {
+	Repository
+	saveLimit int
+	failBatch bool
+}
+
+func (r *failingRepository) SaveExpression(expression *models.Expression) error {
+	if r.saveLimit == 0 {
+		return errors.New("storage is unavailable")
+	}
+	r.saveLimit--
+	return r.Repository.SaveExpression(expression)
+}
+
+func (r *failingRepository) SaveBatch(batch *models.Batch) error {
+	if r.failBatch {
+		return errors.New("storage is unavailable")
+	}
+	return r.Repository.SaveBatch(batch)
+}
+
+func TestProcessBatchRollsBackOnStorageError(t *testing.T) {
+	requests := []models.BatchItemRequest{
+		{CalculateRequest: models.CalculateRequest{Expression: "1 + 2"}},
+		{CalculateRequest: models.CalculateRequest{Expression: "2 +"}},
+		{CalculateRequest: models.CalculateRequest{Expression: "3 * 4"}},
+	}
+
+	for name, repo := range map[string]*failingRepository{
+		"expression": {saveLimit: 1},
+		"batch":      {saveLimit: -1, failBatch: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			inner, _ := newTestRepository()
+			repo.Repository = inner
+			service := NewService(repo, map[models.Operation]int64{}, time.Second)
+
+			if _, err := service.ProcessBatch(requests); err == nil {
+				t.Fatalf("Expected storage error")
+			}
+
+			// Невалидное выражение не сохраняется, а созданные до ошибки отменены
+			expressions, _ := inner.GetAllExpressions()
+			if len(expressions) == 0 {
+				t.Fatalf("Expected the first expression to be created before the error")
+			}
+			for _, expression := range expressions {
+				if expression.Expression == "2 +" || expression.Status != models.StatusCancelled {
+					t.Errorf("Expected created expressions to be cancelled, got %+v", expression)
+				}
+			}
+			if task, _ := service.GetTaskForProcessing(); task != nil {
+				t.Errorf("Expected no tasks of a rolled back batch, got %+v", task)
+			}
+		})
+	}
+}
+
+func TestProcessBatchRollbackSendsNoWebhooks(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	inner, _ := newTestRepository()
+	service := NewService(&failingRepository{Repository: inner, saveLimit: -1, failBatch: true}, map[models.Operation]int64{}, time.Second)
+	service.SetWebhookSender(newTestWebhookSender(t, "secret", 5))
+
+	// Выражение без задач завершается сразу, но его итог не должен уйти до сохранения пакета
+	requests := []models.BatchItemRequest{
+		{CalculateRequest: models.CalculateRequest{Expression: "1 + 2", CallbackURL: server.URL}},
+		{CalculateRequest: models.CalculateRequest{Expression: "7", CallbackURL: server.URL}},
+	}
+	if _, err := service.ProcessBatch(requests); err == nil {
+		t.Fatalf("Expected storage error")
+	}
+
+	expressions, _ := inner.GetAllExpressions()
+	if len(expressions) != 2 {
+		t.Fatalf("Expected both expressions to be created, got %d", len(expressions))
+	}
+	for _, expression := range expressions {
+		if expression.Status != models.StatusCancelled {
+			t.Errorf("Expected created expressions to be cancelled, got %+v", expression)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.requests) != 0 {
+		t.Errorf("Expected no webhooks for a rolled back batch, got %d", len(receiver.requests))
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestWaitForTask(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+
+	expression, err := service.ProcessExpression("(1 + 2) * 3")
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	first, err := service.WaitForTask(context.Background(), "", time.Second)
+	if err != nil || first == nil {
+		t.Fatalf("Expected ready task to be returned immediately, got %+v (%v)", first, err)
+	}
+
+	// Зависимая задача станет готовой только после результата первой
+	result := make(chan *models.Task)
+	go func() {
+		task, err := service.WaitForTask(context.Background(), "", 10*time.Second)
+		if err != nil {
+			t.Errorf("Failed to wait for task: %v", err)
+		}
+		result <- task
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := service.ProcessTaskResult(first.ID, 3); err != nil {
+		t.Fatalf("Failed to process task result: %v", err)
+	}
+
+	select {
+	case task := <-result:
+		if task == nil || task.ID != expression.RootTaskID {
+			t.Errorf("Expected root task after its dependency completed, got %+v", task)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WaitForTask was not woken by the task result")
+	}
+
+	// Без задач ожидание заканчивается по таймауту или отмене контекста
+	start := time.Now()
+	if task, err := service.WaitForTask(context.Background(), "", 20*time.Millisecond); task != nil || err != nil {
+		t.Errorf("Expected no task, got %+v (%v)", task, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if task, err := service.WaitForTask(ctx, "", time.Minute); task != nil || err != nil {
+		t.Errorf("Expected no task after cancellation, got %+v (%v)", task, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Waiting did not stop on time, took %v", elapsed)
+	}
+}
+
+func TestExpressionCompletesWhenRootTaskFinishes(t *testing.T) {
+	// Глубокое выражение: ((((1 + 1) * 2 + 1) * 2 + 1) ...)
+	deep := "1"
+	deepResult := 1.0
+	for i := 0; i < 30; i++ {
+		deep = "(" + deep + " + 1) * 2"
+		deepResult = (deepResult + 1) * 2
+	}
+
+	// Широкое выражение: 1*1 + 2*2 + ... + 40*40
+	terms := []string{}
+	wideResult := 0.0
+	for i := 1; i <= 40; i++ {
+		terms = append(terms, fmt.Sprintf("%d * %d", i, i))
+		wideResult += float64(i * i)
+	}
+	wide := strings.Join(terms, " + ")
+
+	tests := []struct {
+		name       string
+		expression string
+		expected   float64
+	}{
+		{"simple", "2 + 2 * 2", 6},
+		{"deep", deep, deepResult},
+		{"wide", wide, wideResult},
+		{"negation", "-(2 + 3) * 4", -20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, _ := newTestRepository()
+			service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+
+			expression, err := service.ProcessExpression(tt.expression)
+			if err != nil {
+				t.Fatalf("Failed to process expression: %v", err)
+			}
+			if expression.RootTaskID == "" {
+				t.Fatalf("Root task is not recorded on expression")
+			}
+
+			runAgents(t, service, 1)
+
+			stored, _ := service.GetExpressionByID(expression.ID)
+			if stored.Status != models.StatusCompleted || stored.Result == nil || *stored.Result != tt.expected {
+				t.Errorf("Expected completed expression with result %g, got %+v", tt.expected, stored)
+			}
+		})
+	}
+}
+
+func TestExpressionsCompleteUnderConcurrentAgents(t *testing.T) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+
+	ids := []string{}
+	for i := 0; i < 20; i++ {
+		expression, err := service.ProcessExpression(fmt.Sprintf("(%d + 1) * (%d - 1) + %d * 2", i, i, i))
+		if err != nil {
+			t.Fatalf("Failed to process expression: %v", err)
+		}
+		ids = append(ids, expression.ID)
+	}
+
+	// Параллельно с агентами клиенты читают выражения
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, _ = service.GetAllExpressions()
+			}
+		}
+	}()
+
+	runAgents(t, service, 8)
+	close(done)
+
+	for i, id := range ids {
+		stored, _ := service.GetExpressionByID(id)
+		expected := float64((i+1)*(i-1) + i*2)
+		if stored.Status != models.StatusCompleted || stored.Result == nil || *stored.Result != expected {
+			t.Errorf("Expected expression %d to complete with %g, got %+v", i, expected, stored)
+		}
+	}
+}
+
+// runAgents имитирует workers агентов, пока у оркестратора есть задачи
+func runAgents(t *testing.T, service *Service, workers int) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			idle := 0
+			for idle < 100 {
+				task, err := service.GetTaskForProcessing()
+				if err != nil {
+					t.Errorf("Failed to get task: %v", err)
+					return
+				}
+				if task == nil {
+					idle++
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				idle = 0
+
+				if err := service.ProcessTaskResult(task.ID, evaluateTestTask(t, task)); err != nil {
+					t.Errorf("Failed to process task result: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func evaluateTestTask(t testing.TB, task *models.Task) float64 {
+	args := make([]float64, len(task.Args))
+	for i, arg := range task.Args {
+		value, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			t.Errorf("Unresolved argument %q in task %s", arg, task.ID)
+			return math.NaN()
+		}
+		args[i] = value
+	}
+
+	switch task.Operation {
+	case models.Addition:
+		return args[0] + args[1]
+	case models.Subtraction:
+		return args[0] - args[1]
+	case models.Multiplication:
+		return args[0] * args[1]
+	case models.Division:
+		return args[0] / args[1]
+	}
+	t.Errorf("Unexpected operation %s", task.Operation)
+	return math.NaN()
+}
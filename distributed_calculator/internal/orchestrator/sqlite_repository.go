@@ -0,0 +1,1096 @@
+package orchestrator
+
+import (
+	"database/sql"
+	"distributed-calculator/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations применяются по порядку; номер версии - индекс миграции плюс один.
+// Уже выпущенные миграции не меняются, новые добавляются в конец.
+var migrations = []string{
+	// Последний выданный ready_seq хранится в ready_seq_counter: индекс tasks_ready
+	// частичный, и MAX(ready_seq) по нему не посчитать
+	`CREATE TABLE expressions (
+		id           TEXT PRIMARY KEY,
+		expression   TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		result       REAL,
+		error        TEXT NOT NULL DEFAULT '',
+		root_task_id TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE tasks (
+		id               TEXT PRIMARY KEY,
+		expression_id    TEXT NOT NULL,
+		args             TEXT NOT NULL,
+		dependencies     TEXT NOT NULL,
+		operation        TEXT NOT NULL,
+		operation_time   INTEGER NOT NULL,
+		result           REAL,
+		completed        INTEGER NOT NULL DEFAULT 0,
+		cancelled        INTEGER NOT NULL DEFAULT 0,
+		error            TEXT NOT NULL DEFAULT '',
+		lease_expires_at INTEGER,
+		attempts         INTEGER NOT NULL DEFAULT 0,
+		pending_deps     INTEGER NOT NULL DEFAULT 0,
+		ready_seq        INTEGER
+	);
+	CREATE INDEX tasks_expression_id ON tasks (expression_id);
+	CREATE INDEX tasks_ready ON tasks (ready_seq) WHERE completed = 0 AND cancelled = 0 AND pending_deps = 0;
+	CREATE TABLE task_dependencies (
+		task_id    TEXT NOT NULL,
+		depends_on TEXT NOT NULL,
+		PRIMARY KEY (task_id, depends_on)
+	);
+	CREATE INDEX task_dependencies_depends_on ON task_dependencies (depends_on);
+	CREATE TABLE ready_seq_counter (
+		id    INTEGER PRIMARY KEY CHECK (id = 1),
+		value INTEGER NOT NULL
+	);
+	INSERT INTO ready_seq_counter (id, value) VALUES (1, 0);`,
+	`ALTER TABLE expressions ADD COLUMN deadline INTEGER;
+	CREATE INDEX expressions_deadline ON expressions (deadline) WHERE status = 'PROCESSING' AND deadline IS NOT NULL;`,
+	`ALTER TABLE expressions ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE expressions ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE expressions ADD COLUMN submitted_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tasks ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tasks ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE tasks ADD COLUMN submitted_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX tasks_ready_lanes ON tasks (priority, client_id, submitted_at, ready_seq) WHERE completed = 0 AND cancelled = 0 AND pending_deps = 0;`,
+	`ALTER TABLE tasks ADD COLUMN rank INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX tasks_ready_rank ON tasks (rank DESC, ready_seq) WHERE completed = 0 AND cancelled = 0 AND pending_deps = 0;`,
+	`ALTER TABLE expressions ADD COLUMN callback_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE expressions ADD COLUMN deliveries TEXT NOT NULL DEFAULT '[]';`,
+	`CREATE TABLE batches (
+		id         TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE batch_items (
+		batch_id      TEXT NOT NULL,
+		position      INTEGER NOT NULL,
+		item_key      TEXT NOT NULL DEFAULT '',
+		expression_id TEXT NOT NULL DEFAULT '',
+		error         TEXT NOT NULL DEFAULT '',
+		error_column  INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (batch_id, position)
+	);`,
+	// Ключи идемпотентности принадлежат клиенту
+	`CREATE TABLE idempotency_keys (
+		client_id       TEXT NOT NULL DEFAULT '',
+		idempotency_key TEXT NOT NULL,
+		request_hash    TEXT NOT NULL,
+		expression_id   TEXT NOT NULL,
+		created_at      INTEGER NOT NULL,
+		expires_at      INTEGER NOT NULL,
+		PRIMARY KEY (client_id, idempotency_key)
+	);
+	CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at);`,
+}
+
+// SQLiteRepository хранит выражения и задачи в файле SQLite, чтобы они
+// переживали перезапуск оркестратора. Как и InMemoryRepository, ведёт счётчик
+// непосчитанных зависимостей задачи (pending_deps) и порядковый номер готовности
+// (ready_seq), так что выдача задачи - это выборка по индексу.
+type SQLiteRepository struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func NewSQLiteRepository(path string) (*SQLiteRepository, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// SQLite допускает одного писателя; одно соединение сериализует
+	// транзакции и исключает SQLITE_BUSY между ними
+	db.SetMaxOpenConns(1)
+
+	repo := &SQLiteRepository{
+		db:  db,
+		now: time.Now,
+	}
+
+	if err := repo.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+func (r *SQLiteRepository) Close() error {
+	return r.db.Close()
+}
+
+// SetClock подменяет источник текущего времени, по которому истекают аренды задач
+func (r *SQLiteRepository) SetClock(now func() time.Time) {
+	r.now = now
+}
+
+func (r *SQLiteRepository) migrate() error {
+	if _, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var version int
+	if err := r.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err := r.inTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(migrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) SaveExpression(expression *models.Expression) error {
+	deliveries, err := encodeDeliveries(expression.Deliveries)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(
+		`INSERT INTO expressions (id, expression, status, result, error, root_task_id, deadline, priority, client_id, submitted_at,
+			callback_url, deliveries)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		expression.ID, expression.Expression, expression.Status, expression.Result, expression.Error, expression.RootTaskID,
+		unixNanoOrNil(expression.Deadline), expression.Priority, expression.ClientID, unixNanoOrZero(expression.SubmittedAt),
+		expression.CallbackURL, deliveries,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert expression: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) UpdateExpression(expression *models.Expression) error {
+	res, err := r.db.Exec(
+		`UPDATE expressions SET expression = ?, status = ?, result = ?, error = ?, root_task_id = ?, deadline = ?,
+			priority = ?, client_id = ?, submitted_at = ?, callback_url = ?
+		WHERE id = ?`,
+		expression.Expression, expression.Status, expression.Result, expression.Error, expression.RootTaskID,
+		unixNanoOrNil(expression.Deadline), expression.Priority, expression.ClientID, unixNanoOrZero(expression.SubmittedAt),
+		expression.CallbackURL, expression.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update expression: %w", err)
+	}
+	return expectAffected(res, fmt.Errorf("expression with ID %s not found", expression.ID))
+}
+
+func (r *SQLiteRepository) TransitionExpression(id string, from, to models.ExpressionStatus, message string) (*models.Expression, error) {
+	var expression *models.Expression
+	err := r.inTx(func(tx *sql.Tx) error {
+		var err error
+		expression, err = scanExpression(tx.QueryRow(`SELECT `+expressionColumns+` FROM expressions WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("expression with ID %s not found", id)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get expression: %w", err)
+		}
+		if expression.Status != from {
+			return ErrExpressionStatusChanged
+		}
+
+		if _, err := tx.Exec(`UPDATE expressions SET status = ?, error = ? WHERE id = ?`, to, message, id); err != nil {
+			return fmt.Errorf("failed to update expression status: %w", err)
+		}
+		expression.Status = to
+		expression.Error = message
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expression, nil
+}
+
+const expressionColumns = `id, expression, status, result, error, root_task_id, deadline, priority, client_id, submitted_at,
+	callback_url, deliveries`
+
+func (r *SQLiteRepository) GetExpressionByID(id string) (*models.Expression, error) {
+	row := r.db.QueryRow(`SELECT `+expressionColumns+` FROM expressions WHERE id = ?`, id)
+
+	expression, err := scanExpression(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("expression with ID %s not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expression: %w", err)
+	}
+
+	return expression, nil
+}
+
+func (r *SQLiteRepository) GetAllExpressions() ([]*models.Expression, error) {
+	rows, err := r.db.Query(`SELECT ` + expressionColumns + ` FROM expressions ORDER BY rowid`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expressions: %w", err)
+	}
+	return scanExpressions(rows)
+}
+
+func (r *SQLiteRepository) GetExpiredExpressions(now time.Time) ([]*models.Expression, error) {
+	rows, err := r.db.Query(
+		`SELECT `+expressionColumns+` FROM expressions WHERE status = 'PROCESSING' AND deadline IS NOT NULL AND deadline <= ? ORDER BY deadline`,
+		now.UnixNano(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired expressions: %w", err)
+	}
+	return scanExpressions(rows)
+}
+
+func (r *SQLiteRepository) RecordDelivery(expressionID string, delivery models.WebhookDelivery) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		var encoded string
+		err := tx.QueryRow(`SELECT deliveries FROM expressions WHERE id = ?`, expressionID).Scan(&encoded)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("expression with ID %s not found", expressionID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get deliveries: %w", err)
+		}
+
+		var deliveries []models.WebhookDelivery
+		if err := json.Unmarshal([]byte(encoded), &deliveries); err != nil {
+			return fmt.Errorf("failed to decode deliveries: %w", err)
+		}
+
+		encoded, err = encodeDeliveries(append(deliveries, delivery))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE expressions SET deliveries = ? WHERE id = ?`, encoded, expressionID); err != nil {
+			return fmt.Errorf("failed to record delivery: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *SQLiteRepository) SaveBatch(batch *models.Batch) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO batches (id, created_at) VALUES (?, ?)`, batch.ID, unixNanoOrZero(batch.CreatedAt)); err != nil {
+			return fmt.Errorf("failed to insert batch: %w", err)
+		}
+
+		insert, err := tx.Prepare(
+			`INSERT INTO batch_items (batch_id, position, item_key, expression_id, error, error_column) VALUES (?, ?, ?, ?, ?, ?)`,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to prepare batch item insert: %w", err)
+		}
+		defer insert.Close()
+
+		for i, item := range batch.Items {
+			if _, err := insert.Exec(batch.ID, i, item.Key, item.ExpressionID, item.Error, item.Column); err != nil {
+				return fmt.Errorf("failed to insert batch item: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *SQLiteRepository) GetBatchByID(id string) (*models.Batch, error) {
+	batch := &models.Batch{ID: id, Items: []models.BatchItem{}}
+	var createdAt int64
+	err := r.db.QueryRow(`SELECT created_at FROM batches WHERE id = ?`, id).Scan(&createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrBatchNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get batch: %w", err)
+	}
+	batch.CreatedAt = timeFromUnixNano(createdAt)
+
+	rows, err := r.db.Query(
+		`SELECT item_key, expression_id, error, error_column FROM batch_items WHERE batch_id = ? ORDER BY position`, id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list batch items: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.BatchItem
+		if err := rows.Scan(&item.Key, &item.ExpressionID, &item.Error, &item.Column); err != nil {
+			return nil, fmt.Errorf("failed to scan batch item: %w", err)
+		}
+		batch.Items = append(batch.Items, item)
+	}
+
+	return batch, rows.Err()
+}
+
+func (r *SQLiteRepository) GetBatchExpressions(batchID string) ([]*models.Expression, error) {
+	rows, err := r.db.Query(
+		`SELECT `+expressionColumns+` FROM expressions
+		WHERE id IN (SELECT expression_id FROM batch_items WHERE batch_id = ?)`,
+		batchID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list batch expressions: %w", err)
+	}
+	return scanExpressions(rows)
+}
+
+func (r *SQLiteRepository) ReserveIdempotencyKey(key *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	var existing *models.IdempotencyKey
+	err := r.inTx(func(tx *sql.Tx) error {
+		var reserved models.IdempotencyKey
+		var createdAt, expiresAt int64
+		err := tx.QueryRow(
+			`SELECT client_id, idempotency_key, request_hash, expression_id, created_at, expires_at FROM idempotency_keys
+			WHERE client_id = ? AND idempotency_key = ?`,
+			key.ClientID, key.Key,
+		).Scan(&reserved.ClientID, &reserved.Key, &reserved.RequestHash, &reserved.ExpressionID, &createdAt, &expiresAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get idempotency key: %w", err)
+		}
+		if err == nil && key.CreatedAt.UnixNano() < expiresAt {
+			reserved.CreatedAt = timeFromUnixNano(createdAt)
+			reserved.ExpiresAt = timeFromUnixNano(expiresAt)
+			existing = &reserved
+			return nil
+		}
+
+		_, err = tx.Exec(
+			`INSERT OR REPLACE INTO idempotency_keys (client_id, idempotency_key, request_hash, expression_id, created_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			key.ClientID, key.Key, key.RequestHash, key.ExpressionID, unixNanoOrZero(key.CreatedAt), unixNanoOrZero(key.ExpiresAt),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to reserve idempotency key: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (r *SQLiteRepository) DeleteIdempotencyKey(clientID, key string) error {
+	if _, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE client_id = ? AND idempotency_key = ?`, clientID, key); err != nil {
+		return fmt.Errorf("failed to delete idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteExpiredIdempotencyKeys(now time.Time) (int, error) {
+	res, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count deleted idempotency keys: %w", err)
+	}
+	return int(deleted), nil
+}
+
+func encodeDeliveries(deliveries []models.WebhookDelivery) (string, error) {
+	if deliveries == nil {
+		deliveries = []models.WebhookDelivery{}
+	}
+	encoded, err := json.Marshal(deliveries)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode deliveries: %w", err)
+	}
+	return string(encoded), nil
+}
+
+func scanExpressions(rows *sql.Rows) ([]*models.Expression, error) {
+	defer rows.Close()
+
+	expressions := []*models.Expression{}
+	for rows.Next() {
+		expression, err := scanExpression(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan expression: %w", err)
+		}
+		expressions = append(expressions, expression)
+	}
+
+	return expressions, rows.Err()
+}
+
+func (r *SQLiteRepository) SaveTask(task *models.Task) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		pending := 0
+		for _, depID := range task.Dependencies {
+			var completed bool
+			err := tx.QueryRow(`SELECT completed FROM tasks WHERE id = ?`, depID).Scan(&completed)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("failed to check dependency %s: %w", depID, err)
+			}
+			if !completed {
+				pending++
+			}
+			if _, err := tx.Exec(`INSERT INTO task_dependencies (task_id, depends_on) VALUES (?, ?)`, task.ID, depID); err != nil {
+				return fmt.Errorf("failed to insert dependency: %w", err)
+			}
+		}
+
+		args, err := json.Marshal(task.Args)
+		if err != nil {
+			return fmt.Errorf("failed to encode args: %w", err)
+		}
+		dependencies, err := json.Marshal(task.Dependencies)
+		if err != nil {
+			return fmt.Errorf("failed to encode dependencies: %w", err)
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO tasks (id, expression_id, args, dependencies, operation, operation_time, result,
+				completed, cancelled, error, lease_expires_at, attempts, priority, client_id, submitted_at, rank, pending_deps)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			task.ID, task.ExpressionID, string(args), string(dependencies), task.Operation, task.OperationTime, task.Result,
+			task.Completed, task.Cancelled, task.Error, unixNanoOrNil(task.LeaseExpiresAt), task.Attempts,
+			task.Priority, task.ClientID, unixNanoOrZero(task.SubmittedAt), task.Rank, pending,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert task: %w", err)
+		}
+
+		if pending == 0 {
+			if err := markReady(tx, task.ID); err != nil {
+				return err
+			}
+		}
+
+		if task.Completed {
+			return releaseDependents(tx, task.ID)
+		}
+		return nil
+	})
+}
+
+// UpdateTask сохраняет задачу и в той же транзакции продвигает зависящие от неё задачи
+// и, если это корневая задача, завершает выражение
+func (r *SQLiteRepository) UpdateTask(task *models.Task) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		var wasCompleted bool
+		err := tx.QueryRow(`SELECT completed FROM tasks WHERE id = ?`, task.ID).Scan(&wasCompleted)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrTaskNotFound, task.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get task: %w", err)
+		}
+
+		_, err = tx.Exec(
+			`UPDATE tasks SET result = ?, completed = ?, cancelled = ?, error = ?, lease_expires_at = ?, attempts = ?,
+				priority = ?, client_id = ?, submitted_at = ?, rank = ?
+			WHERE id = ?`,
+			task.Result, task.Completed, task.Cancelled, task.Error, unixNanoOrNil(task.LeaseExpiresAt), task.Attempts,
+			task.Priority, task.ClientID, unixNanoOrZero(task.SubmittedAt), task.Rank, task.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update task: %w", err)
+		}
+
+		if !task.Completed || wasCompleted {
+			return nil
+		}
+
+		if err := releaseDependents(tx, task.ID); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`UPDATE expressions SET status = ?, result = ? WHERE id = ? AND root_task_id = ? AND status = ?`,
+			models.StatusCompleted, task.Result, task.ExpressionID, task.ID, models.StatusProcessing,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to complete expression: %w", err)
+		}
+		return nil
+	})
+}
+
+const taskColumns = `id, expression_id, args, dependencies, operation, operation_time, result,
+	completed, cancelled, error, lease_expires_at, attempts, priority, client_id, submitted_at, rank`
+
+func (r *SQLiteRepository) GetTaskByID(id string) (*models.Task, error) {
+	task, err := scanTask(r.db.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task: %w", err)
+	}
+	return task, nil
+}
+
+// readyIndexCondition - условие частичных индексов готовых задач
+const readyIndexCondition = `completed = 0 AND cancelled = 0 AND pending_deps = 0`
+
+const readyCondition = readyIndexCondition + `
+	AND (lease_expires_at IS NULL OR lease_expires_at <= ?)`
+
+func (r *SQLiteRepository) CountTasks(expressionID string) (int, int, error) {
+	var completed, total int
+	err := r.db.QueryRow(`SELECT COALESCE(SUM(completed), 0), COUNT(*) FROM tasks WHERE expression_id = ?`, expressionID).Scan(&completed, &total)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to count tasks: %w", err)
+	}
+	return completed, total, nil
+}
+
+func (r *SQLiteRepository) GetReadyTasks() ([]*models.Task, error) {
+	return r.queryReadyTasks(`SELECT `+taskColumns+` FROM tasks WHERE `+readyCondition+` ORDER BY ready_seq`, r.now().UnixNano())
+}
+
+// readyLanes перебирает дорожки (приоритет, клиент) по индексу tasks_ready_lanes:
+// каждая следующая дорожка находится поиском по индексу, а не просмотром всех готовых задач
+const readyLanes = `WITH RECURSIVE lanes (id) AS (
+		SELECT (SELECT id FROM tasks WHERE ` + readyIndexCondition + ` ORDER BY priority, client_id LIMIT 1)
+		UNION ALL
+		SELECT COALESCE(
+			(
+				SELECT next.id FROM tasks next
+				WHERE ` + readyIndexCondition + ` AND next.priority = lane.priority AND next.client_id > lane.client_id
+				ORDER BY next.client_id LIMIT 1
+			),
+			(
+				SELECT next.id FROM tasks next
+				WHERE ` + readyIndexCondition + ` AND next.priority > lane.priority
+				ORDER BY next.priority, next.client_id LIMIT 1
+			)
+		)
+		FROM lanes JOIN tasks lane ON lane.id = lanes.id
+	)`
+
+func (r *SQLiteRepository) GetReadyHeads() ([]*models.Task, error) {
+	// Голова дорожки - её первая задача, не удерживаемая агентом: арендованные задачи
+	// остаются в индексе, но их в дорожке не больше, чем агентов
+	return r.queryReadyTasks(
+		readyLanes+`
+		SELECT `+taskColumns+` FROM tasks WHERE id IN (
+			SELECT (
+				SELECT head.id FROM tasks head
+				WHERE head.priority = lane.priority AND head.client_id = lane.client_id AND `+readyCondition+`
+				ORDER BY head.submitted_at, head.ready_seq LIMIT 1
+			)
+			FROM lanes JOIN tasks lane ON lane.id = lanes.id
+		)`,
+		r.now().UnixNano(),
+	)
+}
+
+// queryReadyTasks выбирает задачи запросом query и подставляет в их аргументы результаты зависимостей
+func (r *SQLiteRepository) queryReadyTasks(query string, args ...interface{}) ([]*models.Task, error) {
+	var readyTasks []*models.Task
+
+	err := r.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to list ready tasks: %w", err)
+		}
+
+		readyTasks = []*models.Task{}
+		for rows.Next() {
+			task, err := scanTask(rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan task: %w", err)
+			}
+			readyTasks = append(readyTasks, task)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, task := range readyTasks {
+			if err := resolveArgs(tx, task); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return readyTasks, err
+}
+
+func (r *SQLiteRepository) LeaseTask(id string, timeout time.Duration) (*models.Task, error) {
+	var task *models.Task
+
+	err := r.inTx(func(tx *sql.Tx) error {
+		now := r.now()
+
+		var err error
+		task, err = scanTask(tx.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get task: %w", err)
+		}
+
+		var ready bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM tasks WHERE id = ? AND `+readyCondition+`)`, id, now.UnixNano()).Scan(&ready)
+		if err != nil {
+			return fmt.Errorf("failed to check task: %w", err)
+		}
+		if !ready {
+			return ErrTaskNotAvailable
+		}
+
+		return leaseTask(tx, task, now, timeout)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return task, nil
+}
+
+func (r *SQLiteRepository) LeaseNextTask(timeout time.Duration) (*models.Task, error) {
+	return r.leaseFirst(`ready_seq`, timeout)
+}
+
+func (r *SQLiteRepository) LeaseCriticalTask(timeout time.Duration) (*models.Task, error) {
+	return r.leaseFirst(`rank DESC, ready_seq`, timeout)
+}
+
+func (r *SQLiteRepository) RenewLease(id string, timeout time.Duration) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		now := r.now()
+
+		task, err := leasedTask(tx, id, now)
+		if err != nil {
+			return err
+		}
+
+		leaseExpiresAt := now.Add(timeout)
+		if !leaseExpiresAt.After(*task.LeaseExpiresAt) {
+			return nil
+		}
+
+		_, err = tx.Exec(`UPDATE tasks SET lease_expires_at = ? WHERE id = ?`, leaseExpiresAt.UnixNano(), id)
+		if err != nil {
+			return fmt.Errorf("failed to renew lease: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *SQLiteRepository) ReleaseTask(id string) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		if _, err := leasedTask(tx, id, r.now()); err != nil {
+			return err
+		}
+
+		// ready_seq не меняется: задача возвращается на своё место в очереди
+		_, err := tx.Exec(`UPDATE tasks SET lease_expires_at = NULL WHERE id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("failed to release task: %w", err)
+		}
+		return nil
+	})
+}
+
+// leasedTask возвращает задачу, если её аренда ещё не истекла, и ErrTaskNotAvailable иначе
+func leasedTask(tx *sql.Tx, id string, now time.Time) (*models.Task, error) {
+	task, err := scanTask(tx.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task: %w", err)
+	}
+
+	if task.Completed || task.Cancelled || !task.Leased(now) {
+		return nil, ErrTaskNotAvailable
+	}
+	return task, nil
+}
+
+// leaseFirst арендует первую готовую задачу в порядке order
+func (r *SQLiteRepository) leaseFirst(order string, timeout time.Duration) (*models.Task, error) {
+	var task *models.Task
+
+	err := r.inTx(func(tx *sql.Tx) error {
+		now := r.now()
+
+		var err error
+		task, err = scanTask(tx.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE `+readyCondition+` ORDER BY `+order+` LIMIT 1`, now.UnixNano()))
+		if errors.Is(err, sql.ErrNoRows) {
+			task = nil
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get ready task: %w", err)
+		}
+
+		return leaseTask(tx, task, now, timeout)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return task, nil
+}
+
+func (r *SQLiteRepository) CompleteTask(id string, result float64) (*models.Expression, error) {
+	var completed *models.Expression
+	err := r.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			`UPDATE tasks SET result = ?, completed = 1, lease_expires_at = NULL WHERE id = ? AND completed = 0 AND cancelled = 0`,
+			result, id,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to complete task: %w", err)
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return taskUnavailable(tx, id)
+		}
+
+		if err := releaseDependents(tx, id); err != nil {
+			return err
+		}
+
+		var expressionID string
+		if err := tx.QueryRow(`SELECT expression_id FROM tasks WHERE id = ?`, id).Scan(&expressionID); err != nil {
+			return fmt.Errorf("failed to get task: %w", err)
+		}
+		res, err = tx.Exec(
+			`UPDATE expressions SET status = ?, result = ? WHERE id = ? AND root_task_id = ? AND status = ?`,
+			models.StatusCompleted, result, expressionID, id, models.StatusProcessing,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to complete expression: %w", err)
+		}
+		if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+			return err
+		}
+
+		completed, err = scanExpression(tx.QueryRow(`SELECT `+expressionColumns+` FROM expressions WHERE id = ?`, expressionID))
+		if err != nil {
+			return fmt.Errorf("failed to get expression: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return completed, nil
+}
+
+func (r *SQLiteRepository) FailTask(id string, message string) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			`UPDATE tasks SET error = ?, cancelled = 1, lease_expires_at = NULL WHERE id = ? AND completed = 0 AND cancelled = 0`,
+			message, id,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to fail task: %w", err)
+		}
+		if updated, err := res.RowsAffected(); err != nil || updated > 0 {
+			return err
+		}
+		return taskUnavailable(tx, id)
+	})
+}
+
+// taskUnavailable объясняет, почему условное обновление задачи не затронуло ни одной строки
+func taskUnavailable(tx *sql.Tx, id string) error {
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM tasks WHERE id = ?)`, id).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to get task: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, id)
+	}
+	return ErrTaskNotAvailable
+}
+
+func (r *SQLiteRepository) CancelTasks(expressionID string) error {
+	_, err := r.db.Exec(
+		`UPDATE tasks SET cancelled = 1, lease_expires_at = NULL WHERE expression_id = ? AND completed = 0`,
+		expressionID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to cancel tasks: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) ReleaseLeases() (int, error) {
+	res, err := r.db.Exec(`UPDATE tasks SET lease_expires_at = NULL WHERE completed = 0 AND cancelled = 0 AND lease_expires_at IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release leases: %w", err)
+	}
+
+	released, err := res.RowsAffected()
+	return int(released), err
+}
+
+func (r *SQLiteRepository) RebuildDependencies() (int, error) {
+	var fixed int64
+
+	err := r.inTx(func(tx *sql.Tx) error {
+		const actualPending = `(SELECT COUNT(*) FROM task_dependencies d
+			LEFT JOIN tasks dep ON dep.id = d.depends_on
+			WHERE d.task_id = tasks.id AND COALESCE(dep.completed, 0) = 0)`
+
+		res, err := tx.Exec(`UPDATE tasks SET pending_deps = ` + actualPending + ` WHERE completed = 0 AND pending_deps != ` + actualPending)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild dependency counters: %w", err)
+		}
+		if fixed, err = res.RowsAffected(); err != nil {
+			return err
+		}
+
+		// Задачи, у которых счётчик обнулился, встают в очередь готовых
+		rows, err := tx.Query(`SELECT id FROM tasks WHERE completed = 0 AND pending_deps = 0 AND ready_seq IS NULL ORDER BY rowid`)
+		if err != nil {
+			return fmt.Errorf("failed to list unqueued tasks: %w", err)
+		}
+		ids := []string{}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := markReady(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return int(fixed), err
+}
+
+func leaseTask(tx *sql.Tx, task *models.Task, now time.Time, timeout time.Duration) error {
+	leaseExpiresAt := now.Add(time.Duration(task.OperationTime)*time.Millisecond + timeout)
+	task.LeaseExpiresAt = &leaseExpiresAt
+	task.Attempts++
+
+	_, err := tx.Exec(`UPDATE tasks SET lease_expires_at = ?, attempts = ? WHERE id = ?`, leaseExpiresAt.UnixNano(), task.Attempts, task.ID)
+	if err != nil {
+		return fmt.Errorf("failed to lease task: %w", err)
+	}
+
+	return resolveArgs(tx, task)
+}
+
+// markReady присваивает задаче следующий номер в очереди готовых задач
+func markReady(tx *sql.Tx, taskID string) error {
+	if _, err := tx.Exec(`UPDATE ready_seq_counter SET value = value + 1 WHERE id = 1`); err != nil {
+		return fmt.Errorf("failed to advance ready sequence: %w", err)
+	}
+	_, err := tx.Exec(`UPDATE tasks SET ready_seq = (SELECT value FROM ready_seq_counter WHERE id = 1) WHERE id = ?`, taskID)
+	if err != nil {
+		return fmt.Errorf("failed to mark task ready: %w", err)
+	}
+	return nil
+}
+
+// releaseDependents уменьшает счётчики зависимостей у задач, ожидавших посчитанную задачу
+func releaseDependents(tx *sql.Tx, taskID string) error {
+	rows, err := tx.Query(`SELECT task_id FROM task_dependencies WHERE depends_on = ?`, taskID)
+	if err != nil {
+		return fmt.Errorf("failed to list dependents: %w", err)
+	}
+	dependents := []string{}
+	for rows.Next() {
+		var dependentID string
+		if err := rows.Scan(&dependentID); err != nil {
+			rows.Close()
+			return err
+		}
+		dependents = append(dependents, dependentID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, dependentID := range dependents {
+		var pending int
+		err := tx.QueryRow(`UPDATE tasks SET pending_deps = pending_deps - 1 WHERE id = ? RETURNING pending_deps`, dependentID).Scan(&pending)
+		if err != nil {
+			return fmt.Errorf("failed to update dependent %s: %w", dependentID, err)
+		}
+		if pending == 0 {
+			if err := markReady(tx, dependentID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveArgs заменяет аргументы-ссылки на задачи их результатами
+func resolveArgs(tx *sql.Tx, task *models.Task) error {
+	for _, depID := range task.Dependencies {
+		var result sql.NullFloat64
+		err := tx.QueryRow(`SELECT result FROM tasks WHERE id = ? AND completed = 1`, depID).Scan(&result)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !result.Valid) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resolve argument %s: %w", depID, err)
+		}
+
+		for i, arg := range task.Args {
+			if arg == depID {
+				task.Args[i] = strconv.FormatFloat(result.Float64, 'g', -1, 64)
+			}
+		}
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanExpression(row rowScanner) (*models.Expression, error) {
+	var expression models.Expression
+	var result sql.NullFloat64
+	var deadline sql.NullInt64
+	var submittedAt int64
+	var deliveries string
+
+	err := row.Scan(
+		&expression.ID, &expression.Expression, &expression.Status, &result, &expression.Error, &expression.RootTaskID,
+		&deadline, &expression.Priority, &expression.ClientID, &submittedAt, &expression.CallbackURL, &deliveries,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(deliveries), &expression.Deliveries); err != nil {
+		return nil, fmt.Errorf("failed to decode deliveries: %w", err)
+	}
+	if len(expression.Deliveries) == 0 {
+		expression.Deliveries = nil
+	}
+
+	expression.SubmittedAt = timeFromUnixNano(submittedAt)
+	if result.Valid {
+		expression.Result = &result.Float64
+	}
+	if deadline.Valid {
+		expiresAt := time.Unix(0, deadline.Int64)
+		expression.Deadline = &expiresAt
+	}
+	return &expression, nil
+}
+
+func scanTask(row rowScanner) (*models.Task, error) {
+	var task models.Task
+	var args, dependencies string
+	var result sql.NullFloat64
+	var leaseExpiresAt sql.NullInt64
+	var submittedAt int64
+
+	err := row.Scan(
+		&task.ID, &task.ExpressionID, &args, &dependencies, &task.Operation, &task.OperationTime, &result,
+		&task.Completed, &task.Cancelled, &task.Error, &leaseExpiresAt, &task.Attempts,
+		&task.Priority, &task.ClientID, &submittedAt, &task.Rank,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	task.SubmittedAt = timeFromUnixNano(submittedAt)
+	if err := json.Unmarshal([]byte(args), &task.Args); err != nil {
+		return nil, fmt.Errorf("failed to decode args: %w", err)
+	}
+	if err := json.Unmarshal([]byte(dependencies), &task.Dependencies); err != nil {
+		return nil, fmt.Errorf("failed to decode dependencies: %w", err)
+	}
+	if result.Valid {
+		task.Result = &result.Float64
+	}
+	if leaseExpiresAt.Valid {
+		expiresAt := time.Unix(0, leaseExpiresAt.Int64)
+		task.LeaseExpiresAt = &expiresAt
+	}
+	return &task, nil
+}
+
+func unixNanoOrNil(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+// unixNanoOrZero хранит нулевое время как 0, а не как переполненное UnixNano
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func timeFromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func expectAffected(res sql.Result, notFound error) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return notFound
+	}
+	return nil
+}
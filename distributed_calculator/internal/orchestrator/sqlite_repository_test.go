@@ -0,0 +1,139 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteRepository(t testing.TB, path string) (*SQLiteRepository, *fakeClock) {
+	t.Helper()
+
+	repo, err := NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	repo.now = clock.Now
+	return repo, clock
+}
+
+func TestSQLiteRepositoryPersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calculator.db")
+	repo, _ := newTestSQLiteRepository(t, path)
+
+	_ = repo.SaveExpression(&models.Expression{ID: "e1", Expression: "(1 + 2) * 3", Status: models.StatusProcessing, RootTaskID: "t2"})
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition, OperationTime: 100})
+	_ = repo.SaveTask(&models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"t1", "3"}, Operation: models.Multiplication, Dependencies: []string{"t1"}})
+	completeTask(t, repo, "t1", 3)
+	repo.Close()
+
+	reopened, _ := newTestSQLiteRepository(t, path)
+
+	expression, err := reopened.GetExpressionByID("e1")
+	if err != nil || expression.Status != models.StatusProcessing || expression.RootTaskID != "t2" {
+		t.Fatalf("Expression was not persisted: %+v (%v)", expression, err)
+	}
+
+	task, err := reopened.LeaseNextTask(time.Second)
+	if err != nil || task == nil || task.ID != "t2" {
+		t.Fatalf("Expected t2 to be ready after reopen, got %+v (%v)", task, err)
+	}
+	if task.Args[0] != "3" || task.Args[1] != "3" {
+		t.Errorf("Expected resolved arguments [3 3], got %v", task.Args)
+	}
+
+	completeTask(t, reopened, "t2", 9)
+	expression, _ = reopened.GetExpressionByID("e1")
+	if expression.Status != models.StatusCompleted || expression.Result == nil || *expression.Result != 9 {
+		t.Errorf("Expected expression to complete with 9, got %+v", expression)
+	}
+}
+
+func TestSQLiteMigrationsAreApplied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calculator.db")
+	repo, _ := newTestSQLiteRepository(t, path)
+	repo.Close()
+
+	// Повторное открытие не должно применять миграции заново
+	reopened, _ := newTestSQLiteRepository(t, path)
+
+	var version, count int
+	if err := reopened.db.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&version, &count); err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if version != len(migrations) || count != len(migrations) {
+		t.Errorf("Expected schema version %d, got version %d with %d rows", len(migrations), version, count)
+	}
+}
+
+func TestSQLiteReadyOrderSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calculator.db")
+	repo, _ := newTestSQLiteRepository(t, path)
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"1", "2"}, Operation: models.Addition})
+	_ = repo.SaveTask(&models.Task{ID: "t2", ExpressionID: "e1", Args: []string{"3", "4"}, Operation: models.Addition})
+	repo.Close()
+
+	// Номер готовности новой задачи продолжает счётчик, а не начинается заново
+	reopened, _ := newTestSQLiteRepository(t, path)
+	_ = reopened.SaveTask(&models.Task{ID: "t3", ExpressionID: "e1", Args: []string{"5", "6"}, Operation: models.Addition})
+
+	for _, expected := range []string{"t1", "t2", "t3"} {
+		task, err := reopened.LeaseNextTask(time.Second)
+		if err != nil || task == nil || task.ID != expected {
+			t.Fatalf("Expected %s to be leased next, got %+v (%v)", expected, task, err)
+		}
+	}
+}
+
+func TestSQLiteRepositoryLeases(t *testing.T) {
+	repo, clock := newTestSQLiteRepository(t, filepath.Join(t.TempDir(), "calculator.db"))
+	_ = repo.SaveTask(&models.Task{ID: "t1", ExpressionID: "e1", Args: []string{"2", "3"}, Operation: models.Addition, OperationTime: 500})
+
+	task, err := repo.LeaseTask("t1", time.Second)
+	if err != nil || task.Attempts != 1 || task.LeaseExpiresAt == nil {
+		t.Fatalf("Failed to lease task: %+v (%v)", task, err)
+	}
+	if _, err := repo.LeaseTask("t1", time.Second); !errors.Is(err, ErrTaskNotAvailable) {
+		t.Errorf("Expected ErrTaskNotAvailable for leased task, got %v", err)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	task, err = repo.LeaseNextTask(time.Second)
+	if err != nil || task == nil || task.Attempts != 2 {
+		t.Fatalf("Expected task to be reassigned after lease expiry, got %+v (%v)", task, err)
+	}
+
+	_ = repo.CancelTasks("e1")
+	clock.Advance(time.Minute)
+	if task, _ := repo.LeaseNextTask(time.Second); task != nil {
+		t.Errorf("Expected no ready tasks after cancellation, got %+v", task)
+	}
+}
+
+func TestSQLiteRepositoryRunsExpressions(t *testing.T) {
+	repo, _ := newTestSQLiteRepository(t, filepath.Join(t.TempDir(), "calculator.db"))
+	service := NewService(repo, map[models.Operation]int64{}, time.Minute)
+
+	ids := []string{}
+	for _, expression := range []string{"2 + 2 * 2", "(1 + 2) * (3 + 4) - 5 / 5", "-(2 + 3) * 4"} {
+		created, err := service.ProcessExpression(expression)
+		if err != nil {
+			t.Fatalf("Failed to process expression: %v", err)
+		}
+		ids = append(ids, created.ID)
+	}
+
+	runAgents(t, service, 4)
+
+	for i, expected := range []float64{6, 20, -20} {
+		stored, _ := service.GetExpressionByID(ids[i])
+		if stored.Status != models.StatusCompleted || stored.Result == nil || *stored.Result != expected {
+			t.Errorf("Expected expression %d to complete with %g, got %+v", i, expected, stored)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package orchestrator
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"distributed-calculator/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader содержит "sha256=" и HMAC-SHA256 тела запроса в hex,
+	// посчитанный с секретом оркестратора (см. SignWebhook)
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookAttemptHeader - номер попытки доставки, начиная с 1
+	WebhookAttemptHeader = "X-Webhook-Attempt"
+
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = time.Second
+	maxWebhookBackoff      = time.Minute
+	webhookRequestTimeout  = 10 * time.Second
+)
+
+// ErrInvalidCallbackURL возвращается на callback_url, который не является абсолютным http(s)-адресом
+var ErrInvalidCallbackURL = errors.New("invalid callback_url")
+
+// errForbiddenCallbackAddress - callback_url указывает на внутренний адрес оркестратора
+var errForbiddenCallbackAddress = errors.New("callback address is not allowed")
+
+// WebhookSender отправляет итоги выражений на их callback_url. Неудачная попытка
+// повторяется через backoff, который удваивается с каждой попыткой (но не больше минуты).
+type WebhookSender struct {
+	client          *http.Client
+	secret          string
+	maxAttempts     int
+	backoff         time.Duration
+	allowedNetworks []*net.IPNet
+}
+
+// Пустой secret отключает подпись запросов
+func NewWebhookSender(secret string, maxAttempts int, backoff time.Duration) *WebhookSender {
+	sender := &WebhookSender{
+		secret:      secret,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+
+	// Адрес проверяется после разрешения имени, при каждом соединении, поэтому его
+	// не обойти ни DNS-записью, ни редиректом. Прокси из окружения не используется,
+	// иначе проверялся бы адрес прокси.
+	dialer := &net.Dialer{Timeout: webhookRequestTimeout, Control: sender.control}
+	sender.client = &http.Client{
+		Timeout:   webhookRequestTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	return sender
+}
+
+// SetAllowedNetworks разрешает доставку во внутренние сети networks
+func (w *WebhookSender) SetAllowedNetworks(networks []*net.IPNet) {
+	w.allowedNetworks = networks
+}
+
+// ParseNetworks разбирает список подсетей через запятую, например "10.0.0.0/8,127.0.0.1/32"
+func ParseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// addressAllowed запрещает loopback, частные, link-local (в том числе 169.254.169.254),
+// multicast и нулевые адреса, если они не входят в разрешённые сети
+func (w *WebhookSender) addressAllowed(ip net.IP) bool {
+	for _, network := range w.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+func (w *WebhookSender) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !w.addressAllowed(ip) {
+		return fmt.Errorf("%w: %s", errForbiddenCallbackAddress, host)
+	}
+	return nil
+}
+
+// SignWebhook возвращает значение заголовка WebhookSignatureHeader для тела body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post делает одну попытку доставки. Доставка удалась, если получатель ответил 2xx.
+func (w *WebhookSender) post(callbackURL string, body []byte, attempt int) models.WebhookDelivery {
+	delivery := models.WebhookDelivery{Attempt: attempt}
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookAttemptHeader, strconv.Itoa(attempt))
+	if w.secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !delivery.Delivered {
+		delivery.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return delivery
+}
+
+// delay - пауза перед попыткой attempt (начиная со второй)
+func (w *WebhookSender) delay(attempt int) time.Duration {
+	delay := w.backoff
+	for i := 2; i < attempt && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxWebhookBackoff {
+		delay = maxWebhookBackoff
+	}
+	return delay
+}
+
+// SetWebhookSender меняет секрет подписи и расписание повторов доставки итогов
+func (s *Service) SetWebhookSender(sender *WebhookSender) {
+	s.webhooks = sender
+}
+
+func validateCallbackURL(callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+
+	parsed, err := url.Parse(callbackURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%w: %q is not an absolute http(s) URL", ErrInvalidCallbackURL, callbackURL)
+	}
+	return nil
+}
+
+// webhookPending сообщает, что итог выражения нужно отправить на его callback_url.
+// Итогом считается любой финальный статус, в том числе TIMEOUT и CANCELLED.
+func (s *Service) webhookPending(expression *models.Expression) bool {
+	if expression.CallbackURL == "" || expression.Delivered() || len(expression.Deliveries) >= s.webhooks.maxAttempts {
+		return false
+	}
+	return expression.Status.Final()
+}
+
+// deliverResult отправляет итог выражения на его callback_url в фоне. Попытки
+// сохраняются в хранилище, поэтому после перезапуска Recover продолжает доставку
+// с того места, где она остановилась.
+func (s *Service) deliverResult(expression *models.Expression) {
+	if !s.webhookPending(expression) {
+		return
+	}
+
+	payload := *expression
+	payload.Deliveries = nil
+	body, err := json.Marshal(models.ExpressionResponse{Expression: payload})
+	if err != nil {
+		log.Printf("Failed to encode webhook for expression %s: %v", expression.ID, err)
+		return
+	}
+
+	go s.deliverWebhook(expression.ID, expression.CallbackURL, body, len(expression.Deliveries))
+}
+
+func (s *Service) deliverWebhook(expressionID string, callbackURL string, body []byte, attempts int) {
+	sender := s.webhooks
+	for attempt := attempts + 1; attempt <= sender.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(sender.delay(attempt))
+		}
+
+		delivery := sender.post(callbackURL, body, attempt)
+		delivery.At = s.now()
+		if err := s.repo.RecordDelivery(expressionID, delivery); err != nil {
+			log.Printf("Failed to record webhook delivery for expression %s: %v", expressionID, err)
+		}
+
+		if delivery.Delivered {
+			return
+		}
+		log.Printf("Webhook for expression %s failed (attempt %d of %d): %s", expressionID, attempt, sender.maxAttempts, delivery.Error)
+	}
+
+	log.Printf("Giving up webhook for expression %s after %d attempts", expressionID, sender.maxAttempts)
+}
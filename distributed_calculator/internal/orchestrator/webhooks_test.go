@@ -0,0 +1,328 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver отвечает статусами из statuses по очереди, а затем 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, body)
+
+	status := http.StatusOK
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// newTestWebhookSender разрешает доставку на loopback, где слушает httptest.Server
+func newTestWebhookSender(t *testing.T, secret string, maxAttempts int) *WebhookSender {
+	t.Helper()
+
+	networks, err := ParseNetworks("127.0.0.0/8, ::1/128")
+	if err != nil {
+		t.Fatalf("Failed to parse networks: %v", err)
+	}
+	sender := NewWebhookSender(secret, maxAttempts, time.Millisecond)
+	sender.SetAllowedNetworks(networks)
+	return sender
+}
+
+func newWebhookTestService(t *testing.T, secret string, maxAttempts int) (*Service, *InMemoryRepository) {
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	service.SetWebhookSender(newTestWebhookSender(t, secret, maxAttempts))
+	return service, repo
+}
+
+// waitForDeliveries ждёт, пока у выражения накопится count попыток доставки
+func waitForDeliveries(t *testing.T, service *Service, id string, count int) *models.Expression {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		expression, err := service.GetExpressionByID(id)
+		if err != nil {
+			t.Fatalf("Failed to get expression: %v", err)
+		}
+		if len(expression.Deliveries) >= count {
+			return expression
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d deliveries, got %+v", count, expression.Deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookRetriesUntilDelivered(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	service, _ := newWebhookTestService(t, "secret", 5)
+	expression, err := service.ProcessRequest(models.CalculateRequest{Expression: "2 + 3", CallbackURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	task, err := service.GetTaskForProcessing()
+	if err != nil || task == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", task, err)
+	}
+	if err := service.ProcessTaskResult(task.ID, evaluateTestTask(t, task)); err != nil {
+		t.Fatalf("Failed to process task result: %v", err)
+	}
+
+	delivered := waitForDeliveries(t, service, expression.ID, 3)
+	if !delivered.Delivered() || len(delivered.Deliveries) != 3 {
+		t.Fatalf("Expected delivery on third attempt, got %+v", delivered.Deliveries)
+	}
+	for i, status := range []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK} {
+		if delivery := delivered.Deliveries[i]; delivery.Attempt != i+1 || delivery.StatusCode != status || delivery.At.IsZero() {
+			t.Errorf("Delivery %d: expected status %d, got %+v", i, status, delivery)
+		}
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for i, req := range receiver.requests {
+		if attempt := req.Header.Get(WebhookAttemptHeader); attempt != strconv.Itoa(i+1) {
+			t.Errorf("Expected attempt %d, got %s", i+1, attempt)
+		}
+		if signature := req.Header.Get(WebhookSignatureHeader); signature != SignWebhook("secret", receiver.bodies[i]) {
+			t.Errorf("Invalid signature %q", signature)
+		}
+	}
+
+	var payload models.ExpressionResponse
+	if err := json.Unmarshal(receiver.bodies[2], &payload); err != nil {
+		t.Fatalf("Failed to decode payload: %v", err)
+	}
+	if payload.Expression.ID != expression.ID || payload.Expression.Status != models.StatusCompleted ||
+		payload.Expression.Result == nil || *payload.Expression.Result != 5 || payload.Expression.Deliveries != nil {
+		t.Errorf("Unexpected payload: %+v", payload.Expression)
+	}
+}
+
+func TestWebhookSentOnceForDuplicateResults(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	service, _ := newWebhookTestService(t, "secret", 5)
+	expression, err := service.ProcessRequest(models.CalculateRequest{Expression: "2 + 3", CallbackURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	task, err := service.GetTaskForProcessing()
+	if err != nil || task == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", task, err)
+	}
+
+	// Результат корневой задачи одновременно присылают несколько агентов,
+	// например после истечения аренды
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := service.ProcessTaskResult(task.ID, 5); err != nil {
+				t.Errorf("Failed to process task result: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitForDeliveries(t, service, expression.ID, 1)
+	time.Sleep(50 * time.Millisecond)
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.requests) != 1 {
+		t.Errorf("Expected webhook to be sent once, got %d requests", len(receiver.requests))
+	}
+}
+
+func TestWebhookGivesUpAfterMaxAttempts(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{500, 500, 500, 500}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	service, _ := newWebhookTestService(t, "", 3)
+	expression, err := service.ProcessRequest(models.CalculateRequest{Expression: "1 / 0", CallbackURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	task, err := service.GetTaskForProcessing()
+	if err != nil || task == nil {
+		t.Fatalf("Failed to get task: %+v (%v)", task, err)
+	}
+	if err := service.ProcessTaskFailure(task.ID, "division by zero"); err != nil {
+		t.Fatalf("Failed to process task failure: %v", err)
+	}
+
+	failed := waitForDeliveries(t, service, expression.ID, 3)
+	// Даём шанс лишней попытке, если бы она была
+	time.Sleep(20 * time.Millisecond)
+	if failed, _ = service.GetExpressionByID(expression.ID); failed.Delivered() || len(failed.Deliveries) != 3 {
+		t.Errorf("Expected 3 failed deliveries, got %+v", failed.Deliveries)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if signature := receiver.requests[0].Header.Get(WebhookSignatureHeader); signature != "" {
+		t.Errorf("Expected unsigned request without secret, got %q", signature)
+	}
+
+	var payload models.ExpressionResponse
+	if err := json.Unmarshal(receiver.bodies[0], &payload); err != nil || payload.Expression.Status != models.StatusError {
+		t.Errorf("Expected ERROR payload, got %+v (%v)", payload.Expression, err)
+	}
+}
+
+func TestWebhookDeliversTimedOutExpression(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	repo, clock := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	service.SetClock(clock.Now)
+	service.SetWebhookSender(newTestWebhookSender(t, "secret", 5))
+	expression, err := service.ProcessRequest(models.CalculateRequest{Expression: "2 + 3", TimeoutMs: 1000, CallbackURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if expired, err := service.ExpireDeadlines(); err != nil || expired != 1 {
+		t.Fatalf("Expected one expired expression, got %d (%v)", expired, err)
+	}
+
+	if delivered := waitForDeliveries(t, service, expression.ID, 1); !delivered.Delivered() {
+		t.Fatalf("Expected delivery of timed out expression, got %+v", delivered.Deliveries)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	var payload models.ExpressionResponse
+	if err := json.Unmarshal(receiver.bodies[0], &payload); err != nil || payload.Expression.Status != models.StatusTimeout {
+		t.Errorf("Expected TIMEOUT payload, got %+v (%v)", payload.Expression, err)
+	}
+}
+
+func TestRecoverResumesWebhooks(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	service, repo := newWebhookTestService(t, "secret", 5)
+	result := 4.0
+	expressions := []*models.Expression{
+		{ID: "interrupted", Expression: "2 + 2", Status: models.StatusCompleted, Result: &result, CallbackURL: server.URL},
+		{ID: "delivered", Expression: "2 + 2", Status: models.StatusCompleted, Result: &result, CallbackURL: server.URL},
+		{ID: "cancelled", Expression: "2 + 2", Status: models.StatusCancelled, CallbackURL: server.URL},
+	}
+	for _, expression := range expressions {
+		if err := repo.SaveExpression(expression); err != nil {
+			t.Fatalf("Failed to save expression: %v", err)
+		}
+	}
+	_ = repo.RecordDelivery("interrupted", models.WebhookDelivery{Attempt: 1, StatusCode: 502})
+	_ = repo.RecordDelivery("delivered", models.WebhookDelivery{Attempt: 1, StatusCode: 200, Delivered: true})
+
+	report, err := service.Recover()
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if report.ResumedWebhooks != 2 {
+		t.Errorf("Expected 2 resumed webhooks, got %d", report.ResumedWebhooks)
+	}
+
+	resumed := waitForDeliveries(t, service, "interrupted", 2)
+	if delivery := resumed.Deliveries[1]; delivery.Attempt != 2 || !delivery.Delivered {
+		t.Errorf("Expected second attempt to be delivered, got %+v", delivery)
+	}
+	if cancelled := waitForDeliveries(t, service, "cancelled", 1); !cancelled.Delivered() {
+		t.Errorf("Expected cancelled expression to be delivered, got %+v", cancelled.Deliveries)
+	}
+}
+
+func TestProcessRequestRejectsInvalidCallbackURL(t *testing.T) {
+	service, _ := newWebhookTestService(t, "", 1)
+
+	for _, callbackURL := range []string{"example.com/hook", "ftp://example.com/hook", "http://", "://"} {
+		if _, err := service.ProcessRequest(models.CalculateRequest{Expression: "1 + 1", CallbackURL: callbackURL}); !errors.Is(err, ErrInvalidCallbackURL) {
+			t.Errorf("Expected ErrInvalidCallbackURL for %q, got %v", callbackURL, err)
+		}
+	}
+}
+
+func TestWebhookRefusesInternalAddresses(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	repo, _ := newTestRepository()
+	service := NewService(repo, map[models.Operation]int64{}, time.Second)
+	service.SetWebhookSender(NewWebhookSender("secret", 1, time.Millisecond))
+
+	expression, err := service.ProcessRequest(models.CalculateRequest{Expression: "2 + 3", CallbackURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to process expression: %v", err)
+	}
+	if _, err := service.CancelExpression(expression.ID); err != nil {
+		t.Fatalf("Failed to cancel expression: %v", err)
+	}
+
+	refused := waitForDeliveries(t, service, expression.ID, 1)
+	if delivery := refused.Deliveries[0]; delivery.Delivered || !strings.Contains(delivery.Error, errForbiddenCallbackAddress.Error()) {
+		t.Errorf("Expected delivery to loopback to be refused, got %+v", delivery)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.requests) != 0 {
+		t.Errorf("Expected no requests to reach the receiver, got %d", len(receiver.requests))
+	}
+
+	sender := NewWebhookSender("", 1, time.Millisecond)
+	for address, allowed := range map[string]bool{
+		"169.254.169.254":  false,
+		"10.1.2.3":         false,
+		"192.168.0.1":      false,
+		"0.0.0.0":          false,
+		"::ffff:127.0.0.1": false,
+		"fe80::1":          false,
+		"8.8.8.8":          true,
+		"2001:4860::8888":  true,
+	} {
+		if got := sender.addressAllowed(net.ParseIP(address)); got != allowed {
+			t.Errorf("addressAllowed(%s) = %v, expected %v", address, got, allowed)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package orchestrator
+
+import (
+	"context"
+	"distributed-calculator/internal/calculator"
+	"distributed-calculator/internal/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxMessageSize = maxRequestBodySize
+	// wsOutboxSize - сколько кадров может ждать отправки медленному клиенту,
+	// прежде чем соединение перестанет читать новые выражения
+	wsOutboxSize = 64
+	// wsMaxActive ограничивает число выражений, за которыми одновременно следит одно соединение
+	wsMaxActive = 100
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// WebSocketHandler принимает выражения кадрами {"expression": ...} и присылает
+// кадры {"id", "status", "result"} по мере их вычисления
+func (h *Handlers) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade уже ответил клиенту ошибкой
+		return
+	}
+
+	newWSSession(h.service, conn, h.clientID(r)).run()
+}
+
+// wsSession - одно соединение /api/v1/ws. Соединение читает только один цикл,
+// а пишет только writeLoop; на каждое выражение заводится подписка, события
+// которой пересылает forward. Если клиент не успевает читать, очередь outbox
+// заполняется, и соединение перестаёт принимать новые выражения, а из событий
+// каждого выражения сохраняются последние (см. Subscription).
+type wsSession struct {
+	service  *Service
+	conn     *websocket.Conn
+	clientID string
+	outbox   chan models.WSResponse
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu         sync.Mutex
+	active     int
+	forwarders sync.WaitGroup
+}
+
+func newWSSession(service *Service, conn *websocket.Conn, clientID string) *wsSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &wsSession{
+		service:  service,
+		conn:     conn,
+		clientID: clientID,
+		outbox:   make(chan models.WSResponse, wsOutboxSize),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// run обслуживает соединение, пока клиент его не закроет, и отменяет все его подписки
+func (s *wsSession) run() {
+	defer s.conn.Close()
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		s.writeLoop()
+	}()
+
+	s.readLoop()
+
+	s.cancel()
+	s.forwarders.Wait()
+	<-written
+}
+
+func (s *wsSession) readLoop() {
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	_ = s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var request models.WSRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			if !s.send(models.WSResponse{Error: "Invalid request body"}) {
+				return
+			}
+			continue
+		}
+
+		if !s.submit(request) {
+			return
+		}
+	}
+}
+
+// submit отправляет выражение на вычисление и подписывает соединение на его события.
+// Возвращает false, если соединение закрывается.
+func (s *wsSession) submit(request models.WSRequest) bool {
+	if request.Expression == "" {
+		return s.send(models.WSResponse{Ref: request.Ref, Error: "Expression is required"})
+	}
+
+	s.mu.Lock()
+	full := s.active >= wsMaxActive
+	s.mu.Unlock()
+	if full {
+		return s.send(models.WSResponse{Ref: request.Ref, Error: "Too many expressions in progress"})
+	}
+
+	request.ClientID = s.clientID
+	expression, err := s.service.ProcessRequest(request.CalculateRequest)
+	if err != nil {
+		response := models.WSResponse{Ref: request.Ref, Error: err.Error()}
+		var parseErr *calculator.ParseError
+		if errors.As(err, &parseErr) {
+			response.Error = parseErr.Error()
+			response.Column = parseErr.Column()
+		}
+		return s.send(response)
+	}
+
+	// Подписываемся до чтения состояния, чтобы не пропустить изменения между ними
+	subscription := s.service.Subscribe(expression.ID)
+	event, err := s.service.ExpressionEvent(expression.ID)
+	if err != nil {
+		s.service.Unsubscribe(subscription)
+		return s.send(models.WSResponse{Ref: request.Ref, ID: expression.ID, Error: err.Error()})
+	}
+
+	response := wsResponse(event)
+	response.Ref = request.Ref
+	if event.Type == models.EventResult {
+		s.service.Unsubscribe(subscription)
+		return s.send(response)
+	}
+
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+	s.forwarders.Add(1)
+	go s.forward(subscription)
+
+	return s.send(response)
+}
+
+// forward пересылает клиенту события выражения до итогового
+func (s *wsSession) forward(subscription *Subscription) {
+	defer s.forwarders.Done()
+	defer func() {
+		s.service.Unsubscribe(subscription)
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case event := <-subscription.Events():
+			if !s.send(wsResponse(event)) || event.Type == models.EventResult {
+				return
+			}
+		}
+	}
+}
+
+// send ставит кадр в очередь отправки и ждёт, если клиент не успевает читать.
+// Возвращает false, если соединение закрывается.
+func (s *wsSession) send(response models.WSResponse) bool {
+	select {
+	case s.outbox <- response:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *wsSession) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+			return
+		case response := <-s.outbox:
+			_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := s.conn.WriteJSON(response); err != nil {
+				s.abort()
+				return
+			}
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				s.abort()
+				return
+			}
+		}
+	}
+}
+
+// abort закрывает соединение, которому не удалось писать: readLoop получит ошибку и завершит сессию
+func (s *wsSession) abort() {
+	s.cancel()
+	_ = s.conn.Close()
+}
+
+func wsResponse(event models.ExpressionEvent) models.WSResponse {
+	return models.WSResponse{
+		ID:         event.ID,
+		Status:     event.Status,
+		Result:     event.Result,
+		Error:      event.Error,
+		TasksDone:  event.TasksDone,
+		TasksTotal: event.TasksTotal,
+	}
+}
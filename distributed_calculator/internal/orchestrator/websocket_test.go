@@ -0,0 +1,102 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketHandler(t *testing.T) {
+	handlers := newTestHandlers()
+	server := httptest.NewServer(http.HandlerFunc(handlers.WebSocketHandler))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	next := func() models.WSResponse {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var response models.WSResponse
+		if err := conn.ReadJSON(&response); err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		return response
+	}
+
+	for _, request := range []models.WSRequest{
+		{CalculateRequest: models.CalculateRequest{Expression: "2 * 3"}, Ref: "a"},
+		{CalculateRequest: models.CalculateRequest{Expression: "2 +"}, Ref: "bad"},
+		{CalculateRequest: models.CalculateRequest{Expression: "10 - 4"}, Ref: "b"},
+	} {
+		if err := conn.WriteJSON(request); err != nil {
+			t.Fatalf("Failed to send expression: %v", err)
+		}
+	}
+
+	ids := map[string]string{}
+	for i := 0; i < 3; i++ {
+		response := next()
+		switch response.Ref {
+		case "bad":
+			if response.Error == "" || response.Column != 4 || response.ID != "" {
+				t.Errorf("Expected parse error at column 4, got %+v", response)
+			}
+		case "a", "b":
+			if response.ID == "" || response.Status != models.StatusProcessing || response.TasksTotal != 1 {
+				t.Errorf("Expected accepted expression, got %+v", response)
+			}
+			ids[response.ID] = response.Ref
+		default:
+			t.Fatalf("Unexpected frame %+v", response)
+		}
+	}
+	if len(ids) != 2 {
+		t.Fatalf("Expected two accepted expressions, got %v", ids)
+	}
+
+	for i := 0; i < 2; i++ {
+		task, err := handlers.service.GetTaskForProcessing()
+		if err != nil || task == nil {
+			t.Fatalf("Failed to get task: %+v (%v)", task, err)
+		}
+		if err := handlers.service.ProcessTaskResult(task.ID, evaluateTestTask(t, task)); err != nil {
+			t.Fatalf("Failed to process task result: %v", err)
+		}
+	}
+
+	expected := map[string]float64{"a": 6, "b": 6}
+	for i := 0; i < 2; i++ {
+		response := next()
+		ref, found := ids[response.ID]
+		if !found || response.Status != models.StatusCompleted || response.Result == nil || *response.Result != expected[ref] {
+			t.Errorf("Expected completed expression, got %+v", response)
+		}
+		delete(ids, response.ID)
+	}
+
+	// Подписки соединения снимаются, когда клиент уходит
+	if err := conn.WriteJSON(models.WSRequest{CalculateRequest: models.CalculateRequest{Expression: "5 + 5"}}); err != nil {
+		t.Fatalf("Failed to send expression: %v", err)
+	}
+	pending := next()
+	if !handlers.service.events.Subscribed(pending.ID) {
+		t.Fatalf("Expected connection to follow %s", pending.ID)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for handlers.service.events.Subscribed(pending.ID) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Subscription of closed connection was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}